@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// answerTTL is how long the buttons below an answer keep working
+const answerTTL = 7 * 24 * time.Hour
+
+// continuePrompt asks a model to resume an answer that hit the length limit
+const continuePrompt = "Continue your previous answer exactly where it stopped, without repeating what you already wrote."
+
+// Answer is a model's reply to a user message, the buttons below it act on the turn it answers
+type Answer struct {
+	UserID     int64   `json:"user_id"`
+	Thread     string  `json:"thread"`      // Conversation the answer belongs to
+	TurnID     string  `json:"turn_id"`     // ID of the answered user message in the history
+	PromptID   int64   `json:"prompt_id"`   // Telegram message the answer replies to
+	MessageIDs []int64 `json:"message_ids"` // Messages that make up the answer
+	Label      string  `json:"label"`       // Shown instead of the model name in blind mode
+	Truncated  bool    `json:"truncated"`   // Whether the model stopped at the length limit
+	Reasoning  bool    `json:"reasoning"`   // Whether the reasoning behind the answer can be shown
+
+	// Answers that aren't a turn of a conversation, like a synthesis, keep the request that
+	// produced them, so it can be sent again, and the notes above them
+	Request []Message `json:"request,omitempty"`
+	Notes   []string  `json:"notes,omitempty"`
+}
+
+// newMessageID returns an ID for a message in the history, so its turn can be found
+// even after older turns were summarized
+func newMessageID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// saveAnswer stores the answer under its first message and adds it to the answers of the
+// message it replies to, so an edit of that message can find it
+func saveAnswer(ctx context.Context, answer Answer) error {
+	data, err := json.Marshal(answer)
+	if err != nil {
+		return fmt.Errorf("json marshal error: %w", err)
+	}
+	answersKey := fmt.Sprintf("message:%d:answers", answer.PromptID)
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("message:%d:answer", answer.MessageIDs[0]), data, answerTTL)
+	pipe.RPush(ctx, answersKey, answer.MessageIDs[0])
+	pipe.Expire(ctx, answersKey, answerTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis transaction error: %w", err)
+	}
+	return nil
+}
+
+// getAnswer returns the answer starting with messageID, or nil if there is none
+func getAnswer(ctx context.Context, messageID int64) (*Answer, error) {
+	key := fmt.Sprintf("message:%d:answer", messageID)
+	data, err := rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis get error: %w", err)
+	}
+	var answer Answer
+	if err := json.Unmarshal([]byte(data), &answer); err != nil {
+		return nil, fmt.Errorf("json unmarshal error: %w", err)
+	}
+	return &answer, nil
+}
+
+// getPromptAnswers returns the latest answer of every conversation that answered the message
+func getPromptAnswers(ctx context.Context, promptID int64) ([]Answer, error) {
+	key := fmt.Sprintf("message:%d:answers", promptID)
+	ids, err := rdb.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis lrange error: %w", err)
+	}
+
+	// Regenerated answers are added again, the last one of a thread is the current one
+	latest := make(map[string]int)
+	var answers []Answer
+	for _, idText := range ids {
+		messageID, err := strconv.ParseInt(idText, 10, 64)
+		if err != nil {
+			continue
+		}
+		answer, err := getAnswer(ctx, messageID)
+		if err != nil {
+			return nil, err
+		}
+		if answer == nil {
+			continue
+		}
+		if i, ok := latest[answer.Thread]; ok {
+			answers[i] = *answer
+			continue
+		}
+		latest[answer.Thread] = len(answers)
+		answers = append(answers, *answer)
+	}
+	return answers, nil
+}
+
+// answerRequest streams the answer to answer.Request into a reply to msg. The reply starts
+// answer.Thread with the user's content, so replying to it continues from there, and is saved
+// with its buttons like the answers of respondWithModel.
+func answerRequest(ctx context.Context, b *gotgbot.Bot, msg *gotgbot.Message, userID int64, username string, answer Answer, content MessageContent) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.ModelTimeoutSecs)*time.Second)
+	defer cancel()
+	model := threadModel(answer.Thread)
+
+	reply, err := startStreamingReply(b, msg, model, "", "", answer.Notes)
+	if err != nil {
+		return err
+	}
+	resp, err := streamModel(ctx, userID, username, answer.Request, model, ChatOptions{}, reply.SetModel, reply.Update)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		reply.Fail(answerErrorMessage(err))
+		return fmt.Errorf("model %s failed: %w", model, err)
+	}
+	logMessage(userID, username, "ai_response", fmt.Sprintf("[%s via %s] %s", answer.Thread, resp.Model, resp.Content))
+
+	// The thread continues from the user's message, not from the request
+	answer.TurnID = newMessageID()
+	history := []Message{
+		{ID: answer.TurnID, Role: "user", Content: content},
+		{Role: "assistant", Content: TextContent(resp.Content), Model: resp.Model},
+	}
+	if err := saveConversationHistory(context.Background(), userID, answer.Thread, history); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save conversation history", answer.Thread))
+	}
+	if err := addUserThread(context.Background(), userID, answer.Thread); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save thread: %v", answer.Thread, err))
+	}
+
+	answer.Truncated = resp.FinishReason == "length"
+	answer.Reasoning = false
+	if resp.Reasoning != "" {
+		if err := saveReasoning(context.Background(), reply.MessageID(), resp.Reasoning); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save reasoning: %v", answer.Thread, err))
+		} else {
+			answer.Reasoning = true
+		}
+	}
+
+	messageIDs, err := reply.Finish(resp.Content, answerButtons(reply.MessageID(), answer))
+	answer.MessageIDs = messageIDs
+	if err := saveAnswer(context.Background(), answer); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save answer: %v", answer.Thread, err))
+	}
+	for _, messageID := range messageIDs {
+		if err := saveMessageModel(context.Background(), messageID, answer.Thread); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save message model mapping", answer.Thread))
+		}
+	}
+	return err
+}
+
+// restoreHistory saves a thread's history again after the answer that should have replaced its
+// rewound part failed. Nothing is saved if the conversation changed meanwhile, or was restarted,
+// which cancels ctx.
+func restoreHistory(ctx context.Context, userID int64, username string, thread string, rewound []Message, history []Message) {
+	if ctx.Err() != nil {
+		return
+	}
+	current, err := getConversationHistory(context.Background(), userID, thread)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to get conversation history", thread))
+		return
+	}
+	if len(current) != len(rewound) || !hasHistoryPrefix(current, rewound) {
+		return
+	}
+	if err := saveConversationHistory(context.Background(), userID, thread, history); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to restore conversation history", thread))
+	}
+}
+
+// answerButtons returns the buttons below the answer starting with messageID.
+// Continue is only offered when the answer was cut off.
+func answerButtons(messageID int64, answer Answer) [][]gotgbot.InlineKeyboardButton {
+	row := []gotgbot.InlineKeyboardButton{
+		{Text: "🔁 Regenerate", CallbackData: fmt.Sprintf("answer:regen:%d", messageID)},
+	}
+	if answer.Truncated {
+		row = append(row, gotgbot.InlineKeyboardButton{Text: "➡️ Continue", CallbackData: fmt.Sprintf("answer:cont:%d", messageID)})
+	}
+	row = append(row, gotgbot.InlineKeyboardButton{Text: "🔀 Ask another model", CallbackData: fmt.Sprintf("answer:switch:%d", messageID)})
+
+	buttons := [][]gotgbot.InlineKeyboardButton{row}
+	if answer.Reasoning {
+		buttons = append(buttons, []gotgbot.InlineKeyboardButton{reasoningButton(messageID)})
+	}
+	return buttons
+}
+
+// findTurn returns the index of the user message with the given ID in the history, or -1
+func findTurn(history []Message, turnID string) int {
+	for i, message := range history {
+		if message.Role == "user" && message.ID == turnID {
+			return i
+		}
+	}
+	return -1
+}
+
+// isLatestTurn reports whether no user message follows the one at index turn
+func isLatestTurn(history []Message, turn int) bool {
+	for _, message := range history[turn+1:] {
+		if message.Role == "user" {
+			return false
+		}
+	}
+	return true
+}
+
+// handleAnswerCallback handles the buttons below an answer, data is the callback data without "answer:"
+func handleAnswerCallback(b *gotgbot.Bot, callback *gotgbot.CallbackQuery, userID int64, username string, data string) error {
+	msg := callback.Message
+	if msg == nil {
+		return fmt.Errorf("callback message is nil")
+	}
+	bg := context.Background()
+
+	fields := strings.Split(data, ":")
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid answer callback data: %s", data)
+	}
+	action := fields[0]
+	messageID, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid answer callback data: %s", data)
+	}
+
+	answer, err := getAnswer(bg, messageID)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to get answer %d: %v", messageID, err))
+	}
+	if answer == nil || answer.UserID != userID {
+		_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "This answer is no longer available.",
+			ShowAlert: true,
+		})
+		return err
+	}
+
+	setButtons := func(buttons [][]gotgbot.InlineKeyboardButton) {
+		if _, _, err := b.EditMessageReplyMarkup(&gotgbot.EditMessageReplyMarkupOpts{
+			ChatId:      msg.GetChat().Id,
+			MessageId:   msg.GetMessageId(),
+			ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: buttons},
+		}); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to edit answer buttons: %v", err))
+		}
+	}
+	// Once the turn changes, only the reasoning stays available
+	var reasoningOnly [][]gotgbot.InlineKeyboardButton
+	if answer.Reasoning {
+		reasoningOnly = append(reasoningOnly, []gotgbot.InlineKeyboardButton{reasoningButton(messageID)})
+	}
+	alert := func(text string) error {
+		_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: text, ShowAlert: true})
+		return err
+	}
+
+	switch action {
+	case "switch":
+		// Offer the configured models, except the one that answered. In blind mode the
+		// list is complete, the missing model would tell who wrote the answer.
+		current := threadModel(answer.Thread)
+		var buttons [][]gotgbot.InlineKeyboardButton
+		for i, info := range getAvailableModels() {
+			if info.ID == current && answer.Label == "" {
+				continue
+			}
+			buttons = append(buttons, []gotgbot.InlineKeyboardButton{
+				{Text: info.ID, CallbackData: fmt.Sprintf("answer:to:%d:%d", messageID, i)},
+			})
+		}
+		if len(buttons) == 0 {
+			return alert("There is no other model to ask.")
+		}
+		buttons = append(buttons, []gotgbot.InlineKeyboardButton{{Text: "« Back", CallbackData: fmt.Sprintf("answer:back:%d", messageID)}})
+		setButtons(buttons)
+		_, err := callback.Answer(b, nil)
+		return err
+	case "back":
+		setButtons(answerButtons(messageID, *answer))
+		_, err := callback.Answer(b, nil)
+		return err
+	}
+
+	history, err := getConversationHistory(bg, userID, answer.Thread)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to get conversation history", answer.Thread))
+		return alert("Sorry, I couldn't load the conversation.")
+	}
+	turn := findTurn(history, answer.TurnID)
+	if turn < 0 {
+		return alert("This answer is no longer part of the conversation.")
+	}
+
+	userMode, err := getUserMode(bg, userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+	// Answers reply to the message that was answered, like the original one
+	prompt := &gotgbot.Message{MessageId: answer.PromptID, Chat: msg.GetChat()}
+
+	switch action {
+	case "regen":
+		if !isLatestTurn(history, turn) {
+			return alert("Only the latest answer of a conversation can be regenerated.")
+		}
+		// The new answer replaces this turn in the history instead of following it. An answer
+		// to a request starts its thread, which is saved again with the new answer.
+		content := history[turn].Content
+		if answer.Request == nil {
+			if err := saveConversationHistory(bg, userID, answer.Thread, history[:turn]); err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save conversation history", answer.Thread))
+				return alert("Sorry, I couldn't regenerate the answer.")
+			}
+		}
+		logMessage(userID, username, "command", fmt.Sprintf("Regenerate answer %d of %s", messageID, answer.Thread))
+		setButtons(reasoningOnly)
+		if _, err := callback.Answer(b, nil); err != nil {
+			return err
+		}
+		requestCtx, done := startRequest(userID)
+		defer done()
+		if answer.Request != nil {
+			err = answerRequest(requestCtx, b, prompt, userID, username, *answer, content)
+		} else {
+			err = respondWithModel(requestCtx, b, prompt, userID, username, userMode, answer.Thread, content, labelSlot(answer.Label), nil)
+		}
+		// Without a new answer, the previous one stays the latest, unless the conversation was restarted
+		if err != nil && requestCtx.Err() == nil {
+			if answer.Request == nil {
+				restoreHistory(requestCtx, userID, username, answer.Thread, history[:turn], history)
+			}
+			setButtons(answerButtons(messageID, *answer))
+		}
+		return err
+	case "cont":
+		if !answer.Truncated {
+			return alert("This answer is already complete.")
+		}
+		if !isLatestTurn(history, turn) {
+			return alert("Only the latest answer of a conversation can be continued.")
+		}
+		logMessage(userID, username, "command", fmt.Sprintf("Continue answer %d of %s", messageID, answer.Thread))
+		setButtons(reasoningOnly)
+		if _, err := callback.Answer(b, nil); err != nil {
+			return err
+		}
+		// The continuation replies to the cut off answer
+		cutOff := &gotgbot.Message{MessageId: msg.GetMessageId(), Chat: msg.GetChat()}
+		requestCtx, done := startRequest(userID)
+		defer done()
+		err = respondWithModel(requestCtx, b, cutOff, userID, username, userMode, answer.Thread, TextContent(continuePrompt), labelSlot(answer.Label), nil)
+		if err != nil && requestCtx.Err() == nil {
+			setButtons(answerButtons(messageID, *answer))
+		}
+		return err
+	case "to":
+		if len(fields) < 3 {
+			return fmt.Errorf("invalid answer callback data: %s", data)
+		}
+		index, err := strconv.Atoi(fields[2])
+		models := getAvailableModels()
+		if err != nil || index < 0 || index >= len(models) {
+			return alert("This model is no longer available.")
+		}
+		model := models[index].ID
+		logMessage(userID, username, "command", fmt.Sprintf("Ask %s instead of %s", model, answer.Thread))
+		setButtons(answerButtons(messageID, *answer))
+		if _, err := callback.Answer(b, nil); err != nil {
+			return err
+		}
+		// The other model answers in its own conversation, so replies to its answer continue there
+		requestCtx, done := startRequest(userID)
+		defer done()
+		return respondWithModel(requestCtx, b, prompt, userID, username, userMode, model, history[turn].Content, nil, nil)
+	}
+	return fmt.Errorf("invalid answer callback data: %s", data)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// anthropicAPIVersion is sent with every request as required by the Messages API
+const anthropicAPIVersion = "2023-06-01"
+
+// anthropicProvider talks to Anthropic's Messages API
+type anthropicProvider struct {
+	apiKey string
+}
+
+type AnthropicMessage struct {
+	Role    string                  `json:"role"`
+	Content []AnthropicContentBlock `json:"content"`
+}
+
+// AnthropicContentBlock is a text, image, tool_use or tool_result block of a message
+type AnthropicContentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`          // tool_use
+	Name      string          `json:"name,omitempty"`        // tool_use
+	Input     json.RawMessage `json:"input,omitempty"`       // tool_use
+	ToolUseID string          `json:"tool_use_id,omitempty"` // tool_result
+	Content   string          `json:"content,omitempty"`     // tool_result
+	Source    *AnthropicImage `json:"source,omitempty"`      // image
+}
+
+type AnthropicImage struct {
+	Type      string `json:"type"` // Always "base64"
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type AnthropicToolChoice struct {
+	Type string `json:"type"`
+}
+
+type AnthropicRequest struct {
+	Model       string               `json:"model"`
+	System      string               `json:"system,omitempty"`
+	Messages    []AnthropicMessage   `json:"messages"`
+	MaxTokens   int                  `json:"max_tokens"`
+	Temperature *float64             `json:"temperature,omitempty"`
+	TopP        *float64             `json:"top_p,omitempty"`
+	Stream      bool                 `json:"stream,omitempty"`
+	Tools       []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice  *AnthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+type AnthropicResponse struct {
+	ID         string                  `json:"id"`
+	Content    []AnthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      AnthropicUsage          `json:"usage"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type AnthropicErrorResponse struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// AnthropicStreamEvent represents a single SSE event from a streaming response
+type AnthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		ID    string         `json:"id"`
+		Usage AnthropicUsage `json:"usage"`
+	} `json:"message"` // Set in message_start
+	Index        int                   `json:"index"`
+	ContentBlock AnthropicContentBlock `json:"content_block"` // Set in content_block_start
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"` // Fragment of a tool_use input
+		StopReason  string `json:"stop_reason"`  // Set in message_delta
+	} `json:"delta"`
+	Usage AnthropicUsage `json:"usage"` // Set in message_delta
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newAnthropicProvider(apiKey string) *anthropicProvider {
+	return &anthropicProvider{apiKey: apiKey}
+}
+
+func (p *anthropicProvider) Name() string {
+	return "anthropic"
+}
+
+func (p *anthropicProvider) newRequest(ctx context.Context, userID int64, username string, chatReq ChatRequest, stream bool) (*http.Request, error) {
+	reqBody := AnthropicRequest{
+		Model:     chatReq.Model,
+		MaxTokens: chatReq.MaxTokens,
+		Stream:    stream,
+		TopP:      chatReq.TopP,
+	}
+	// Anthropic's temperature only goes up to 1, there is no frequency penalty or seed
+	if chatReq.Temperature != nil {
+		temperature := math.Min(*chatReq.Temperature, 1)
+		reqBody.Temperature = &temperature
+	}
+	reqBody.System, reqBody.Messages = toAnthropicMessages(chatReq.Messages)
+
+	for _, tool := range chatReq.Tools {
+		reqBody.Tools = append(reqBody.Tools, AnthropicTool{
+			Name:        tool.Name,
+			Description: tool.Description,
+			InputSchema: tool.Parameters,
+		})
+	}
+	if chatReq.ToolChoice != "" && len(reqBody.Tools) > 0 {
+		reqBody.ToolChoice = &AnthropicToolChoice{Type: chatReq.ToolChoice}
+	}
+
+	reqData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	logMessage(userID, username, "anthropic_request", fmt.Sprintf("Model: %s, Messages: %d, Stream: %t", reqBody.Model, len(reqBody.Messages), stream))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(reqData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("x-api-key", p.apiKey)
+	req.Header.Set("anthropic-version", anthropicAPIVersion)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (p *anthropicProvider) Complete(ctx context.Context, userID int64, username string, chatReq ChatRequest) (*ChatResponse, error) {
+	client := &http.Client{Timeout: completionTimeout}
+
+	req, err := p.newRequest(ctx, userID, username, chatReq, false)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call Anthropic API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	logMessage(userID, username, "anthropic_response", fmt.Sprintf("Status: %d, Response length: %d", resp.StatusCode, len(respBody)))
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, p.parseError(userID, username, resp, respBody)
+	}
+
+	var anthropicResp AnthropicResponse
+	if err := json.Unmarshal(respBody, &anthropicResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	var content strings.Builder
+	var toolCalls []ToolCall
+	for _, block := range anthropicResp.Content {
+		switch block.Type {
+		case "text":
+			content.WriteString(block.Text)
+		case "tool_use":
+			toolCalls = append(toolCalls, ToolCall{
+				ID:       block.ID,
+				Type:     "function",
+				Function: ToolCallFunction{Name: block.Name, Arguments: string(block.Input)},
+			})
+		}
+	}
+	if content.Len() == 0 && len(toolCalls) == 0 {
+		return nil, fmt.Errorf("no response from Anthropic API")
+	}
+
+	return &ChatResponse{
+		Content:      content.String(),
+		ToolCalls:    toolCalls,
+		FinishReason: anthropicFinishReason(anthropicResp.StopReason),
+		Usage: Usage{
+			PromptTokens:     anthropicResp.Usage.InputTokens,
+			CompletionTokens: anthropicResp.Usage.OutputTokens,
+		},
+		GenerationID: anthropicResp.ID,
+	}, nil
+}
+
+func (p *anthropicProvider) Stream(ctx context.Context, userID int64, username string, chatReq ChatRequest, onDelta func(text string)) (*ChatResponse, error) {
+	client := &http.Client{Timeout: streamTimeout}
+
+	req, err := p.newRequest(ctx, userID, username, chatReq, true)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call Anthropic API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+		return nil, p.parseError(userID, username, resp, respBody)
+	}
+
+	var content strings.Builder
+	var usage Usage
+	var toolCalls []ToolCall
+	toolCallIndex := make(map[int]int) // Content block index -> index in toolCalls
+	generationID := ""
+	finishReason := ""
+	err = readSSE(resp.Body, func(eventType, data string) (bool, error) {
+		var event AnthropicStreamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			logMessage(userID, username, "anthropic_error", fmt.Sprintf("Failed to decode stream event: %v", err))
+			return true, nil
+		}
+
+		switch event.Type {
+		case "message_start":
+			generationID = event.Message.ID
+			usage.PromptTokens = event.Message.Usage.InputTokens
+		case "message_delta":
+			usage.CompletionTokens = event.Usage.OutputTokens
+			finishReason = anthropicFinishReason(event.Delta.StopReason)
+		case "content_block_start":
+			if event.ContentBlock.Type == "tool_use" {
+				toolCallIndex[event.Index] = len(toolCalls)
+				toolCalls = append(toolCalls, ToolCall{
+					ID:       event.ContentBlock.ID,
+					Type:     "function",
+					Function: ToolCallFunction{Name: event.ContentBlock.Name},
+				})
+			}
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+				content.WriteString(event.Delta.Text)
+				if onDelta != nil {
+					onDelta(content.String())
+				}
+			}
+			if i, ok := toolCallIndex[event.Index]; ok && event.Delta.Type == "input_json_delta" {
+				toolCalls[i].Function.Arguments += event.Delta.PartialJSON
+			}
+		case "message_stop":
+			return false, nil
+		case "error":
+			// Mid-stream errors carry no status code, "overloaded_error" is the transient one
+			statusCode := http.StatusBadRequest
+			if event.Error.Type == "overloaded_error" {
+				statusCode = 529
+			}
+			return false, &APIError{
+				Provider:   "anthropic",
+				StatusCode: statusCode,
+				Message:    fmt.Sprintf("Anthropic stream error: %s - %s", event.Error.Type, event.Error.Message),
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logMessage(userID, username, "anthropic_response", fmt.Sprintf("Status: %d, Streamed response length: %d", resp.StatusCode, content.Len()))
+
+	if content.Len() == 0 && len(toolCalls) == 0 {
+		return nil, fmt.Errorf("no response from Anthropic API")
+	}
+
+	return &ChatResponse{
+		Content:      content.String(),
+		Usage:        usage,
+		GenerationID: generationID,
+		ToolCalls:    toolCalls,
+		FinishReason: finishReason,
+	}, nil
+}
+
+// toAnthropicMessages converts the history into the Messages API format. The system prompt
+// is a separate field there, and tool results are sent as tool_result blocks of a user message.
+func toAnthropicMessages(messages []Message) (string, []AnthropicMessage) {
+	var system []string
+	var result []AnthropicMessage
+	for _, msg := range messages {
+		var role string
+		var blocks []AnthropicContentBlock
+
+		switch msg.Role {
+		case "system":
+			system = append(system, msg.Content.Text())
+			continue
+		case "tool":
+			role = "user"
+			blocks = []AnthropicContentBlock{{Type: "tool_result", ToolUseID: msg.ToolCallID, Content: msg.Content.Text()}}
+		default:
+			role = msg.Role
+			for _, part := range msg.Content {
+				switch {
+				case part.Type == "image":
+					blocks = append(blocks, AnthropicContentBlock{Type: "image", Source: &AnthropicImage{
+						Type:      "base64",
+						MediaType: part.MimeType,
+						Data:      base64.StdEncoding.EncodeToString(part.Data),
+					}})
+				case part.Text != "":
+					blocks = append(blocks, AnthropicContentBlock{Type: "text", Text: part.Text})
+				}
+			}
+			for _, call := range msg.ToolCalls {
+				input := json.RawMessage(call.Function.Arguments)
+				if strings.TrimSpace(call.Function.Arguments) == "" {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, AnthropicContentBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+			}
+		}
+
+		// Roles have to alternate, so consecutive messages of the same role are merged
+		if len(result) > 0 && result[len(result)-1].Role == role {
+			result[len(result)-1].Content = append(result[len(result)-1].Content, blocks...)
+			continue
+		}
+		result = append(result, AnthropicMessage{Role: role, Content: blocks})
+	}
+	return strings.Join(system, "\n\n"), result
+}
+
+// anthropicFinishReason maps Anthropic's stop reasons to OpenAI's finish reasons
+func anthropicFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "":
+		return ""
+	}
+	return "stop"
+}
+
+// parseError converts a non-200 response into an error
+func (p *anthropicProvider) parseError(userID int64, username string, resp *http.Response, respBody []byte) error {
+	var errorResp AnthropicErrorResponse
+	if err := json.Unmarshal(respBody, &errorResp); err == nil && errorResp.Error.Message != "" {
+		logMessage(userID, username, "anthropic_error", fmt.Sprintf("Status: %d, Error type: %s, message: %s",
+			resp.StatusCode, errorResp.Error.Type, errorResp.Error.Message))
+		return newAPIError("anthropic", resp, fmt.Sprintf("Anthropic API error (status %d): %s - %s",
+			resp.StatusCode, errorResp.Error.Type, errorResp.Error.Message))
+	}
+	logMessage(userID, username, "anthropic_error", fmt.Sprintf("Status: %d, Raw response: %s",
+		resp.StatusCode, string(respBody)))
+	return newAPIError("anthropic", resp, fmt.Sprintf("Anthropic API returned status %d: %s", resp.StatusCode, string(respBody)))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// boardTickInterval is how often the board is edited to update the elapsed times
+// even when no model changed its state
+const boardTickInterval = 5 * time.Second
+
+// answerState is the progress of a model's answer shown on the status board
+type answerState int
+
+const (
+	answerQueued    answerState = iota // Preparing the request or waiting for its turn
+	answerThinking                     // Request sent, no output yet
+	answerStreaming                    // Output is arriving
+	answerDone
+	answerFailed
+	answerSkipped
+)
+
+// boardEntry is a model's line on the status board
+type boardEntry struct {
+	model    string // Requested model
+	answerBy string // Model that is answering, differs from model after a fallback
+	label    string // Shown instead of the model names in blind mode
+	state    answerState
+	started  time.Time // When the request was sent
+	latency  time.Duration
+	cost     float64
+	reason   string // Why the model failed or was skipped
+}
+
+// line renders the entry for the board
+func (e boardEntry) line() string {
+	name := e.model
+	if e.answerBy != "" && e.answerBy != e.model {
+		name = fmt.Sprintf("%s (fallback for %s)", e.answerBy, e.model)
+	}
+	if e.label != "" {
+		name = e.label
+	}
+
+	elapsed := int(time.Since(e.started).Seconds())
+	switch e.state {
+	case answerThinking:
+		return fmt.Sprintf("🤔 %s: thinking… %ds", name, elapsed)
+	case answerStreaming:
+		return fmt.Sprintf("✍️ %s: streaming… %ds", name, elapsed)
+	case answerDone:
+		return fmt.Sprintf("✅ %s: done in %.1fs · $%.4f", name, e.latency.Seconds(), e.cost)
+	case answerFailed:
+		return fmt.Sprintf("❌ %s: failed, %s", name, e.reason)
+	case answerSkipped:
+		return fmt.Sprintf("⏭ %s: skipped, %s", name, e.reason)
+	}
+	return fmt.Sprintf("⏳ %s: queued", name)
+}
+
+// statusBoard is a message edited in place with the state of every model answering a message.
+// The answers themselves are separate replies.
+type statusBoard struct {
+	bot       *gotgbot.Bot
+	chatID    int64
+	messageID int64
+	mu        sync.Mutex
+	entries   []boardEntry
+	lastText  string
+	changed   chan struct{} // Signals the edit loop that an entry changed
+	stop      chan struct{} // Closed to make the edit loop show the final state and exit
+	stopped   chan struct{} // Closed once the edit loop exited
+}
+
+// startStatusBoard replies to msg with a board listing the models as queued
+// and keeps it up to date until Close is called. labels (optional) are shown instead of the model names.
+func startStatusBoard(b *gotgbot.Bot, msg *gotgbot.Message, models []string, labels []string) (*statusBoard, error) {
+	board := &statusBoard{
+		bot:     b,
+		changed: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for i, model := range models {
+		entry := boardEntry{model: model, state: answerQueued}
+		if labels != nil {
+			entry.label = labels[i]
+		}
+		board.entries = append(board.entries, entry)
+	}
+
+	text := board.render()
+	resp, err := msg.Reply(b, text, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send status board: %w", err)
+	}
+	board.chatID = resp.Chat.Id
+	board.messageID = resp.MessageId
+	board.lastText = text
+
+	go board.run()
+	return board, nil
+}
+
+// update changes the entry of the i-th model, a nil board is ignored
+func (s *statusBoard) update(i int, change func(entry *boardEntry)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	before := s.entries[i]
+	change(&s.entries[i])
+	changed := s.entries[i] != before
+	s.mu.Unlock()
+
+	if changed {
+		select {
+		case s.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close shows the final state of the board and stops updating it, a nil board is ignored
+func (s *statusBoard) Close() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.stopped
+}
+
+// run edits the board when an entry changes or the elapsed times need an update,
+// but not more often than streamEditInterval
+func (s *statusBoard) run() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(boardTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			s.refresh()
+			return
+		case <-s.changed:
+		case <-ticker.C:
+		}
+		s.refresh()
+
+		select {
+		case <-s.stop:
+			s.refresh()
+			return
+		case <-time.After(streamEditInterval):
+		}
+	}
+}
+
+// render returns the board text
+func (s *statusBoard) render() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lines []string
+	finished, answered := 0, 0
+	for _, entry := range s.entries {
+		lines = append(lines, entry.line())
+		switch entry.state {
+		case answerDone:
+			answered++
+			finished++
+		case answerFailed, answerSkipped:
+			finished++
+		}
+	}
+
+	title := fmt.Sprintf("📋 %d models are working on your message", len(s.entries))
+	if finished == len(s.entries) {
+		title = fmt.Sprintf("📋 %d of %d models answered", answered, len(s.entries))
+	}
+	return title + "\n\n" + strings.Join(lines, "\n")
+}
+
+// refresh edits the board if its text changed
+func (s *statusBoard) refresh() {
+	text := s.render()
+	if text == s.lastText {
+		return
+	}
+
+	if _, _, err := s.bot.EditMessageText(text, &gotgbot.EditMessageTextOpts{
+		ChatId:    s.chatID,
+		MessageId: s.messageID,
+	}); err != nil {
+		log.Printf("[Error] Failed to edit status board %d: %v", s.messageID, err)
+		return
+	}
+	s.lastText = text
+}
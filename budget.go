@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/go-redis/redis/v8"
+)
+
+// budgetWarningTTL keeps "warning sent" markers a bit longer than the longest budget period
+const budgetWarningTTL = 35 * 24 * time.Hour
+
+// telegramBot is the bot used outside of update handlers (budget warnings to admins,
+// image downloads), set once the bot is created
+var telegramBot *gotgbot.Bot
+
+// Budget holds spending limits in USD, zero means unlimited
+type Budget struct {
+	Daily   float64
+	Monthly float64
+}
+
+// BudgetExceededError is returned instead of calling a model when a spending cap is reached
+type BudgetExceededError struct {
+	Scope  string // "user" or "global"
+	Period string // "daily" or "monthly"
+	Limit  float64
+	Spent  float64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%s %s budget exceeded: spent $%.4f of $%.2f", e.Scope, e.Period, e.Spent, e.Limit)
+}
+
+// UserMessage explains the cap to the user
+func (e *BudgetExceededError) UserMessage() string {
+	resets := "tomorrow"
+	if e.Period == "monthly" {
+		resets = "at the beginning of next month"
+	}
+	if e.Scope == "global" {
+		return fmt.Sprintf("💸 The bot has reached its %s spending limit of $%.2f. It resets %s, please contact the administrator if you need access sooner.",
+			e.Period, e.Limit, resets)
+	}
+	return fmt.Sprintf("💸 You have reached your %s budget of $%.2f (spent $%.4f). It resets %s.",
+		e.Period, e.Limit, e.Spent, resets)
+}
+
+// globalUsageKeys returns the ledger keys (day and month) of the whole bot's usage at the given time
+func globalUsageKeys(at time.Time) []string {
+	return []string{
+		fmt.Sprintf("usage:global:day:%s", at.Format("2006-01-02")),
+		fmt.Sprintf("usage:global:month:%s", at.Format("2006-01")),
+	}
+}
+
+// getPeriodCost returns the total cost stored under a ledger key
+func getPeriodCost(ctx context.Context, key string) (float64, error) {
+	usage, err := getUsage(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	total := 0.0
+	for _, u := range usage {
+		total += u.Cost
+	}
+	return total, nil
+}
+
+// applyBudgetOverride replaces budget values with the ones an admin stored under key
+func applyBudgetOverride(ctx context.Context, key string, budget *Budget) error {
+	values, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("redis get error: %w", err)
+	}
+	if value, ok := values["daily"]; ok {
+		budget.Daily, _ = strconv.ParseFloat(value, 64)
+	}
+	if value, ok := values["monthly"]; ok {
+		budget.Monthly, _ = strconv.ParseFloat(value, 64)
+	}
+	return nil
+}
+
+// getUserBudget returns the budget that applies to a user. A user's own budget takes
+// precedence over their role's budget, which takes precedence over the default user budget.
+func getUserBudget(ctx context.Context, userID int64) (Budget, error) {
+	budget := config.UserBudget
+	if role := config.UserRoles[userID]; role != "" {
+		if roleBudget, ok := config.RoleBudgets[role]; ok {
+			budget = roleBudget
+		}
+		if err := applyBudgetOverride(ctx, "budget:role:"+role, &budget); err != nil {
+			return budget, err
+		}
+	}
+	if err := applyBudgetOverride(ctx, fmt.Sprintf("budget:user:%d", userID), &budget); err != nil {
+		return budget, err
+	}
+	return budget, nil
+}
+
+// getGlobalBudget returns the budget for the whole bot
+func getGlobalBudget(ctx context.Context) (Budget, error) {
+	budget := config.GlobalBudget
+	err := applyBudgetOverride(ctx, "budget:global", &budget)
+	return budget, err
+}
+
+// budgetLimit is a single spending cap together with the ledger key it is checked against
+type budgetLimit struct {
+	scope  string
+	period string
+	limit  float64
+	key    string
+}
+
+// getBudgetLimits returns all caps that apply to a user right now
+func getBudgetLimits(ctx context.Context, userID int64) ([]budgetLimit, error) {
+	userBudget, err := getUserBudget(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	globalBudget, err := getGlobalBudget(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	userKeys := usageKeys(userID, now)
+	globalKeys := globalUsageKeys(now)
+	return []budgetLimit{
+		{scope: "user", period: "daily", limit: userBudget.Daily, key: userKeys[0]},
+		{scope: "user", period: "monthly", limit: userBudget.Monthly, key: userKeys[1]},
+		{scope: "global", period: "daily", limit: globalBudget.Daily, key: globalKeys[0]},
+		{scope: "global", period: "monthly", limit: globalBudget.Monthly, key: globalKeys[1]},
+	}, nil
+}
+
+// checkBudget returns a BudgetExceededError if the user or the bot has reached a spending cap
+func checkBudget(ctx context.Context, userID int64) error {
+	limits, err := getBudgetLimits(ctx, userID)
+	if err != nil {
+		// Don't lock everyone out because of a Redis hiccup
+		logMessage(userID, "", "error", fmt.Sprintf("Failed to get budgets: %v", err))
+		return nil
+	}
+
+	for _, limit := range limits {
+		if limit.limit <= 0 {
+			continue
+		}
+		spent, err := getPeriodCost(ctx, limit.key)
+		if err != nil {
+			logMessage(userID, "", "error", fmt.Sprintf("Failed to get spend for %s: %v", limit.key, err))
+			continue
+		}
+		if spent >= limit.limit {
+			return &BudgetExceededError{Scope: limit.scope, Period: limit.period, Limit: limit.limit, Spent: spent}
+		}
+	}
+	return nil
+}
+
+// checkBudgetWarnings notifies admins once per period when spend crosses a warning threshold
+func checkBudgetWarnings(ctx context.Context, userID int64, username string) {
+	if len(config.AdminUsers) == 0 || len(config.BudgetWarnings) == 0 {
+		return
+	}
+
+	limits, err := getBudgetLimits(ctx, userID)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to get budgets: %v", err))
+		return
+	}
+
+	for _, limit := range limits {
+		if limit.limit <= 0 {
+			continue
+		}
+		spent, err := getPeriodCost(ctx, limit.key)
+		if err != nil {
+			continue
+		}
+
+		for _, threshold := range config.BudgetWarnings {
+			if spent < threshold*limit.limit {
+				continue
+			}
+
+			// Only warn once per threshold and period
+			marker := fmt.Sprintf("budget:warned:%s:%d", limit.key, int(threshold*100))
+			first, err := rdb.SetNX(ctx, marker, 1, budgetWarningTTL).Result()
+			if err != nil || !first {
+				continue
+			}
+
+			who := "The bot"
+			if limit.scope == "user" {
+				who = fmt.Sprintf("User %d (@%s)", userID, username)
+			}
+			notifyAdmins(fmt.Sprintf("⚠️ %s has used %.0f%% of the %s budget: $%.4f of $%.2f",
+				who, spent/limit.limit*100, limit.period, spent, limit.limit))
+		}
+	}
+}
+
+// notifyAdmins sends a message to every configured admin
+func notifyAdmins(text string) {
+	if telegramBot == nil {
+		return
+	}
+	for _, adminID := range config.AdminUsers {
+		if _, err := telegramBot.SendMessage(adminID, text, nil); err != nil {
+			logMessage(adminID, "admin", "error", fmt.Sprintf("Failed to notify admin: %v", err))
+		}
+	}
+}
+
+// userErrorMessage returns a message for the user explaining why a request failed
+func userErrorMessage(err error, fallback string) string {
+	var budgetErr *BudgetExceededError
+	if errors.As(err, &budgetErr) {
+		return budgetErr.UserMessage()
+	}
+	return fallback
+}
+
+// formatBudgetLimit renders a spending cap
+func formatBudgetLimit(limit float64) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("$%.2f", limit)
+}
+
+// handleBudget shows the user's budgets. Admins can also change them:
+//
+//	/budget set user <id>|role <name>|global daily|monthly <amount>
+//	/budget reset user <id>|role <name>|global daily|monthly
+func handleBudget(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	args := strings.Fields(msg.Text)[1:]
+	if len(args) > 0 {
+		text := updateBudget(context.Background(), userID, username, args)
+		_, err = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	limits, err := getBudgetLimits(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to get budgets: %v", err))
+		_, err = msg.Reply(b, "Sorry, I encountered an error retrieving your budget.", &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	text := "💰 Budgets\n"
+	for _, limit := range limits {
+		spent, err := getPeriodCost(context.Background(), limit.key)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to get spend for %s: %v", limit.key, err))
+		}
+		scope := "Your"
+		if limit.scope == "global" {
+			scope = "Bot"
+		}
+		text += fmt.Sprintf("\n%s %s budget: %s (spent $%.4f)", scope, limit.period, formatBudgetLimit(limit.limit), spent)
+	}
+
+	if isAdmin(userID) {
+		text += "\n\nAdmin commands:\n" +
+			"/budget set user <id>|role <name>|global daily|monthly <amount>\n" +
+			"/budget reset user <id>|role <name>|global daily|monthly\n" +
+			"An amount of 0 means unlimited, reset goes back to the configured default."
+	}
+
+	_, err = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+		ReplyMarkup: getKeyboard(userMode),
+	})
+	return err
+}
+
+// updateBudget applies an admin's /budget set or /budget reset command and returns the reply text
+func updateBudget(ctx context.Context, userID int64, username string, args []string) string {
+	const usage = "Usage:\n/budget set user <id>|role <name>|global daily|monthly <amount>\n/budget reset user <id>|role <name>|global daily|monthly"
+
+	if !isAdmin(userID) {
+		logMessage(userID, username, "access_denied", "User is not an admin")
+		return "Sorry, only admins can change budgets."
+	}
+
+	action := args[0]
+	if (action != "set" && action != "reset") || len(args) < 3 {
+		return usage
+	}
+
+	// Parse scope
+	var key, scopeName string
+	rest := args[1:]
+	switch rest[0] {
+	case "global":
+		key, scopeName = "budget:global", "global"
+		rest = rest[1:]
+	case "user":
+		if len(rest) < 3 {
+			return usage
+		}
+		targetID, err := strconv.ParseInt(rest[1], 10, 64)
+		if err != nil {
+			return "Invalid user ID: " + rest[1]
+		}
+		key, scopeName = fmt.Sprintf("budget:user:%d", targetID), "user "+rest[1]
+		rest = rest[2:]
+	case "role":
+		if len(rest) < 3 {
+			return usage
+		}
+		key, scopeName = "budget:role:"+rest[1], "role "+rest[1]
+		rest = rest[2:]
+	default:
+		return usage
+	}
+
+	period := rest[0]
+	if period != "daily" && period != "monthly" {
+		return usage
+	}
+
+	if action == "reset" {
+		if err := rdb.HDel(ctx, key, period).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to reset budget: %v", err))
+			return "Sorry, I encountered an error updating the budget."
+		}
+		logMessage(userID, username, "budget", fmt.Sprintf("Reset %s %s budget", scopeName, period))
+		return fmt.Sprintf("The %s budget for %s was reset to the configured default.", period, scopeName)
+	}
+
+	if len(rest) < 2 {
+		return usage
+	}
+	amount, err := strconv.ParseFloat(strings.TrimPrefix(rest[1], "$"), 64)
+	if err != nil || amount < 0 {
+		return "Invalid amount: " + rest[1]
+	}
+	if err := rdb.HSet(ctx, key, period, amount).Err(); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to set budget: %v", err))
+		return "Sorry, I encountered an error updating the budget."
+	}
+	logMessage(userID, username, "budget", fmt.Sprintf("Set %s %s budget to $%.2f", scopeName, period, amount))
+	return fmt.Sprintf("The %s budget for %s is now %s.", period, scopeName, formatBudgetLimit(amount))
+}
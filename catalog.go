@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/go-redis/redis/v8"
+)
+
+// catalogKey caches the last OpenRouter catalog that was fetched successfully,
+// so the bot knows prices right after a restart even if OpenRouter is unreachable
+const catalogKey = "catalog:openrouter"
+
+// priceChangesKey holds the latest price changes, newest first
+const priceChangesKey = "catalog:price_changes"
+
+// maxPriceChanges limits the length of the price change log
+const maxPriceChanges = 200
+
+// catalogRetryInterval is the delay before another refresh after a failed one
+const catalogRetryInterval = 5 * time.Minute
+
+// catalogMu guards config.AvailableModels and catalog, which are replaced on every refresh
+var catalogMu sync.RWMutex
+
+// catalog holds every OpenRouter model by its OpenRouter ID
+var catalog map[string]ModelInfo
+
+// CachedCatalog is the catalog as stored in Redis
+type CachedCatalog struct {
+	FetchedAt time.Time            `json:"fetched_at"`
+	Models    map[string]ModelInfo `json:"models"`
+}
+
+// getAvailableModels returns the configured models with their current prices
+func getAvailableModels() []ModelInfo {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	return config.AvailableModels
+}
+
+// findCatalogModel returns the catalog entry of an OpenRouter model
+func findCatalogModel(modelID string) (ModelInfo, bool) {
+	provider, name := parseModelID(modelID)
+	if provider != defaultProvider {
+		return ModelInfo{}, false
+	}
+
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	info, ok := catalog[name]
+	if ok {
+		info.ID = modelID
+		info.Provider = provider
+	}
+	return info, ok
+}
+
+// buildAvailableModels creates the model list for the configured IDs. OpenRouter models
+// get their prices and capabilities from the catalog, and the list is sorted by average
+// price if a catalog is given.
+func buildAvailableModels(modelIDs []string, pricing map[string]ModelInfo) []ModelInfo {
+	availableModels := make([]ModelInfo, 0, len(modelIDs))
+	for _, modelID := range modelIDs {
+		provider, name := parseModelID(modelID)
+		if info, ok := pricing[name]; ok && provider == defaultProvider {
+			info.ID = modelID
+			info.Provider = provider
+			availableModels = append(availableModels, info)
+		} else {
+			// Include model without pricing if not found in OpenRouter response
+			availableModels = append(availableModels, ModelInfo{
+				ID:       modelID,
+				Provider: provider,
+			})
+		}
+	}
+
+	if pricing != nil {
+		// Sort models by average price (input + output / 2)
+		sort.SliceStable(availableModels, func(i, j int) bool {
+			avgPriceI := (availableModels[i].PriceIn + availableModels[i].PriceOut) / 2
+			avgPriceJ := (availableModels[j].PriceIn + availableModels[j].PriceOut) / 2
+			return avgPriceI < avgPriceJ
+		})
+	}
+	return availableModels
+}
+
+// applyCatalog replaces the catalog and the prices of the configured models.
+// It returns a description of every price that changed.
+func applyCatalog(pricing map[string]ModelInfo) []string {
+	availableModels := buildAvailableModels(config.ModelIDs, pricing)
+
+	catalogMu.Lock()
+	previous := catalog
+	catalog = pricing
+	config.AvailableModels = availableModels
+	catalogMu.Unlock()
+
+	var changes []string
+	for id, info := range pricing {
+		old, ok := previous[id]
+		if !ok || (old.PriceIn == info.PriceIn && old.PriceOut == info.PriceOut) {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: in $%.2f → $%.2f, out $%.2f → $%.2f per 1M tokens",
+			id, old.PriceIn, info.PriceIn, old.PriceOut, info.PriceOut))
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// loadCachedCatalog applies the catalog cached in Redis
+func loadCachedCatalog(ctx context.Context) error {
+	data, err := rdb.Get(ctx, catalogKey).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("redis get error: %w", err)
+	}
+
+	var cached CachedCatalog
+	if err := json.Unmarshal([]byte(data), &cached); err != nil {
+		return fmt.Errorf("json unmarshal error: %w", err)
+	}
+	applyCatalog(cached.Models)
+	log.Printf("[Catalog] Loaded %d models cached at %s", len(cached.Models), cached.FetchedAt.Format(time.RFC3339))
+	return nil
+}
+
+// refreshCatalog fetches the OpenRouter catalog, caches it and applies it.
+// Price changes are logged and returned.
+func refreshCatalog(ctx context.Context) ([]string, error) {
+	pricing, err := FetchModelPricing()
+	if err != nil {
+		return nil, err
+	}
+	if len(pricing) == 0 {
+		return nil, fmt.Errorf("OpenRouter returned an empty catalog")
+	}
+
+	data, err := json.Marshal(CachedCatalog{FetchedAt: time.Now(), Models: pricing})
+	if err != nil {
+		return nil, fmt.Errorf("json marshal error: %w", err)
+	}
+	if err := rdb.Set(ctx, catalogKey, data, 0).Err(); err != nil {
+		log.Printf("[Warning] Failed to cache model catalog: %v", err)
+	}
+
+	changes := applyCatalog(pricing)
+	if len(changes) > 0 {
+		now := time.Now().Format("2006-01-02 15:04")
+		entries := make([]interface{}, 0, len(changes))
+		for _, change := range changes {
+			log.Printf("[Catalog] Price change: %s", change)
+			entries = append(entries, now+" "+change)
+		}
+		pipe := rdb.TxPipeline()
+		pipe.LPush(ctx, priceChangesKey, entries...)
+		pipe.LTrim(ctx, priceChangesKey, 0, maxPriceChanges-1)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("[Warning] Failed to save price changes: %v", err)
+		}
+	}
+	log.Printf("[Catalog] Refreshed %d models, %d price changes", len(pricing), len(changes))
+	return changes, nil
+}
+
+// startCatalogRefresher applies the cached catalog and keeps refreshing it in the background
+// until ctx is canceled. The first refresh happens right away, without delaying the startup.
+func startCatalogRefresher(ctx context.Context) {
+	if err := loadCachedCatalog(ctx); err != nil {
+		log.Printf("[Warning] Failed to load cached model catalog: %v", err)
+	}
+
+	go func() {
+		interval := time.Duration(config.CatalogRefreshMins) * time.Minute
+		for {
+			delay := interval
+			if _, err := refreshCatalog(ctx); err != nil {
+				log.Printf("[Warning] Failed to refresh model catalog: %v", err)
+				delay = min(interval, catalogRetryInterval)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+}
+
+func handleModelsRefresh(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	reply := func(text string) error {
+		for _, part := range chunkText(text, maxMessageLength) {
+			if _, err := msg.Reply(b, part, &gotgbot.SendMessageOpts{
+				ReplyMarkup: getKeyboard(userMode),
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !isAdmin(userID) {
+		logMessage(userID, username, "access_denied", "User is not an admin")
+		return reply("Sorry, only admins can refresh the model catalog.")
+	}
+
+	changes, err := refreshCatalog(context.Background())
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to refresh model catalog: %v", err))
+		return reply("Sorry, the model catalog could not be refreshed, the last known prices are still used.")
+	}
+
+	catalogMu.RLock()
+	text := fmt.Sprintf("✅ Model catalog refreshed, %d models available.\n", len(catalog))
+	catalogMu.RUnlock()
+	if len(changes) > 0 {
+		text += "\nPrice changes:\n" + strings.Join(changes, "\n")
+	} else {
+		text += "\nNo price changes."
+		recent, err := rdb.LRange(context.Background(), priceChangesKey, 0, 9).Result()
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to get price changes: %v", err))
+		} else if len(recent) > 0 {
+			text += "\n\nEarlier price changes:\n" + strings.Join(recent, "\n")
+		}
+	}
+	return reply(text)
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/go-redis/redis/v8"
+)
+
+// catalogPageSize is the number of models shown on one page of the catalog browser
+const catalogPageSize = 8
+
+// catalogPatternsKey holds the glob patterns set by admins, replacing CATALOG_MODEL_PATTERNS
+const catalogPatternsKey = "catalog:model_patterns"
+
+// catalogModalities are the input modalities the browser can filter by
+var catalogModalities = []string{"image", "audio", "file"}
+
+// CatalogFilter narrows down the models shown in the catalog browser
+type CatalogFilter struct {
+	Query      string   // Part of the model ID or name
+	Author     string   // Organization in front of the slash in the model ID, e.g. "openai"
+	Modality   string   // Required input modality
+	MinContext int      // Minimum context length
+	MaxPrice   *float64 // Maximum input and output price per 1M tokens
+}
+
+func isModelCatalogEnabled() bool {
+	return config.ModelCatalog
+}
+
+func catalogFilterKey(userID int64) string {
+	return fmt.Sprintf("user:%d:catalog_filter", userID)
+}
+
+// getCatalogFilter returns the user's filter of the catalog browser
+func getCatalogFilter(ctx context.Context, userID int64) (CatalogFilter, error) {
+	var filter CatalogFilter
+	values, err := rdb.HGetAll(ctx, catalogFilterKey(userID)).Result()
+	if err != nil && err != redis.Nil {
+		return filter, fmt.Errorf("redis get error: %w", err)
+	}
+
+	filter.Query = values["query"]
+	filter.Author = values["author"]
+	filter.Modality = values["modality"]
+	filter.MinContext, _ = strconv.Atoi(values["context"])
+	if price, err := strconv.ParseFloat(values["price"], 64); err == nil {
+		filter.MaxPrice = &price
+	}
+	return filter, nil
+}
+
+// describe returns the active filters as text, or an empty string if there are none
+func (f CatalogFilter) describe() string {
+	var parts []string
+	if f.Query != "" {
+		parts = append(parts, fmt.Sprintf("search \"%s\"", f.Query))
+	}
+	if f.Author != "" {
+		parts = append(parts, "provider "+f.Author)
+	}
+	if f.Modality != "" {
+		parts = append(parts, "accepts "+f.Modality)
+	}
+	if f.MinContext > 0 {
+		parts = append(parts, fmt.Sprintf("context ≥ %d", f.MinContext))
+	}
+	if f.MaxPrice != nil {
+		parts = append(parts, fmt.Sprintf("price ≤ $%.2f", *f.MaxPrice))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// matches reports whether a catalog model passes the filter
+func (f CatalogFilter) matches(info ModelInfo) bool {
+	if f.Query != "" {
+		query := strings.ToLower(f.Query)
+		if !strings.Contains(strings.ToLower(info.ID), query) && !strings.Contains(strings.ToLower(info.Name), query) {
+			return false
+		}
+	}
+	if f.Author != "" && !strings.EqualFold(modelAuthor(info.ID), f.Author) {
+		return false
+	}
+	if f.Modality != "" {
+		found := false
+		for _, modality := range info.InputModalities {
+			if modality == f.Modality {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.MinContext > 0 && info.ContextLength < f.MinContext {
+		return false
+	}
+	if f.MaxPrice != nil && (info.PriceIn > *f.MaxPrice || info.PriceOut > *f.MaxPrice) {
+		return false
+	}
+	return true
+}
+
+// modelAuthor returns the organization part of an OpenRouter model ID
+func modelAuthor(modelID string) string {
+	author, _, _ := strings.Cut(modelID, "/")
+	return author
+}
+
+// getModelPatterns returns the glob patterns of catalog models users may pick
+func getModelPatterns(ctx context.Context) ([]string, error) {
+	patterns, err := rdb.SMembers(ctx, catalogPatternsKey).Result()
+	if err != nil && err != redis.Nil {
+		return config.ModelPatterns, fmt.Errorf("redis get error: %w", err)
+	}
+	if len(patterns) == 0 {
+		return config.ModelPatterns, nil
+	}
+	sort.Strings(patterns)
+	return patterns, nil
+}
+
+// matchModelPattern matches a model ID against a glob pattern, where * matches any
+// characters including slashes and ? matches a single character
+func matchModelPattern(pattern string, modelID string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	matched, err := regexp.MatchString("^"+expr+"$", modelID)
+	return err == nil && matched
+}
+
+// isModelAllowed reports whether a catalog model matches one of the patterns
+func isModelAllowed(patterns []string, modelID string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matchModelPattern(pattern, modelID) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterCatalog returns the allowed catalog models that pass the filter, sorted by ID
+func filterCatalog(ctx context.Context, filter CatalogFilter) ([]ModelInfo, error) {
+	patterns, err := getModelPatterns(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	catalogMu.RLock()
+	var models []ModelInfo
+	for _, info := range catalog {
+		if isModelAllowed(patterns, info.ID) && filter.matches(info) {
+			models = append(models, info)
+		}
+	}
+	catalogMu.RUnlock()
+
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].ID < models[j].ID
+	})
+	return models, nil
+}
+
+// catalogPage renders a page of the catalog browser. Models are referenced by their index
+// in the filtered list, since IDs may not fit into the callback data.
+func catalogPage(ctx context.Context, userID int64, page int) (string, gotgbot.InlineKeyboardMarkup, error) {
+	filter, err := getCatalogFilter(ctx, userID)
+	if err != nil {
+		return "", gotgbot.InlineKeyboardMarkup{}, err
+	}
+	models, err := filterCatalog(ctx, filter)
+	if err != nil {
+		return "", gotgbot.InlineKeyboardMarkup{}, err
+	}
+	currentModels, err := getUserModels(ctx, userID)
+	if err != nil {
+		return "", gotgbot.InlineKeyboardMarkup{}, err
+	}
+	selectedModels := make(map[string]bool)
+	for _, model := range currentModels {
+		selectedModels[model] = true
+	}
+
+	pages := (len(models) + catalogPageSize - 1) / catalogPageSize
+	if page >= pages {
+		page = pages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+
+	text := fmt.Sprintf("📚 Model catalog: %d models", len(models))
+	if description := filter.describe(); description != "" {
+		text += "\nFilters: " + description
+	}
+	text += "\n\nTap a model to select or deselect it. Filter with /catalog search <text>, " +
+		"/catalog provider <name>, /catalog context <tokens>, /catalog price <max $ per 1M tokens> and /catalog clear."
+
+	var buttons [][]gotgbot.InlineKeyboardButton
+	for i := page * catalogPageSize; i < min((page+1)*catalogPageSize, len(models)); i++ {
+		info := models[i]
+		modelText := fmt.Sprintf("%s ($%.2f/$%.2f)", info.ID, info.PriceIn, info.PriceOut)
+		if info.PriceIn == 0 && info.PriceOut == 0 {
+			modelText = info.ID + " (free)"
+		}
+		if selectedModels[info.ID] {
+			modelText = "✅ " + modelText
+		}
+		buttons = append(buttons, []gotgbot.InlineKeyboardButton{
+			{Text: modelText, CallbackData: fmt.Sprintf("cat:t:%d", i)},
+		})
+	}
+
+	// Page navigation
+	if pages > 1 {
+		var nav []gotgbot.InlineKeyboardButton
+		if page > 0 {
+			nav = append(nav, gotgbot.InlineKeyboardButton{Text: "◀️", CallbackData: fmt.Sprintf("cat:p:%d", page-1)})
+		}
+		nav = append(nav, gotgbot.InlineKeyboardButton{Text: fmt.Sprintf("%d/%d", page+1, pages), CallbackData: fmt.Sprintf("cat:p:%d", page)})
+		if page < pages-1 {
+			nav = append(nav, gotgbot.InlineKeyboardButton{Text: "▶️", CallbackData: fmt.Sprintf("cat:p:%d", page+1)})
+		}
+		buttons = append(buttons, nav)
+	}
+
+	// Quick filters by input modality
+	modalityRow := []gotgbot.InlineKeyboardButton{{Text: "Any input", CallbackData: "cat:m:any"}}
+	if filter.Modality == "" {
+		modalityRow[0].Text = "✅ Any input"
+	}
+	for _, modality := range catalogModalities {
+		label := modality
+		if filter.Modality == modality {
+			label = "✅ " + label
+		}
+		modalityRow = append(modalityRow, gotgbot.InlineKeyboardButton{Text: label, CallbackData: "cat:m:" + modality})
+	}
+	buttons = append(buttons, modalityRow)
+
+	buttons = append(buttons, []gotgbot.InlineKeyboardButton{
+		{Text: "✨ Done", CallbackData: "models:done"},
+	})
+	return text, gotgbot.InlineKeyboardMarkup{InlineKeyboard: buttons}, nil
+}
+
+func handleCatalog(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	if !isModelCatalogEnabled() {
+		_, err := msg.Reply(b, "The model catalog is not enabled, use /set_models to choose models.", &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	args := strings.Fields(msg.Text)[1:]
+	if len(args) > 0 {
+		if text := updateCatalogFilter(context.Background(), userID, username, args); text != "" {
+			_, err := msg.Reply(b, text, &gotgbot.SendMessageOpts{
+				ReplyMarkup: getKeyboard(userMode),
+			})
+			return err
+		}
+	}
+
+	text, keyboard, err := catalogPage(context.Background(), userID, 0)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to show model catalog: %v", err))
+		_, err = msg.Reply(b, "Sorry, I encountered an error loading the model catalog.", &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+	if isAdmin(userID) {
+		text += "\n\nAdmin commands:\n" +
+			"/catalog allow <pattern> - Allow models matching a glob pattern, e.g. openai/*\n" +
+			"/catalog disallow <pattern> - Remove a pattern\n" +
+			"/catalog patterns - Show the allowed patterns"
+	}
+	_, err = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+		ReplyMarkup: keyboard,
+	})
+	return err
+}
+
+// updateCatalogFilter handles the arguments of /catalog. It returns a message for the user,
+// or an empty string if the catalog should be shown with the updated filter.
+func updateCatalogFilter(ctx context.Context, userID int64, username string, args []string) string {
+	const usage = "Usage:\n/catalog search <text>\n/catalog provider <name>|any\n/catalog modality image|audio|file|any\n" +
+		"/catalog context <min tokens>|any\n/catalog price <max $ per 1M tokens>|any\n/catalog clear"
+
+	key := catalogFilterKey(userID)
+	value := strings.Join(args[1:], " ")
+	if value == "any" {
+		value = ""
+	}
+
+	var field string
+	switch args[0] {
+	case "search":
+		field = "query"
+	case "provider":
+		field = "author"
+		value = strings.ToLower(value)
+	case "modality":
+		field = "modality"
+		valid := value == ""
+		for _, modality := range catalogModalities {
+			valid = valid || value == modality
+		}
+		if !valid {
+			return usage
+		}
+	case "context":
+		field = "context"
+		if parsed, err := strconv.Atoi(value); value != "" && (err != nil || parsed < 0) {
+			return "Invalid context length: " + value
+		}
+	case "price":
+		field = "price"
+		value = strings.TrimPrefix(value, "$")
+		if parsed, err := strconv.ParseFloat(value, 64); value != "" && (err != nil || parsed < 0) {
+			return "Invalid price: " + value
+		}
+	case "clear":
+		if err := rdb.Del(ctx, key).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to clear catalog filter: %v", err))
+			return "Sorry, I encountered an error updating the filter."
+		}
+		return ""
+	case "allow", "disallow", "patterns":
+		return updateModelPatterns(ctx, userID, username, args)
+	default:
+		return usage
+	}
+
+	var err error
+	if value == "" {
+		err = rdb.HDel(ctx, key, field).Err()
+	} else {
+		err = rdb.HSet(ctx, key, field, value).Err()
+	}
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to update catalog filter: %v", err))
+		return "Sorry, I encountered an error updating the filter."
+	}
+	return ""
+}
+
+// updateModelPatterns handles the admin forms of /catalog
+func updateModelPatterns(ctx context.Context, userID int64, username string, args []string) string {
+	if !isAdmin(userID) {
+		logMessage(userID, username, "access_denied", "User is not an admin")
+		return "Sorry, only admins can change the allowed models."
+	}
+
+	if args[0] != "patterns" {
+		if len(args) != 2 {
+			return "Usage: /catalog allow|disallow <pattern>"
+		}
+		// The first admin pattern replaces the configured ones, keep them
+		patterns, err := getModelPatterns(ctx)
+		if err == nil && args[0] == "allow" {
+			err = rdb.SAdd(ctx, catalogPatternsKey, append(toInterfaces(patterns), args[1])...).Err()
+		} else if err == nil {
+			if exists, _ := rdb.Exists(ctx, catalogPatternsKey).Result(); exists == 0 && len(patterns) > 0 {
+				err = rdb.SAdd(ctx, catalogPatternsKey, toInterfaces(patterns)...).Err()
+			}
+			if err == nil {
+				err = rdb.SRem(ctx, catalogPatternsKey, args[1]).Err()
+			}
+		}
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to update model patterns: %v", err))
+			return "Sorry, I encountered an error updating the allowed models."
+		}
+		logMessage(userID, username, "catalog", fmt.Sprintf("%s model pattern %s", args[0], args[1]))
+	}
+
+	patterns, err := getModelPatterns(ctx)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to get model patterns: %v", err))
+		return "Sorry, I encountered an error retrieving the allowed models."
+	}
+	if len(patterns) == 0 {
+		return "All catalog models are allowed."
+	}
+	return "Allowed catalog models:\n" + strings.Join(patterns, "\n")
+}
+
+func toInterfaces(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
+
+// handleCatalogCallback handles the buttons of the catalog browser, data is the callback data without "cat:"
+func handleCatalogCallback(b *gotgbot.Bot, callback *gotgbot.CallbackQuery, userID int64, username string, data string) error {
+	msg := callback.Message
+	if msg == nil {
+		return fmt.Errorf("callback message is nil")
+	}
+	bg := context.Background()
+
+	action, arg, _ := strings.Cut(data, ":")
+	number, _ := strconv.Atoi(arg)
+	page := number
+	switch action {
+	case "p":
+	case "m":
+		var err error
+		if arg == "any" {
+			err = rdb.HDel(bg, catalogFilterKey(userID), "modality").Err()
+		} else {
+			err = rdb.HSet(bg, catalogFilterKey(userID), "modality", arg).Err()
+		}
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to update catalog filter: %v", err))
+		}
+		page = 0
+	case "t":
+		page = number / catalogPageSize
+		filter, err := getCatalogFilter(bg, userID)
+		if err != nil {
+			return err
+		}
+		models, err := filterCatalog(bg, filter)
+		if err != nil {
+			return err
+		}
+		if number < 0 || number >= len(models) {
+			_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "This model is no longer in the catalog", ShowAlert: true})
+			return err
+		}
+
+		model := models[number].ID
+		currentModels, err := getUserModels(bg, userID)
+		if err != nil {
+			return err
+		}
+		selected := false
+		for _, current := range currentModels {
+			selected = selected || current == model
+		}
+		if selected {
+			err = removeUserModel(bg, userID, model)
+		} else {
+			err = addUserModel(bg, userID, model)
+		}
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to update models: %v", err))
+			_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "Error updating models", ShowAlert: true})
+			return err
+		}
+		logMessage(userID, username, "catalog", fmt.Sprintf("Toggled catalog model %s", model))
+	default:
+		return nil
+	}
+
+	text, keyboard, err := catalogPage(bg, userID, page)
+	if err != nil {
+		return err
+	}
+	_, _, err = b.EditMessageText(text, &gotgbot.EditMessageTextOpts{
+		ChatId:      msg.GetChat().Id,
+		MessageId:   msg.GetMessageId(),
+		ReplyMarkup: keyboard,
+	})
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		return err
+	}
+
+	// Acknowledge the callback without showing alert
+	_, err = callback.Answer(b, nil)
+	return err
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"log"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 
@@ -19,11 +18,54 @@ type Config struct {
 	RedisPort           string
 	RedisDB             string
 	RedisPass           string
-	AvailableModels     []ModelInfo // Changed from []string to []ModelInfo
+	AvailableModels     []ModelInfo // Replaced on catalog refreshes, read it with getAvailableModels
+	ModelIDs            []string    // Configured model IDs in the order of AVAILABLE_MODELS
+	CatalogRefreshMins  int         // Interval of the OpenRouter catalog refresh
+	ModelCatalog        bool        // Lets users pick any OpenRouter model with /catalog
+	ModelPatterns       []string    // Glob patterns of the catalog models users may pick, empty allows all
 	AllowedUsers        []int64
 	TogetherAPIKey      string
 	TogetherModel       string
+	ImagePrice          float64 // USD per generated image
 	AvailableImgModels  []string
+	CustomProviders     map[string]CustomProvider
+	OllamaBaseURL       string
+	AnthropicAPIKey     string
+	MaxRetries          int
+	FallbackModels      map[string][]string // Model ID -> ordered list of fallback model IDs
+	ModelTimeoutSecs    int                 // Time limit of an answer, including retries and fallbacks
+	OrderedAnswers      bool                // Posts the answers of several models in the order they were selected
+	AnswerVoting        bool                // Asks which answer was best after several models answered
+	JudgeModel          string              // Merges the answers of several models into one, empty disables it
+	AdminUsers          []int64
+	UserRoles           map[int64]string  // User ID -> role name
+	UserBudget          Budget            // Default budget of every user
+	RoleBudgets         map[string]Budget // Role name -> budget of every user with this role
+	GlobalBudget        Budget            // Budget of the whole bot
+	BudgetWarnings      []float64         // Fractions of a budget at which admins are warned
+	EnabledTools        []string
+	MaxToolIterations   int
+	TranscriptionURL    string // Base URL of a Whisper-compatible API, empty disables voice messages
+	TranscriptionAPIKey string
+	TranscriptionModel  string
+	DocumentMaxChars    int    // Longer documents are summarized before they are added to a conversation
+	EmbeddingsURL       string // Base URL of an OpenAI-compatible embeddings API, empty disables the knowledge base
+	EmbeddingsAPIKey    string
+	EmbeddingsModel     string
+	EmbeddingsPrice     float64 // USD per 1M embedded tokens
+	KBTopK              int     // Number of knowledge base chunks added to a chat message
+	KBChunkChars        int     // Size of the chunks knowledge base documents are split into
+	DefaultContextLen   int     // Context length of models that don't report one
+	MaxContextTokens    int     // Limit of history tokens sent with a request, zero means the model's context length
+	SummaryModel        string
+	SummaryThreshold    int // History tokens above which old turns are summarized, zero disables summaries
+	SummaryKeepTurns    int // Latest turns that are never summarized
+}
+
+// CustomProvider is an OpenAI-compatible server (vLLM, llama.cpp server, LM Studio, ...)
+type CustomProvider struct {
+	BaseURL string
+	APIKey  string
 }
 
 var config Config
@@ -34,8 +76,7 @@ func initConfig() {
 		log.Printf("[System] No .env file found, using system environment variables")
 	}
 
-	// Parse and fetch pricing for available models
-	var availableModels []ModelInfo
+	// Parse available models
 	defaultModel := "google/gemini-flash-1.5"
 	
 	modelsList := []string{defaultModel}
@@ -51,35 +92,25 @@ func initConfig() {
 		}
 	}
 
-	// Fetch pricing information from OpenRouter
-	modelPricing, err := FetchModelPricing()
-	if err != nil {
-		log.Printf("[Warning] Failed to fetch model pricing: %v", err)
-		// Create default models without pricing info
-		for _, modelID := range cleanModelsList {
-			availableModels = append(availableModels, ModelInfo{
-				ID: modelID,
-			})
-		}
-	} else {
-		// Create models with pricing info and sort by average price
-		for _, modelID := range cleanModelsList {
-			if info, ok := modelPricing[modelID]; ok {
-				availableModels = append(availableModels, info)
-			} else {
-				// Include model without pricing if not found in OpenRouter response
-				availableModels = append(availableModels, ModelInfo{
-					ID: modelID,
-				})
-			}
+	// Prices are filled in from the cached or fetched OpenRouter catalog once Redis is available
+	availableModels := buildAvailableModels(cleanModelsList, nil)
+
+	// Interval of the background catalog and pricing refresh
+	catalogRefreshMins := 360
+	if mins := os.Getenv("CATALOG_REFRESH_MINUTES"); mins != "" {
+		if parsed, err := strconv.Atoi(mins); err == nil && parsed > 0 {
+			catalogRefreshMins = parsed
+		} else {
+			log.Printf("[Warning] Invalid CATALOG_REFRESH_MINUTES value: %s", mins)
 		}
+	}
 
-		// Sort models by average price (input + output / 2)
-		sort.Slice(availableModels, func(i, j int) bool {
-			avgPriceI := (availableModels[i].PriceIn + availableModels[i].PriceOut) / 2
-			avgPriceJ := (availableModels[j].PriceIn + availableModels[j].PriceOut) / 2
-			return avgPriceI < avgPriceJ
-		})
+	// Catalog models users may pick, e.g. "openai/*,anthropic/claude-*"
+	var modelPatterns []string
+	for _, pattern := range strings.Split(os.Getenv("CATALOG_MODEL_PATTERNS"), ",") {
+		if trimmed := strings.TrimSpace(pattern); trimmed != "" {
+			modelPatterns = append(modelPatterns, trimmed)
+		}
 	}
 
 	// Parse allowed users from environment variable
@@ -106,6 +137,221 @@ func initConfig() {
 		}
 	}
 
+	// Parse OpenAI-compatible providers in the form "name=base_url", the API key is read from <NAME>_API_KEY
+	customProviders := make(map[string]CustomProvider)
+	if providers := os.Getenv("OPENAI_COMPATIBLE_PROVIDERS"); providers != "" {
+		for _, entry := range strings.Split(providers, ",") {
+			name, baseURL, found := strings.Cut(strings.TrimSpace(entry), "=")
+			if !found || name == "" || baseURL == "" {
+				log.Printf("[Warning] Invalid OpenAI-compatible provider entry: %s", entry)
+				continue
+			}
+			keyEnv := strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_API_KEY"
+			customProviders[name] = CustomProvider{
+				BaseURL: strings.TrimSpace(baseURL),
+				APIKey:  os.Getenv(keyEnv),
+			}
+		}
+	}
+
+	// Parse retry count for transient API errors
+	maxRetries := 2
+	if retries := os.Getenv("MAX_RETRIES"); retries != "" {
+		if parsed, err := strconv.Atoi(retries); err == nil && parsed >= 0 {
+			maxRetries = parsed
+		} else {
+			log.Printf("[Warning] Invalid MAX_RETRIES value: %s", retries)
+		}
+	}
+
+	// Time limit of an answer, models are queried concurrently so a slow one doesn't hold up the others
+	modelTimeoutSecs := 180
+	if timeout := os.Getenv("MODEL_TIMEOUT_SECONDS"); timeout != "" {
+		if parsed, err := strconv.Atoi(timeout); err == nil && parsed > 0 {
+			modelTimeoutSecs = parsed
+		} else {
+			log.Printf("[Warning] Invalid MODEL_TIMEOUT_SECONDS value: %s", timeout)
+		}
+	}
+
+	// Parse fallback chains in the form "model=fallback1|fallback2,other_model=fallback3"
+	fallbackModels := make(map[string][]string)
+	if fallbacks := os.Getenv("FALLBACK_MODELS"); fallbacks != "" {
+		for _, entry := range strings.Split(fallbacks, ",") {
+			model, chain, found := strings.Cut(strings.TrimSpace(entry), "=")
+			if !found || model == "" {
+				log.Printf("[Warning] Invalid fallback entry: %s", entry)
+				continue
+			}
+			for _, fallback := range strings.Split(chain, "|") {
+				if trimmed := strings.TrimSpace(fallback); trimmed != "" {
+					fallbackModels[model] = append(fallbackModels[model], trimmed)
+				}
+			}
+		}
+	}
+
+	// Parse admin users from environment variable
+	var adminUsers []int64
+	if users := os.Getenv("ADMIN_USERS"); users != "" {
+		for _, userStr := range strings.Split(users, ",") {
+			if userID, err := strconv.ParseInt(strings.TrimSpace(userStr), 10, 64); err == nil {
+				adminUsers = append(adminUsers, userID)
+			}
+		}
+	}
+
+	// Parse user roles in the form "user_id=role"
+	userRoles := make(map[int64]string)
+	if roles := os.Getenv("USER_ROLES"); roles != "" {
+		for _, entry := range strings.Split(roles, ",") {
+			userStr, role, found := strings.Cut(strings.TrimSpace(entry), "=")
+			userID, err := strconv.ParseInt(userStr, 10, 64)
+			if !found || err != nil || role == "" {
+				log.Printf("[Warning] Invalid user role entry: %s", entry)
+				continue
+			}
+			userRoles[userID] = role
+		}
+	}
+
+	// Parse role budgets in the form "role=daily/monthly"
+	roleBudgets := make(map[string]Budget)
+	if budgets := os.Getenv("ROLE_BUDGETS"); budgets != "" {
+		for _, entry := range strings.Split(budgets, ",") {
+			role, budget, found := strings.Cut(strings.TrimSpace(entry), "=")
+			if !found || role == "" {
+				log.Printf("[Warning] Invalid role budget entry: %s", entry)
+				continue
+			}
+			roleBudgets[role] = parseBudget(budget)
+		}
+	}
+
+	// Parse thresholds at which admins are warned about spend
+	var warningThresholds []float64
+	if thresholds := os.Getenv("BUDGET_WARNING_THRESHOLDS"); thresholds != "" {
+		for _, thresholdStr := range strings.Split(thresholds, ",") {
+			if threshold, err := strconv.ParseFloat(strings.TrimSpace(thresholdStr), 64); err == nil && threshold > 0 {
+				warningThresholds = append(warningThresholds, threshold)
+			}
+		}
+	}
+
+	// Parse tools that chat models may call
+	var enabledTools []string
+	if tools := os.Getenv("ENABLED_TOOLS"); tools != "" {
+		for _, tool := range strings.Split(tools, ",") {
+			if trimmed := strings.TrimSpace(tool); trimmed != "" {
+				enabledTools = append(enabledTools, trimmed)
+			}
+		}
+	}
+
+	// Parse how many model -> tool -> model rounds are allowed per message
+	maxToolIterations := 5
+	if iterations := os.Getenv("MAX_TOOL_ITERATIONS"); iterations != "" {
+		if parsed, err := strconv.Atoi(iterations); err == nil && parsed > 0 {
+			maxToolIterations = parsed
+		} else {
+			log.Printf("[Warning] Invalid MAX_TOOL_ITERATIONS value: %s", iterations)
+		}
+	}
+
+	// Whisper model used to transcribe voice messages
+	transcriptionModel := os.Getenv("TRANSCRIPTION_MODEL")
+	if transcriptionModel == "" {
+		transcriptionModel = "whisper-1"
+	}
+
+	// Parse the document length above which uploads are summarized
+	documentMaxChars := 20000
+	if maxChars := os.Getenv("DOCUMENT_MAX_CHARS"); maxChars != "" {
+		if parsed, err := strconv.Atoi(maxChars); err == nil && parsed > 0 {
+			documentMaxChars = parsed
+		} else {
+			log.Printf("[Warning] Invalid DOCUMENT_MAX_CHARS value: %s", maxChars)
+		}
+	}
+
+	// Parse knowledge base settings
+	embeddingsModel := os.Getenv("EMBEDDINGS_MODEL")
+	if embeddingsModel == "" {
+		embeddingsModel = "text-embedding-3-small"
+	}
+	kbTopK := 4
+	if topK := os.Getenv("KB_TOP_K"); topK != "" {
+		if parsed, err := strconv.Atoi(topK); err == nil && parsed > 0 {
+			kbTopK = parsed
+		} else {
+			log.Printf("[Warning] Invalid KB_TOP_K value: %s", topK)
+		}
+	}
+	var imagePrice float64
+	if price := os.Getenv("IMAGE_PRICE"); price != "" {
+		if parsed, err := strconv.ParseFloat(price, 64); err == nil && parsed >= 0 {
+			imagePrice = parsed
+		} else {
+			log.Printf("[Warning] Invalid IMAGE_PRICE value: %s", price)
+		}
+	}
+	var embeddingsPrice float64
+	if price := os.Getenv("EMBEDDINGS_PRICE"); price != "" {
+		if parsed, err := strconv.ParseFloat(price, 64); err == nil && parsed >= 0 {
+			embeddingsPrice = parsed
+		} else {
+			log.Printf("[Warning] Invalid EMBEDDINGS_PRICE value: %s", price)
+		}
+	}
+	kbChunkChars := 1500
+	if chunkChars := os.Getenv("KB_CHUNK_CHARS"); chunkChars != "" {
+		if parsed, err := strconv.Atoi(chunkChars); err == nil && parsed > 0 {
+			kbChunkChars = parsed
+		} else {
+			log.Printf("[Warning] Invalid KB_CHUNK_CHARS value: %s", chunkChars)
+		}
+	}
+
+	// Parse context window limits
+	defaultContextLen := 16000
+	if contextLen := os.Getenv("DEFAULT_CONTEXT_LENGTH"); contextLen != "" {
+		if parsed, err := strconv.Atoi(contextLen); err == nil && parsed > 0 {
+			defaultContextLen = parsed
+		} else {
+			log.Printf("[Warning] Invalid DEFAULT_CONTEXT_LENGTH value: %s", contextLen)
+		}
+	}
+	maxContextTokens := 0
+	if maxTokens := os.Getenv("MAX_CONTEXT_TOKENS"); maxTokens != "" {
+		if parsed, err := strconv.Atoi(maxTokens); err == nil && parsed >= 0 {
+			maxContextTokens = parsed
+		} else {
+			log.Printf("[Warning] Invalid MAX_CONTEXT_TOKENS value: %s", maxTokens)
+		}
+	}
+
+	// Parse rolling summary settings
+	summaryModel := os.Getenv("SUMMARY_MODEL")
+	if summaryModel == "" {
+		summaryModel = os.Getenv("OPENROUTER_MODEL")
+	}
+	summaryThreshold := 8000
+	if threshold := os.Getenv("SUMMARY_THRESHOLD_TOKENS"); threshold != "" {
+		if parsed, err := strconv.Atoi(threshold); err == nil && parsed >= 0 {
+			summaryThreshold = parsed
+		} else {
+			log.Printf("[Warning] Invalid SUMMARY_THRESHOLD_TOKENS value: %s", threshold)
+		}
+	}
+	summaryKeepTurns := 4
+	if keepTurns := os.Getenv("SUMMARY_KEEP_TURNS"); keepTurns != "" {
+		if parsed, err := strconv.Atoi(keepTurns); err == nil && parsed >= 0 {
+			summaryKeepTurns = parsed
+		} else {
+			log.Printf("[Warning] Invalid SUMMARY_KEEP_TURNS value: %s", keepTurns)
+		}
+	}
+
 	config = Config{
 		TelegramToken:       os.Getenv("TELEGRAM_BOT_TOKEN"),
 		OpenRouterAPIKey:    os.Getenv("OPENROUTER_API_KEY"),
@@ -116,10 +362,47 @@ func initConfig() {
 		RedisDB:            os.Getenv("REDIS_DB"),
 		RedisPass:          os.Getenv("REDIS_PASS"),
 		AvailableModels:    availableModels,
+		ModelIDs:           cleanModelsList,
+		CatalogRefreshMins: catalogRefreshMins,
+		ModelCatalog:       os.Getenv("MODEL_CATALOG") == "true",
+		ModelPatterns:      modelPatterns,
 		AllowedUsers:       allowedUsers,
 		TogetherAPIKey:     os.Getenv("TOGETHER_API_KEY"),
 		TogetherModel:      os.Getenv("TOGETHER_MODEL"),
+		ImagePrice:         imagePrice,
 		AvailableImgModels: imgModels,
+		CustomProviders:    customProviders,
+		OllamaBaseURL:      os.Getenv("OLLAMA_BASE_URL"),
+		AnthropicAPIKey:    os.Getenv("ANTHROPIC_API_KEY"),
+		MaxRetries:         maxRetries,
+		FallbackModels:     fallbackModels,
+		ModelTimeoutSecs:   modelTimeoutSecs,
+		OrderedAnswers:     os.Getenv("ORDERED_ANSWERS") == "true",
+		AnswerVoting:       os.Getenv("ANSWER_VOTING") == "true",
+		JudgeModel:         strings.TrimSpace(os.Getenv("JUDGE_MODEL")),
+		AdminUsers:         adminUsers,
+		UserRoles:          userRoles,
+		UserBudget:         parseBudget(os.Getenv("USER_BUDGET")),
+		RoleBudgets:        roleBudgets,
+		GlobalBudget:       parseBudget(os.Getenv("GLOBAL_BUDGET")),
+		BudgetWarnings:     warningThresholds,
+		EnabledTools:       enabledTools,
+		MaxToolIterations:  maxToolIterations,
+		TranscriptionURL:    strings.TrimSuffix(os.Getenv("TRANSCRIPTION_BASE_URL"), "/"),
+		TranscriptionAPIKey: os.Getenv("TRANSCRIPTION_API_KEY"),
+		TranscriptionModel:  transcriptionModel,
+		DocumentMaxChars:    documentMaxChars,
+		EmbeddingsURL:       strings.TrimSuffix(os.Getenv("EMBEDDINGS_BASE_URL"), "/"),
+		EmbeddingsAPIKey:    os.Getenv("EMBEDDINGS_API_KEY"),
+		EmbeddingsModel:     embeddingsModel,
+		EmbeddingsPrice:     embeddingsPrice,
+		KBTopK:              kbTopK,
+		KBChunkChars:        kbChunkChars,
+		DefaultContextLen:   defaultContextLen,
+		MaxContextTokens:    maxContextTokens,
+		SummaryModel:        summaryModel,
+		SummaryThreshold:    summaryThreshold,
+		SummaryKeepTurns:    summaryKeepTurns,
 	}
 
 	// Validate required environment variables
@@ -127,6 +410,36 @@ func initConfig() {
 		log.Fatal("[Error] Missing required environment variables")
 	}
 
+	// Create chat providers and make sure every model is served by one of them
+	initProviders()
+	for _, model := range getAvailableModels() {
+		if _, ok := chatProviders[model.Provider]; !ok {
+			log.Fatalf("[Error] Provider %q is not configured for model: %s", model.Provider, model.ID)
+		}
+	}
+	for model, chain := range config.FallbackModels {
+		for _, fallback := range chain {
+			if provider, _ := parseModelID(fallback); chatProviders[provider] == nil {
+				log.Fatalf("[Error] Provider %q is not configured for fallback model %s of %s", provider, fallback, model)
+			}
+		}
+	}
+
+	if provider, _ := parseModelID(config.SummaryModel); chatProviders[provider] == nil {
+		log.Fatalf("[Error] Provider %q is not configured for summary model %s", provider, config.SummaryModel)
+	}
+
+	if provider, _ := parseModelID(config.JudgeModel); config.JudgeModel != "" && chatProviders[provider] == nil {
+		log.Fatalf("[Error] Provider %q is not configured for judge model %s", provider, config.JudgeModel)
+	}
+
+	// Validate tools configuration
+	for _, tool := range config.EnabledTools {
+		if _, ok := availableTools[tool]; !ok {
+			log.Fatalf("[Error] Unknown tool: %s", tool)
+		}
+	}
+
 	// Validate image models configuration if image generation is enabled
 	if config.TogetherAPIKey != "" {
 		for _, model := range config.AvailableImgModels {
@@ -136,3 +449,24 @@ func initConfig() {
 		}
 	}
 }
+
+// parseBudget parses a budget in the form "daily/monthly" in USD, e.g. "2/40".
+// Missing or zero values mean unlimited.
+func parseBudget(value string) Budget {
+	var budget Budget
+	if value == "" {
+		return budget
+	}
+	daily, monthly, _ := strings.Cut(value, "/")
+	if parsed, err := strconv.ParseFloat(strings.TrimSpace(daily), 64); err == nil {
+		budget.Daily = parsed
+	} else if strings.TrimSpace(daily) != "" {
+		log.Printf("[Warning] Invalid daily budget: %s", daily)
+	}
+	if parsed, err := strconv.ParseFloat(strings.TrimSpace(monthly), 64); err == nil {
+		budget.Monthly = parsed
+	} else if strings.TrimSpace(monthly) != "" {
+		log.Printf("[Warning] Invalid monthly budget: %s", monthly)
+	}
+	return budget
+}
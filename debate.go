@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/go-redis/redis/v8"
+)
+
+// maxDebateRounds limits the cost and length of a debate
+const maxDebateRounds = 5
+
+// defaultDebateRounds is used when /debate is given no number of rounds
+const defaultDebateRounds = 2
+
+// debateAnswerTokens is the assumed length of a debate answer in the cost estimate
+const debateAnswerTokens = 600
+
+// debateConfirmTTL is how long a debate waits for the user to confirm the cost
+const debateConfirmTTL = time.Hour
+
+// debateSummaryPrompt instructs the model summarizing a debate
+const debateSummaryPrompt = "You summarize a debate between AI models about a question. " +
+	"Give the conclusion the debate points to, the main arguments, where the models came to agree and where they still disagree. " +
+	"Answer in the language of the question."
+
+// Debate is a debate waiting for the user to confirm its estimated cost
+type Debate struct {
+	UserID    int64    `json:"user_id"`
+	MessageID int64    `json:"message_id"` // The /debate message, answers are replies to it
+	Question  string   `json:"question"`
+	Rounds    int      `json:"rounds"`
+	Models    []string `json:"models"`
+}
+
+// debateThreadPrefix starts the conversation key of a debate summary, it is followed by the
+// /debate message
+const debateThreadPrefix = "debate:"
+
+// debateThread returns the conversation key of the summary of the debate started by a message
+func debateThread(messageID int64) string {
+	return fmt.Sprintf("%s%d", debateThreadPrefix, messageID)
+}
+
+// debateSummaryModel returns the model that summarizes debates
+func debateSummaryModel() string {
+	if config.JudgeModel != "" {
+		return config.JudgeModel
+	}
+	return config.SummaryModel
+}
+
+// estimateDebateCost estimates the cost of a debate. In every round each model sees the question,
+// its own earlier answers and the other models' answers. It also returns the models without prices,
+// which are counted as free.
+func estimateDebateCost(question string, models []string, rounds int) (float64, []string) {
+	questionTokens := estimateTokens(Message{Role: "user", Content: TextContent(question)})
+	priced := func(model string) bool {
+		info, ok := findModelInfo(model)
+		return ok && (info.PriceIn > 0 || info.PriceOut > 0)
+	}
+
+	var cost float64
+	var unpriced []string
+	for _, model := range models {
+		if !priced(model) {
+			unpriced = append(unpriced, model)
+		}
+		for round := 1; round <= rounds; round++ {
+			prompt := questionTokens + (round-1)*len(models)*debateAnswerTokens
+			cost += estimateCost(model, Usage{PromptTokens: prompt, CompletionTokens: debateAnswerTokens})
+		}
+	}
+
+	summaryModel := debateSummaryModel()
+	if !priced(summaryModel) {
+		unpriced = append(unpriced, summaryModel)
+	}
+	prompt := questionTokens + rounds*len(models)*debateAnswerTokens
+	cost += estimateCost(summaryModel, Usage{PromptTokens: prompt, CompletionTokens: debateAnswerTokens})
+	return cost, unpriced
+}
+
+// rebuttalPrompt asks the i-th model to answer the other models' latest answers
+func rebuttalPrompt(round int, rounds int, models []string, latest []string, i int) string {
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Round %d of %d of the debate. The latest answers of the other participants:", round, rounds)
+	for j, answer := range latest {
+		if j != i && answer != "" {
+			fmt.Fprintf(&prompt, "\n\n--- %s ---\n%s", models[j], answer)
+		}
+	}
+	prompt.WriteString("\n\nRebut the points you disagree with, and revise your own answer where they convinced you. Then give your updated answer.")
+	return prompt.String()
+}
+
+func handleDebate(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	reply := func(text string) error {
+		_, err := msg.Reply(b, text, &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	// The number of rounds is optional
+	rounds := defaultDebateRounds
+	args, question := splitCommand(msg.Text, 2)
+	if len(args) > 1 {
+		if parsed, err := strconv.Atoi(args[1]); err == nil {
+			rounds = parsed
+		} else {
+			question = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(msg.Text), args[0]))
+		}
+	}
+	if question == "" || rounds < 1 || rounds > maxDebateRounds {
+		return reply(fmt.Sprintf("Usage: /debate [rounds] <question>\n\n"+
+			"Your selected models answer the question, then see each other's answers and rebut or revise them "+
+			"for up to %d rounds (%d by default). A summary follows the last round.", maxDebateRounds, defaultDebateRounds))
+	}
+
+	models, err := getUserModels(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user models")
+		return reply("Sorry, your selected models could not be loaded.")
+	}
+	if len(models) < 2 {
+		return reply("A debate needs at least two models, select them with /set_models.")
+	}
+	sort.Strings(models)
+
+	debate := Debate{UserID: userID, MessageID: msg.MessageId, Question: question, Rounds: rounds, Models: models}
+	id, err := rdb.Incr(context.Background(), "debate:next_id").Result()
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to create debate: %v", err))
+		return reply("Sorry, the debate could not be created.")
+	}
+	data, err := json.Marshal(debate)
+	if err != nil {
+		return fmt.Errorf("json marshal error: %w", err)
+	}
+	if err := rdb.Set(context.Background(), fmt.Sprintf("debate:%d", id), data, debateConfirmTTL).Err(); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to save debate: %v", err))
+		return reply("Sorry, the debate could not be created.")
+	}
+
+	cost, unpriced := estimateDebateCost(question, models, rounds)
+	text := fmt.Sprintf("🗣 Debate between %s in %d rounds, summarized by %s.\n\n"+
+		"Estimated cost: about $%.4f (%d answers of ~%d tokens each).",
+		strings.Join(models, ", "), rounds, debateSummaryModel(), cost, len(models)*rounds+1, debateAnswerTokens)
+	if len(unpriced) > 0 {
+		text += fmt.Sprintf("\nNo known prices for %s, counted as free.", strings.Join(unpriced, ", "))
+	}
+	text += "\n\nThe debate starts a new conversation with these models."
+	_, err = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+		ReplyMarkup: gotgbot.InlineKeyboardMarkup{
+			InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
+				{Text: "✅ Start debate", CallbackData: fmt.Sprintf("debate:start:%d", id)},
+				{Text: "❌ Cancel", CallbackData: fmt.Sprintf("debate:cancel:%d", id)},
+			}},
+		},
+	})
+	return err
+}
+
+// handleDebateCallback starts or cancels a confirmed debate, data is the callback data without "debate:"
+func handleDebateCallback(b *gotgbot.Bot, callback *gotgbot.CallbackQuery, userID int64, username string, data string) error {
+	msg := callback.Message
+	if msg == nil {
+		return fmt.Errorf("callback message is nil")
+	}
+	bg := context.Background()
+
+	action, idText, _ := strings.Cut(data, ":")
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid debate callback data: %s", data)
+	}
+	key := fmt.Sprintf("debate:%d", id)
+
+	var debate Debate
+	stored, err := rdb.Get(bg, key).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("redis get error: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal([]byte(stored), &debate); err != nil {
+			return fmt.Errorf("json unmarshal error: %w", err)
+		}
+	}
+	// Deleting the debate makes sure it starts only once
+	deleted, err := rdb.Del(bg, key).Result()
+	if err != nil {
+		return fmt.Errorf("redis del error: %w", err)
+	}
+	if deleted == 0 || debate.UserID != userID {
+		_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "This debate is no longer available.",
+			ShowAlert: true,
+		})
+		return err
+	}
+
+	text := "Debate canceled."
+	if action == "start" {
+		text = fmt.Sprintf("🗣 Debate started: %s", debate.Question)
+	}
+	if _, _, err := b.EditMessageText(text, &gotgbot.EditMessageTextOpts{
+		ChatId:    msg.GetChat().Id,
+		MessageId: msg.GetMessageId(),
+	}); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to edit debate message: %v", err))
+	}
+	if _, err := callback.Answer(b, nil); err != nil {
+		return err
+	}
+	if action != "start" {
+		return nil
+	}
+
+	userMode, err := getUserMode(bg, userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+	question := &gotgbot.Message{MessageId: debate.MessageID, Chat: msg.GetChat()}
+	return runDebate(b, question, userID, username, userMode, debate)
+}
+
+// runDebate lets the models answer the question and each other for the given rounds and
+// posts a summary. Every answer is a reply to msg and part of the model's conversation,
+// so replying to any of them continues with that model.
+func runDebate(b *gotgbot.Bot, msg *gotgbot.Message, userID int64, username string, userMode string, debate Debate) error {
+	// The debate stops when the conversation is restarted
+	ctx, done := startRequest(userID)
+	defer done()
+
+	logMessage(userID, username, "debate", fmt.Sprintf("%d rounds between %s: %s", debate.Rounds, strings.Join(debate.Models, ", "), debate.Question))
+	for _, model := range debate.Models {
+		if err := clearConversationHistory(ctx, userID, model); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to clear conversation for model %s", model))
+		}
+	}
+
+	latest := make([]string, len(debate.Models))
+	var transcript strings.Builder
+	for round := 1; round <= debate.Rounds; round++ {
+		if _, err := msg.Reply(b, fmt.Sprintf("🗣 Round %d of %d", round, debate.Rounds), nil); err != nil {
+			return err
+		}
+
+		contents := make([]MessageContent, len(debate.Models))
+		for i := range debate.Models {
+			if round == 1 {
+				contents[i] = TextContent(debate.Question)
+			} else {
+				contents[i] = TextContent(rebuttalPrompt(round, debate.Rounds, debate.Models, latest, i))
+			}
+		}
+
+		slots, errs := fanOut(ctx, b, msg, userID, username, userMode, debate.Models, contents, nil, nil)
+		if ctx.Err() != nil {
+			return nil
+		}
+		answered := 0
+		for i, slot := range slots {
+			if errs[i] != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("[%s] Debate round %d: %v", debate.Models[i], round, errs[i]))
+				continue
+			}
+			if slot.answeredBy != "" {
+				latest[i] = slot.answer
+				answered++
+				fmt.Fprintf(&transcript, "\n\n--- Round %d, %s ---\n%s", round, debate.Models[i], slot.answer)
+			}
+		}
+		if answered < 2 {
+			_, err := msg.Reply(b, fmt.Sprintf("⚠️ The debate stopped, fewer than two models answered in round %d.", round), &gotgbot.SendMessageOpts{
+				ReplyMarkup: getKeyboard(userMode),
+			})
+			return err
+		}
+	}
+
+	return summarizeDebate(ctx, b, msg, userID, username, debate.Question, transcript.String())
+}
+
+// summarizeDebate posts the conclusion of a debate. It starts the debate's thread, so replying
+// to the summary continues with the summary model.
+func summarizeDebate(ctx context.Context, b *gotgbot.Bot, msg *gotgbot.Message, userID int64, username string, question string, transcript string) error {
+	answer := Answer{
+		UserID:   userID,
+		Thread:   debateThread(msg.MessageId),
+		PromptID: msg.MessageId,
+		Request: []Message{
+			{Role: "system", Content: TextContent(debateSummaryPrompt)},
+			{Role: "user", Content: TextContent(fmt.Sprintf("Question:\n%s%s", question, transcript))},
+		},
+		Notes: []string{"🗣 Debate summary"},
+	}
+	if err := answerRequest(ctx, b, msg, userID, username, answer, TextContent(question)); err != nil {
+		return fmt.Errorf("debate summary failed: %w", err)
+	}
+	return nil
+}
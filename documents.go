@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// maxDocumentSize is the largest document that is downloaded, bots can't download larger files
+const maxDocumentSize = 20 * 1024 * 1024
+
+// maxDocumentChunks limits how many chunks of a long document are summarized,
+// the rest of the document is left out
+const maxDocumentChunks = 20
+
+// maxDecompressedSize limits how much the compressed parts of a document may expand while its
+// text is extracted, so a small file can't exhaust the memory. It is well above the text that
+// is kept of a document, maxDocumentChunks chunks of DOCUMENT_MAX_CHARS characters by default.
+const maxDecompressedSize = 64 * 1024 * 1024
+
+// errDecompressedTooLarge is returned when a document expands beyond maxDecompressedSize
+var errDecompressedTooLarge = errors.New("document is too large when decompressed")
+
+// limitedReader reads at most n more bytes from r and fails with errDecompressedTooLarge
+// if there is more
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// Reading one byte more than allowed tells whether there is more data
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errDecompressedTooLarge
+	}
+	return n, err
+}
+
+// defaultDocumentPrompt is sent with a document that has no caption
+const defaultDocumentPrompt = "Briefly summarize this document, then wait for my questions about it."
+
+// getDocumentContent downloads a document sent to the bot and returns its text as a content part.
+// Text longer than config.DocumentMaxChars is summarized chunk by chunk with the default model,
+// so it doesn't blow up the conversation history.
+func getDocumentContent(ctx context.Context, b *gotgbot.Bot, msg *gotgbot.Message, userID int64, username string, userMode string) (ContentPart, error) {
+	document := msg.Document
+	fileName := document.FileName
+	if fileName == "" {
+		fileName = "document"
+	}
+
+	data, err := downloadTelegramFile(ctx, document.FileId, maxDocumentSize)
+	if err != nil {
+		return ContentPart{}, fmt.Errorf("failed to download document: %w", err)
+	}
+
+	text, err := extractDocumentText(fileName, data)
+	if err != nil {
+		return ContentPart{}, err
+	}
+	logMessage(userID, username, "document", fmt.Sprintf("%s: %d bytes, %d characters of text", fileName, len(data), utf8.RuneCountInString(text)))
+
+	header := fmt.Sprintf("File: %s (%s)", fileName, formatFileSize(int64(len(data))))
+	if utf8.RuneCountInString(text) > config.DocumentMaxChars {
+		chunks := chunkText(text, config.DocumentMaxChars)
+		_, err := msg.Reply(b, fmt.Sprintf("📄 %s is long, summarizing it in %d parts first...", fileName, min(len(chunks), maxDocumentChunks)), &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		if err != nil {
+			return ContentPart{}, err
+		}
+
+		text, err = summarizeDocument(ctx, userID, username, fileName, chunks)
+		if err != nil {
+			return ContentPart{}, fmt.Errorf("failed to summarize document: %w", err)
+		}
+		header += ", summarized because it is too long"
+	}
+
+	return ContentPart{
+		Type:     "text",
+		Text:     fmt.Sprintf("%s\n<document>\n%s\n</document>", header, text),
+		FileName: fileName,
+		FileSize: int64(len(data)),
+	}, nil
+}
+
+// extractDocumentText returns the text of a PDF, Word (docx) or plain text document
+func extractDocumentText(fileName string, data []byte) (string, error) {
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".pdf":
+		return extractPDFText(data)
+	case ".docx":
+		return extractDocxText(data)
+	}
+
+	// Everything else (text, markdown, source code, ...) is accepted as long as it is text
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return "", fmt.Errorf("unsupported file type: %s", fileName)
+	}
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		return "", fmt.Errorf("document is empty")
+	}
+	return text, nil
+}
+
+// extractDocxText returns the paragraphs of a Word document. A docx file is a zip archive
+// with the body in word/document.xml, where text is in <w:t> elements of <w:p> paragraphs.
+func extractDocxText(data []byte) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("failed to open docx: %w", err)
+	}
+
+	var body io.ReadCloser
+	for _, file := range archive.File {
+		if file.Name == "word/document.xml" {
+			if body, err = file.Open(); err != nil {
+				return "", fmt.Errorf("failed to open document body: %w", err)
+			}
+			break
+		}
+	}
+	if body == nil {
+		return "", fmt.Errorf("not a Word document")
+	}
+	defer body.Close()
+
+	var text strings.Builder
+	inText := false
+	decoder := xml.NewDecoder(&limitedReader{r: body, n: maxDecompressedSize})
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse document body: %w", err)
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteString("\t")
+			case "br", "cr":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch element.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(element)
+			}
+		}
+	}
+
+	result := cleanExtractedText(text.String())
+	if result == "" {
+		return "", fmt.Errorf("document is empty")
+	}
+	return result, nil
+}
+
+// chunkText splits text into chunks of at most maxChars characters, preferring to split
+// at paragraph and line boundaries
+func chunkText(text string, maxChars int) []string {
+	var chunks []string
+	runes := []rune(text)
+	for len(runes) > maxChars {
+		split := maxChars
+		chunk := string(runes[:maxChars])
+		if i := strings.LastIndex(chunk, "\n\n"); i > len(chunk)/2 {
+			split = utf8.RuneCountInString(chunk[:i])
+		} else if i := strings.LastIndex(chunk, "\n"); i > len(chunk)/2 {
+			split = utf8.RuneCountInString(chunk[:i])
+		}
+		chunks = append(chunks, strings.TrimSpace(string(runes[:split])))
+		runes = runes[split:]
+	}
+	if rest := strings.TrimSpace(string(runes)); rest != "" {
+		chunks = append(chunks, rest)
+	}
+	return chunks
+}
+
+// summarizeDocument summarizes every chunk of a document with the default model
+// and joins the summaries
+func summarizeDocument(ctx context.Context, userID int64, username string, fileName string, chunks []string) (string, error) {
+	omitted := 0
+	if len(chunks) > maxDocumentChunks {
+		omitted = len(chunks) - maxDocumentChunks
+		chunks = chunks[:maxDocumentChunks]
+	}
+
+	var summaries []string
+	for i, chunk := range chunks {
+		prompt := fmt.Sprintf("Summarize part %d of %d of the document %q. Keep all facts, numbers, names and definitions "+
+			"someone could ask about later. Respond with only the summary.\n\n<document>\n%s\n</document>", i+1, len(chunks), fileName, chunk)
+		resp, err := callModel(ctx, userID, username, []Message{{Role: "user", Content: TextContent(prompt)}}, config.OpenRouterModel)
+		if err != nil {
+			return "", err
+		}
+		summaries = append(summaries, fmt.Sprintf("[Part %d]\n%s", i+1, strings.TrimSpace(resp.Content)))
+	}
+
+	if omitted > 0 {
+		summaries = append(summaries, fmt.Sprintf("[%d more parts were left out because the document is too long]", omitted))
+	}
+	return strings.Join(summaries, "\n\n"), nil
+}
+
+// formatFileSize formats a size in bytes for display
+func formatFileSize(size int64) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// docxWithFiles returns a zip archive with the given files
+func docxWithFiles(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range files {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(writer, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractDocxText(t *testing.T) {
+	const body = `<?xml version="1.0"?><w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>%s</w:body></w:document>`
+	document := func(paragraphs string) map[string]string {
+		return map[string]string{"word/document.xml": strings.Replace(body, "%s", paragraphs, 1)}
+	}
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "paragraphs",
+			files: document(`<w:p><w:r><w:t>Hello</w:t></w:r><w:r><w:t xml:space="preserve"> world</w:t></w:r></w:p><w:p><w:r><w:t>Second</w:t></w:r></w:p>`),
+			want:  "Hello world\nSecond",
+		},
+		{
+			name:  "tabs and breaks",
+			files: document(`<w:p><w:r><w:t>a</w:t><w:tab/><w:t>b</w:t><w:br/><w:t>c</w:t></w:r></w:p>`),
+			want:  "a b\nc",
+		},
+		{
+			name:  "text outside runs is ignored",
+			files: document(`<w:p><w:pPr><w:pStyle w:val="Title"/></w:pPr><w:r><w:t>Text</w:t></w:r></w:p>`),
+			want:  "Text",
+		},
+		{
+			name:    "empty document",
+			files:   document(`<w:p/>`),
+			wantErr: errors.New("document is empty"),
+		},
+		{
+			name:    "no document body",
+			files:   map[string]string{"xl/workbook.xml": "<workbook/>"},
+			wantErr: errors.New("not a Word document"),
+		},
+		{
+			name:    "not a zip archive",
+			data:    []byte("plain text"),
+			wantErr: errors.New("failed to open docx"),
+		},
+		{
+			name:    "decompression bomb",
+			files:   document(`<w:p><w:r><w:t>` + strings.Repeat(" ", maxDecompressedSize) + `</w:t></w:r></w:p>`),
+			wantErr: errDecompressedTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.data
+			if tt.files != nil {
+				data = docxWithFiles(t, tt.files)
+			}
+			got, err := extractDocxText(data)
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("got %q, want error %v", got, tt.wantErr)
+				}
+				if !errors.Is(err, tt.wantErr) && !strings.Contains(err.Error(), tt.wantErr.Error()) {
+					t.Errorf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		limit   int64
+		wantErr error
+	}{
+		{name: "below the limit", data: "abc", limit: 4},
+		{name: "at the limit", data: "abcd", limit: 4},
+		{name: "above the limit", data: "abcde", limit: 4, wantErr: errDecompressedTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(&limitedReader{r: strings.NewReader(tt.data), n: tt.limit})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(got) != tt.data {
+				t.Errorf("got %q, want %q", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestChunkText(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		maxChars int
+		want     []string
+	}{
+		{name: "empty", text: "", maxChars: 10, want: nil},
+		{name: "only whitespace", text: " \n\n ", maxChars: 10, want: nil},
+		{name: "fits", text: "short text", maxChars: 10, want: []string{"short text"}},
+		{name: "paragraph boundary", text: "aaaaaa\n\nbbbb", maxChars: 10, want: []string{"aaaaaa", "bbbb"}},
+		{name: "line boundary", text: "aaaaaa\nbbbbb", maxChars: 10, want: []string{"aaaaaa", "bbbbb"}},
+		{name: "early break is not used", text: "a\nbbbbbbbbbbbb", maxChars: 10, want: []string{"a\nbbbbbbbb", "bbbb"}},
+		{name: "no boundary", text: "abcdefghij", maxChars: 4, want: []string{"abcd", "efgh", "ij"}},
+		{name: "multi-byte characters", text: "ääääää", maxChars: 4, want: []string{"ääää", "ää"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chunkText(tt.text, tt.maxChars); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("chunkText(%q, %d) = %q, want %q", tt.text, tt.maxChars, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// isEditedMessage filters the edits of messages, new messages go to handleMessage
+func isEditedMessage(msg *gotgbot.Message) bool {
+	return msg.EditDate != 0
+}
+
+// editedContent returns the content of a user message after its text was edited.
+// Images and documents can't change with an edit, they are kept from the previous content.
+func editedContent(previous MessageContent, text string) MessageContent {
+	var content MessageContent
+	for _, part := range previous {
+		if part.Type == "image" || part.FileName != "" {
+			content = append(content, part)
+		}
+	}
+	if text == "" && len(previous.Documents()) > 0 {
+		text = defaultDocumentPrompt
+	}
+	return append(content, TextContent(text)...)
+}
+
+// handleEditedMessage answers an edited message again. Every conversation that answered it is
+// rewound to that turn, and the new answers are edited into the messages of the previous ones.
+func handleEditedMessage(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EditedMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+	if username == "" {
+		username = "unknown"
+	}
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	text := msg.Text
+	if text == "" {
+		text = msg.Caption
+	}
+	logMessage(userID, username, "user_message_edit", text)
+
+	// Commands are not run again when edited
+	if strings.HasPrefix(text, "/") {
+		return nil
+	}
+
+	answers, err := getPromptAnswers(context.Background(), msg.MessageId)
+	if err != nil {
+		return fmt.Errorf("failed to get answers of message %d: %w", msg.MessageId, err)
+	}
+	if len(answers) == 0 {
+		logMessage(userID, username, "debug", fmt.Sprintf("No answers to the edited message %d", msg.MessageId))
+		return nil
+	}
+
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	// Answers stop when the conversation is restarted while they are generated
+	requestCtx, done := startRequest(userID)
+	defer done()
+
+	var wg sync.WaitGroup
+	for _, answer := range answers {
+		// Syntheses and pipeline answers were made from other answers to the previous text
+		if answer.UserID != userID || answer.Request != nil {
+			continue
+		}
+
+		history, err := getConversationHistory(context.Background(), userID, answer.Thread)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to get conversation history", answer.Thread))
+			continue
+		}
+		turn := findTurn(history, answer.TurnID)
+		if turn < 0 {
+			logMessage(userID, username, "debug", fmt.Sprintf("[%s] Edited message is no longer part of the conversation", answer.Thread))
+			continue
+		}
+		content := editedContent(history[turn].Content, text)
+		if len(content) == 0 {
+			continue
+		}
+
+		// Later turns followed from the previous text, the conversation continues from the edited one.
+		// If no new answer comes, the previous turns are restored.
+		if err := saveConversationHistory(context.Background(), userID, answer.Thread, history[:turn]); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save conversation history", answer.Thread))
+			continue
+		}
+		logMessage(userID, username, "debug", fmt.Sprintf("[%s] Regenerating answer %d to the edited message", answer.Thread, answer.MessageIDs[0]))
+
+		wg.Add(1)
+		go func(answer Answer, history []Message, turn int) {
+			defer wg.Done()
+			if err := respondWithModel(requestCtx, b, msg, userID, username, userMode, answer.Thread, content, labelSlot(answer.Label), answer.MessageIDs); err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to regenerate answer: %v", answer.Thread, err))
+				restoreHistory(requestCtx, userID, username, answer.Thread, history[:turn], history)
+			}
+		}(answer, history, turn)
+	}
+	wg.Wait()
+	return nil
+}
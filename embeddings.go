@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// embeddingsBatchSize limits how many texts are embedded with a single request
+const embeddingsBatchSize = 64
+
+// EmbeddingsRequest represents the request structure of an OpenAI-compatible embeddings endpoint
+type EmbeddingsRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// EmbeddingsResponse represents the response of an OpenAI-compatible embeddings endpoint
+type EmbeddingsResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+	} `json:"usage"`
+}
+
+// createEmbeddings returns an embedding vector for every text, in the same order
+func createEmbeddings(ctx context.Context, userID int64, username string, texts []string) ([][]float32, error) {
+	if err := checkBudget(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	// Batches that were embedded before a failure are billed as well
+	tokens := 0
+	defer func() {
+		recordEmbeddingsUsage(userID, username, tokens)
+	}()
+
+	embeddings := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingsBatchSize {
+		batch := texts[start:min(start+embeddingsBatchSize, len(texts))]
+		result, batchTokens, err := createEmbeddingsBatch(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		tokens += batchTokens
+		embeddings = append(embeddings, result...)
+	}
+
+	logMessage(userID, username, "debug", fmt.Sprintf("Created %d embeddings with %s", len(embeddings), config.EmbeddingsModel))
+	return embeddings, nil
+}
+
+// createEmbeddingsBatch embeds texts with a single request, it also returns the number of tokens
+// the request used. APIs that don't report it get an estimate.
+func createEmbeddingsBatch(ctx context.Context, texts []string) ([][]float32, int, error) {
+	client := &http.Client{Timeout: 60 * time.Second}
+
+	jsonData, err := json.Marshal(EmbeddingsRequest{Model: config.EmbeddingsModel, Input: texts})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", config.EmbeddingsURL+"/embeddings", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.EmbeddingsAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+config.EmbeddingsAPIKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var embeddingsResp EmbeddingsResponse
+	if err := json.Unmarshal(body, &embeddingsResp); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(embeddingsResp.Data) != len(texts) {
+		return nil, 0, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(embeddingsResp.Data))
+	}
+
+	embeddings := make([][]float32, len(texts))
+	for _, data := range embeddingsResp.Data {
+		if data.Index < 0 || data.Index >= len(texts) {
+			return nil, 0, fmt.Errorf("embedding index %d out of range", data.Index)
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+
+	tokens := embeddingsResp.Usage.PromptTokens
+	if tokens == 0 {
+		for _, text := range texts {
+			tokens += estimateTokens(Message{Content: TextContent(text)}) - tokensPerMessage
+		}
+	}
+	return embeddings, tokens, nil
+}
+
+// recordEmbeddingsUsage adds embedded tokens to the user's cost ledger, priced with EMBEDDINGS_PRICE
+// unless the embeddings model has a configured price
+func recordEmbeddingsUsage(userID int64, username string, tokens int) {
+	if tokens == 0 {
+		return
+	}
+	// Embedding happens while answering, the ledger is written even if the request was canceled
+	ctx := context.Background()
+
+	usage := Usage{PromptTokens: tokens}
+	cost := estimateCost(config.EmbeddingsModel, usage)
+	if cost == 0 {
+		cost = float64(tokens) * config.EmbeddingsPrice / 1_000_000
+	}
+	logMessage(userID, username, "usage", fmt.Sprintf("[%s] Embedded tokens: %d, Cost: $%.6f", config.EmbeddingsModel, tokens, cost))
+
+	if err := addUsage(ctx, userID, config.EmbeddingsModel, time.Now(), 1, usage, cost); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to record usage: %v", err))
+		return
+	}
+	checkBudgetWarnings(ctx, userID, username)
+}
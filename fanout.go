@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// activeRequests holds the cancel functions of the answers being generated for each user,
+// so restarting the conversation stops them
+var (
+	activeRequestsMu sync.Mutex
+	activeRequests   = make(map[int64]map[uint64]context.CancelFunc)
+	nextRequestID    uint64
+)
+
+// startRequest returns a context shared by all answers to one user message. The returned
+// function must be called once the answers are done, it cancels the context and forgets it.
+func startRequest(userID int64) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	activeRequestsMu.Lock()
+	nextRequestID++
+	id := nextRequestID
+	if activeRequests[userID] == nil {
+		activeRequests[userID] = make(map[uint64]context.CancelFunc)
+	}
+	activeRequests[userID][id] = cancel
+	activeRequestsMu.Unlock()
+
+	return ctx, func() {
+		cancel()
+		activeRequestsMu.Lock()
+		delete(activeRequests[userID], id)
+		if len(activeRequests[userID]) == 0 {
+			delete(activeRequests, userID)
+		}
+		activeRequestsMu.Unlock()
+	}
+}
+
+// cancelRequests stops every answer being generated for the user and returns how many requests were stopped
+func cancelRequests(userID int64) int {
+	activeRequestsMu.Lock()
+	defer activeRequestsMu.Unlock()
+	for _, cancel := range activeRequests[userID] {
+		cancel()
+	}
+	return len(activeRequests[userID])
+}
+
+// fanoutSlot is the place of a model's answer in a request to several models. It makes the
+// replies appear in a fixed order, every model waits for the previous one to post its reply
+// before posting its own, and reports the model's progress on the status board.
+// All methods can be called on a nil slot, which does nothing.
+type fanoutSlot struct {
+	prev   <-chan struct{} // Closed once the previous model posted its reply, nil if there is no order
+	posted chan struct{}   // Closed once this model posted its reply
+	once   sync.Once
+	board  *statusBoard // Nil if the board couldn't be sent
+	index  int          // Entry of the model on the board
+
+	blindLabel string // Shown instead of the model name in blind mode
+	answeredBy string // Model that answered, empty if the model failed or was skipped
+	answer     string
+}
+
+// newFanoutSlots creates the slots of n models, which answer in order if ordered is set.
+// labels (optional) hide the model names.
+func newFanoutSlots(n int, ordered bool, board *statusBoard, labels []string) []*fanoutSlot {
+	slots := make([]*fanoutSlot, n)
+	var prev <-chan struct{}
+	for i := range slots {
+		slots[i] = &fanoutSlot{posted: make(chan struct{}), board: board, index: i}
+		if labels != nil {
+			slots[i].blindLabel = labels[i]
+		}
+		if ordered {
+			slots[i].prev = prev
+			prev = slots[i].posted
+		}
+	}
+	return slots
+}
+
+// labelSlot returns a slot that only keeps an answer labeled in blind mode when it is generated
+// again, nil if the answer has no label
+func labelSlot(label string) *fanoutSlot {
+	if label == "" {
+		return nil
+	}
+	return &fanoutSlot{posted: make(chan struct{}), blindLabel: label}
+}
+
+// wait blocks until the previous model posted its reply
+func (s *fanoutSlot) wait(ctx context.Context) {
+	if s == nil || s.prev == nil {
+		return
+	}
+	select {
+	case <-s.prev:
+	case <-ctx.Done():
+	}
+}
+
+// release lets the next model post its reply, it may be called more than once
+func (s *fanoutSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() { close(s.posted) })
+}
+
+// label returns the name shown instead of the model name, empty if the model name is shown
+func (s *fanoutSlot) label() string {
+	if s == nil {
+		return ""
+	}
+	return s.blindLabel
+}
+
+// thinking reports that the request was sent to the model
+func (s *fanoutSlot) thinking() {
+	if s == nil {
+		return
+	}
+	s.board.update(s.index, func(entry *boardEntry) {
+		entry.state = answerThinking
+		entry.started = time.Now()
+	})
+}
+
+// fallback reports that a fallback model answers instead
+func (s *fanoutSlot) fallback(model string) {
+	if s == nil {
+		return
+	}
+	s.board.update(s.index, func(entry *boardEntry) {
+		entry.answerBy = model
+		entry.state = answerThinking
+	})
+}
+
+// streaming reports that the answer is arriving
+func (s *fanoutSlot) streaming() {
+	if s == nil {
+		return
+	}
+	s.board.update(s.index, func(entry *boardEntry) {
+		entry.state = answerStreaming
+	})
+}
+
+// finished reports the answer with its latency and cost
+func (s *fanoutSlot) finished(resp *ChatResponse) {
+	if s == nil {
+		return
+	}
+	s.answeredBy = resp.Model
+	s.answer = resp.Content
+	s.board.update(s.index, func(entry *boardEntry) {
+		entry.answerBy = resp.Model
+		entry.state = answerDone
+		entry.latency = time.Since(entry.started)
+		entry.cost = resp.Usage.Cost
+	})
+}
+
+// failed reports why the model didn't answer
+func (s *fanoutSlot) failed(err error) {
+	if s == nil {
+		return
+	}
+	s.board.update(s.index, func(entry *boardEntry) {
+		entry.state = answerFailed
+		entry.reason = failureReason(err)
+	})
+}
+
+// skipped reports that the model wasn't asked
+func (s *fanoutSlot) skipped(reason string) {
+	if s == nil {
+		return
+	}
+	s.board.update(s.index, func(entry *boardEntry) {
+		entry.state = answerSkipped
+		entry.reason = reason
+	})
+}
+
+// answerErrorMessage is shown in place of an answer that failed
+func answerErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Sprintf("⏱ Sorry, the model didn't answer within %d seconds.", config.ModelTimeoutSecs)
+	case errors.Is(err, context.Canceled):
+		return "🚫 Canceled."
+	}
+	return userErrorMessage(err, "Sorry, I encountered an error processing your request.")
+}
+
+// failureReason describes briefly why a model failed to answer
+func failureReason(err error) string {
+	var budgetErr *BudgetExceededError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Sprintf("timed out after %d seconds", config.ModelTimeoutSecs)
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &budgetErr):
+		return "budget exceeded"
+	}
+	return "error"
+}
+
+// fanOut sends contents[i] to models[i] for every model at the same time and waits for all answers.
+// board and labels are optional. It returns the slots with the answers and the error of every model.
+func fanOut(ctx context.Context, b *gotgbot.Bot, msg *gotgbot.Message, userID int64, username string, userMode string, models []string, contents []MessageContent, board *statusBoard, labels []string) ([]*fanoutSlot, []error) {
+	slots := newFanoutSlots(len(models), config.OrderedAnswers, board, labels)
+	errs := make([]error, len(models))
+	var wg sync.WaitGroup
+	for i, model := range models {
+		wg.Add(1)
+		go func(i int, model string) {
+			defer wg.Done()
+			errs[i] = respondWithModel(ctx, b, msg, userID, username, userMode, model, contents[i], slots[i], nil)
+			if errs[i] != nil {
+				slots[i].failed(errs[i])
+			}
+		}(i, model)
+	}
+	wg.Wait()
+	return slots, errs
+}
+
+// respondWithModels sends a message to several models at the same time. Each model has its
+// own timeout, and all of them stop when ctx is canceled. The answers appear as the models
+// respond, or in the order of the models if ORDERED_ANSWERS is set, while a status board
+// shows how far every model is. Models that failed are listed on the board, or in a reply
+// once all of them are done if the board couldn't be sent. With ANSWER_VOTING the user
+// is asked which answer was best, in blind mode the models are shuffled and only labeled.
+// With a JUDGE_MODEL the answers are finally merged into one.
+func respondWithModels(ctx context.Context, b *gotgbot.Bot, msg *gotgbot.Message, userID int64, username string, userMode string, models []string, content MessageContent) error {
+	var labels []string
+	if isAnswerVotingEnabled() {
+		blind, err := isBlindVoting(ctx, userID)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to get blind voting: %v", err))
+		}
+		if blind {
+			// Labels are handed out in a random order, so they don't tell which model is which
+			models = append([]string(nil), models...)
+			rand.Shuffle(len(models), func(i, j int) { models[i], models[j] = models[j], models[i] })
+			for i := range models {
+				labels = append(labels, answerLabel(i))
+			}
+		}
+	}
+	names := models
+	if labels != nil {
+		names = labels
+	}
+
+	board, err := startStatusBoard(b, msg, models, labels)
+	if err != nil {
+		logMessage(userID, username, "error", err.Error())
+	}
+	contents := make([]MessageContent, len(models))
+	for i := range contents {
+		contents[i] = content
+	}
+	slots, errs := fanOut(ctx, b, msg, userID, username, userMode, models, contents, board, labels)
+	board.Close()
+
+	var failures []string
+	for i, err := range errs {
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("[%s] %v", models[i], err))
+			failures = append(failures, fmt.Sprintf("• %s: %s", names[i], failureReason(err)))
+		}
+	}
+	// Nothing more to do if the user restarted the conversation meanwhile
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	var answered, answeredNames, answers []string
+	for _, slot := range slots {
+		if slot.answeredBy != "" {
+			answered = append(answered, slot.answeredBy)
+			answeredNames = append(answeredNames, slot.answeredBy)
+			if labels != nil {
+				answeredNames[len(answeredNames)-1] = slot.blindLabel
+			}
+			answers = append(answers, slot.answer)
+		}
+	}
+
+	// Votes and the synthesis need at least two answers. The vote comes first,
+	// so the synthesis doesn't influence it.
+	if isAnswerVotingEnabled() && len(answered) >= 2 {
+		var answeredLabels []string
+		if labels != nil {
+			answeredLabels = answeredNames
+		}
+		if err := sendVote(ctx, b, msg, userID, content.Text(), answered, answeredLabels); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to send vote: %v", err))
+		}
+	}
+	if isSynthesisEnabled() && len(answered) >= 2 {
+		if err := synthesizeAnswers(ctx, b, msg, userID, username, content, answeredNames, answers); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to synthesize answers: %v", err))
+		}
+	}
+
+	// The board shows the failures if there is one
+	if len(failures) == 0 || board != nil {
+		return nil
+	}
+
+	text := fmt.Sprintf("⚠️ %d of %d models failed to answer:\n%s", len(failures), len(models), strings.Join(failures, "\n"))
+	_, err = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+		ReplyMarkup: getKeyboard(userMode),
+	})
+	return err
+}
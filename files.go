@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// downloadTelegramFile downloads a file that was sent to the bot. Files larger than
+// maxSize bytes are rejected.
+func downloadTelegramFile(ctx context.Context, fileID string, maxSize int64) ([]byte, error) {
+	if telegramBot == nil {
+		return nil, fmt.Errorf("bot is not initialized")
+	}
+
+	file, err := telegramBot.GetFile(fileID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file: %w", err)
+	}
+	if file.FileSize > maxSize {
+		return nil, fmt.Errorf("file is too large (%d bytes, at most %d allowed)", file.FileSize, maxSize)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", file.URL(telegramBot, nil), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// The file URL contains the bot token, keep it out of error messages
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("file download returned status %d", resp.StatusCode)
+	}
+
+	// The reported size is optional, so the limit is enforced while reading as well
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("file is too large (at most %d bytes allowed)", maxSize)
+	}
+	return data, nil
+}
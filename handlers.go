@@ -4,43 +4,12 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext"
 )
 
-// splitMessage splits a message into parts that fit within maxLength while preserving markdown
-func splitMessage(message string, maxLength int) []string {
-	if len(message) <= maxLength {
-		return []string{message}
-	}
-
-	var parts []string
-	currentPart := ""
-	lines := strings.Split(message, "\n")
-	
-	// First line contains model name in italics, handle separately
-	modelLine := lines[0]
-	currentPart = modelLine + "\n\n"
-	
-	for i := 2; i < len(lines); i++ { // Start from 2 to skip empty line after model name
-		line := lines[i]
-		if len(currentPart)+len(line)+1 > maxLength {
-			// If adding this line would exceed maxLength, start new part
-			parts = append(parts, strings.TrimSpace(currentPart))
-			currentPart = modelLine + "\n\n" + line + "\n" // Include model name in new part
-		} else {
-			currentPart += line + "\n"
-		}
-	}
-	
-	if len(currentPart) > 0 {
-		parts = append(parts, strings.TrimSpace(currentPart))
-	}
-	
-	return parts
-}
-
 func isImageGenerationEnabled() bool {
 	return config.TogetherAPIKey != ""
 }
@@ -60,6 +29,15 @@ func isUserAllowed(userID int64) bool {
 	return false
 }
 
+func isAdmin(userID int64) bool {
+	for _, adminID := range config.AdminUsers {
+		if adminID == userID {
+			return true
+		}
+	}
+	return false
+}
+
 func getKeyboard(mode string) *gotgbot.ReplyKeyboardMarkup {
 	var buttons []gotgbot.KeyboardButton
 	buttons = append(buttons, gotgbot.KeyboardButton{Text: "🔄 Restart Conversation"})
@@ -130,13 +108,36 @@ func handleMessage(b *gotgbot.Bot, ctx *ext.Context) error {
 			selectedModels = []string{config.OpenRouterModel} // fallback to default
 		}
 
-		// Clear conversation history for all models
+		// Stop answers that are still being generated, they belong to the old conversation
+		if stopped := cancelRequests(userID); stopped > 0 {
+			logMessage(userID, username, "system", fmt.Sprintf("Canceled %d running requests", stopped))
+		}
+
+		// Clear conversation history for all models, including the ones asked instead of the selected models
+		for _, info := range getAvailableModels() {
+			selectedModels = append(selectedModels, info.ID)
+		}
+		cleared := make(map[string]bool)
 		for _, model := range selectedModels {
+			if cleared[model] {
+				continue
+			}
+			cleared[model] = true
 			if err := clearConversationHistory(context.Background(), userID, model); err != nil {
 				logMessage(userID, username, "error", fmt.Sprintf("Failed to clear conversation for model %s", model))
 			}
 		}
 
+		// Syntheses, pipeline answers and debate summaries have their own conversations
+		if err := clearUserThreads(context.Background(), userID); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to clear synthesis, pipeline and debate conversations: %v", err))
+		}
+
+		// A /system override only lasts for one conversation
+		if err := rdb.Del(context.Background(), systemOverrideKey(userID)).Err(); err != nil {
+			logMessage(userID, username, "error", "Failed to clear system prompt override")
+		}
+
 		logMessage(userID, username, "system", "Conversation reset")
 		_, err = msg.Reply(b, "Conversation has been reset. Send a new message to start.", &gotgbot.SendMessageOpts{
 			ReplyMarkup: getKeyboard(userMode),
@@ -144,29 +145,63 @@ func handleMessage(b *gotgbot.Bot, ctx *ext.Context) error {
 		return err
 	}
 
+	// Text and images of the message, photos have their text in the caption
+	content := getMessageContent(msg)
+
+	// Voice messages and audio files are transcribed and then handled like text messages
+	if fileID, fileName := getAudioFile(msg); fileID != "" {
+		if !isTranscriptionEnabled() {
+			_, err := msg.Reply(b, "Sorry, voice messages are not supported.", &gotgbot.SendMessageOpts{
+				ReplyMarkup: getKeyboard(userMode),
+			})
+			return err
+		}
+
+		transcript, err := transcribeAudio(context.Background(), userID, username, fileID, fileName)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Transcription failed: %v", err))
+			_, err = msg.Reply(b, userErrorMessage(err, "Sorry, I couldn't transcribe your voice message."), &gotgbot.SendMessageOpts{
+				ReplyMarkup: getKeyboard(userMode),
+			})
+			return err
+		}
+
+		// Echo the transcript, so the user can see what the models are answering to
+		if _, err := msg.Reply(b, "🎤 "+transcript, &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		}); err != nil {
+			return err
+		}
+		content = append(content, TextContent(transcript)...)
+	}
+
 	// Log user message
-	logMessage(userID, username, "user_message", msg.Text)
+	if content.HasImages() {
+		logMessage(userID, username, "user_message", "[image] "+content.Text())
+	} else {
+		logMessage(userID, username, "user_message", content.Text())
+	}
 
 	if userMode == "image" && isImageGenerationEnabled() {
-		prompt := msg.Text
+		prompt := content.Text()
 		// If user's language is not English, translate the prompt
 		if msg.From.LanguageCode != "" && msg.From.LanguageCode != "en" {
 			// Create a translation prompt
-			translationPrompt := fmt.Sprintf("Translate the following text from %s to English, respond with only the translation without any additional text: %s", msg.From.LanguageCode, msg.Text)
+			translationPrompt := fmt.Sprintf("Translate the following text from %s to English, respond with only the translation without any additional text: %s", msg.From.LanguageCode, content.Text())
 			
-			// Call OpenRouter for translation
+			// Call the default model for translation
 			history := []Message{
-				{Role: "user", Content: translationPrompt},
+				{Role: "user", Content: TextContent(translationPrompt)},
 			}
-			translatedPrompt, err := callOpenRouter(context.Background(), userID, username, history, config.OpenRouterModel)
+			translation, err := callModel(context.Background(), userID, username, history, config.OpenRouterModel)
 			if err != nil {
 				logMessage(userID, username, "error", fmt.Sprintf("Translation failed: %v", err))
-				_, err = msg.Reply(b, "Sorry, I encountered an error translating your prompt.", &gotgbot.SendMessageOpts{
+				_, err = msg.Reply(b, userErrorMessage(err, "Sorry, I encountered an error translating your prompt."), &gotgbot.SendMessageOpts{
 					ReplyMarkup: getKeyboard(userMode),
 				})
 				return err
 			}
-			prompt = translatedPrompt
+			prompt = translation.Content
 			
 			// Inform user about translation
 			_, err = msg.Reply(b, fmt.Sprintf("Translated prompt: %s", prompt), &gotgbot.SendMessageOpts{
@@ -187,7 +222,7 @@ func handleMessage(b *gotgbot.Bot, ctx *ext.Context) error {
 		// Generate image with translated prompt
 		imageData, err := generateImage(context.Background(), userID, username, prompt, userImageModel)
 		if err != nil {
-			errMsg := "Sorry, I encountered an error generating the image."
+			errMsg := userErrorMessage(err, "Sorry, I encountered an error generating the image.")
 			if strings.Contains(err.Error(), "undefined image model configuration") {
 				errMsg = "Sorry, this image model is not properly configured. Please try a different model or contact the administrator."
 			}
@@ -217,9 +252,9 @@ func handleMessage(b *gotgbot.Bot, ctx *ext.Context) error {
 		}
 
 		// Save the image file ID with both original and translated prompts if they differ
-		promptInfo := msg.Text
-		if prompt != msg.Text {
-			promptInfo = fmt.Sprintf("%s\nTranslated to: %s", msg.Text, prompt)
+		promptInfo := content.Text()
+		if prompt != content.Text() {
+			promptInfo = fmt.Sprintf("%s\nTranslated to: %s", content.Text(), prompt)
 		}
 		if err := saveUserImage(context.Background(), userID, resp.Photo[0].FileId, promptInfo); err != nil {
 			logMessage(userID, username, "error", fmt.Sprintf("Failed to save image: %v", err))
@@ -230,6 +265,29 @@ func handleMessage(b *gotgbot.Bot, ctx *ext.Context) error {
 	// Text mode - handle normal conversation
 	logMessage(userID, username, "debug", "Starting text mode handling")
 
+	// Documents are added to the message as text, image documents were already handled as images
+	if msg.Document != nil && !content.HasImages() {
+		document, err := getDocumentContent(context.Background(), b, msg, userID, username, userMode)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to read document %s: %v", msg.Document.FileName, err))
+			_, err = msg.Reply(b, userErrorMessage(err, fmt.Sprintf("Sorry, I couldn't read %s: %v", msg.Document.FileName, err)), &gotgbot.SendMessageOpts{
+				ReplyMarkup: getKeyboard(userMode),
+			})
+			return err
+		}
+		if len(content) == 0 {
+			content = TextContent(defaultDocumentPrompt)
+		}
+		content = append(MessageContent{document}, content...)
+	}
+
+	if len(content) == 0 {
+		_, err = msg.Reply(b, "Please send a text message, a photo, a voice message or a document.", &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
 	// Get user's selected models
 	selectedModels, err := getUserModels(context.Background(), userID)
 	if err != nil {
@@ -238,6 +296,10 @@ func handleMessage(b *gotgbot.Bot, ctx *ext.Context) error {
 	}
 	logMessage(userID, username, "debug", fmt.Sprintf("Selected models: %v", selectedModels))
 
+	// Answers stop when the conversation is restarted while they are generated
+	requestCtx, done := startRequest(userID)
+	defer done()
+
 	// Check if this is a reply to a model's response
 	replyToMsg := msg.ReplyToMessage
 	var targetModel string
@@ -253,8 +315,11 @@ func handleMessage(b *gotgbot.Bot, ctx *ext.Context) error {
 				logMessage(userID, username, "debug", fmt.Sprintf("Found model %s for message %d", model, replyToMsg.MessageId))
 			}
 
-			// Verify the model is still in user's selected models
-			isValidModel := false
+			// Verify the model is still in user's selected models, or continues the synthesis, a pipeline,
+			// a debate summary or the answer of another model the user asked instead
+			isValidModel := (strings.HasPrefix(targetModel, synthesisThreadPrefix) && isSynthesisEnabled()) || strings.HasPrefix(targetModel, pipelineThreadPrefix) ||
+				strings.HasPrefix(targetModel, debateThreadPrefix) ||
+				(targetModel != "" && isModelAvailable(context.Background(), targetModel))
 			for _, model := range selectedModels {
 				if model == targetModel {
 					isValidModel = true
@@ -274,291 +339,231 @@ func handleMessage(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	// If we have a valid target model (replying to a specific model's message)
 	if targetModel != "" {
-		// Get conversation history for this model
-		history, err := getConversationHistory(context.Background(), userID, targetModel)
-		if err != nil {
-			logMessage(userID, username, "error", "Failed to get conversation history")
-			history = []Message{}
-		}
+		return respondWithModel(requestCtx, b, msg, userID, username, userMode, targetModel, content, nil, nil)
+	}
 
-		// If history is empty, add system prompt if configured
-		if len(history) == 0 && config.SystemPrompt != "" {
-			history = append(history, Message{Role: "system", Content: config.SystemPrompt})
-		}
+	// A default pipeline answers instead of the selected models
+	pipelineName, pipeline, err := getDefaultPipeline(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to get default pipeline: %v", err))
+	} else if pipeline != nil {
+		return runPipeline(requestCtx, b, msg, userID, username, userMode, pipelineName, *pipeline, content)
+	}
 
-		// Add user message to history
-		history = append(history, Message{Role: "user", Content: msg.Text})
+	// If no target model (not replying to a model's message)
+	logMessage(userID, username, "debug", "No target model, checking if this is first message")
 
-		// Call OpenRouter API with the target model
-		aiResponse, err := callOpenRouter(context.Background(), userID, username, history, targetModel)
+	// Check if any model has conversation history
+	hasHistory := false
+	for _, model := range selectedModels {
+		history, err := getConversationHistory(context.Background(), userID, model)
 		if err != nil {
-			logMessage(userID, username, "error", err.Error())
-			_, err := msg.Reply(b, "Sorry, I encountered an error processing your request.", &gotgbot.SendMessageOpts{
-				ReplyMarkup: getKeyboard(userMode),
-			})
-			return err
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to get history for model %s: %v", model, err))
+			continue
 		}
-
-		// Add AI response to history
-		history = append(history, Message{Role: "assistant", Content: aiResponse})
-
-		// Save updated conversation history
-		if err := saveConversationHistory(context.Background(), userID, targetModel, history); err != nil {
-			logMessage(userID, username, "error", "Failed to save conversation history")
+		if len(history) > 0 {
+			hasHistory = true
+			break
 		}
+	}
 
-		// Log AI response
-		logMessage(userID, username, "ai_response", fmt.Sprintf("[%s] %s", targetModel, aiResponse))
-
-		// Format response with model name in italics
-		formattedResponse := fmt.Sprintf("_%s_\n\n%s", targetModel, aiResponse)
-		
-		// Split message if it's too long (Telegram limit is 4096 characters)
-		const maxLength = 4000 // Leave some room for formatting
-		var resp *gotgbot.Message
-		
-		if len(formattedResponse) > maxLength {
-			parts := splitMessage(formattedResponse, maxLength)
-			for i, part := range parts {
-				opts := &gotgbot.SendMessageOpts{
-					ReplyMarkup: getKeyboard(userMode),
-					ParseMode:   "Markdown",
-				}
-				
-				// Only first part replies to original message
-				if i == 0 {
-					opts.ReplyParameters = &gotgbot.ReplyParameters{
-						MessageId: msg.MessageId,
-					}
-				}
-				
-				partResp, err := msg.Reply(b, part, opts)
-				if err != nil {
-					logMessage(userID, username, "error", fmt.Sprintf("Failed to send message part %d: %v", i+1, err))
-					return fmt.Errorf("failed to send message part %d: %w", i+1, err)
-				}
-				resp = partResp // Keep track of last response for message model mapping
-			}
-		} else {
-			var err error
-			resp, err = msg.Reply(b, formattedResponse, &gotgbot.SendMessageOpts{
-				ReplyMarkup: getKeyboard(userMode),
-				ParseMode:   "Markdown",
-			})
-			if err != nil {
-				logMessage(userID, username, "error", fmt.Sprintf("Failed to send message: %v", err))
-				return fmt.Errorf("failed to send message: %w", err)
-			}
-		}
+	// If there's existing conversation and multiple models are selected, ask to reply to a specific model
+	if hasHistory && len(selectedModels) > 1 {
+		logMessage(userID, username, "debug", "Multiple models with existing conversation found, requesting reply to specific model")
+		_, err = msg.Reply(b, "Please reply to a specific model's message to continue the conversation.", &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
 
-		// Save the message ID with its associated model
-		if err := saveMessageModel(context.Background(), resp.MessageId, targetModel); err != nil {
-			logMessage(userID, username, "error", "Failed to save message model mapping")
-		}
-		return nil
+	// If only one model is selected, use that model for direct messages
+	if len(selectedModels) == 1 {
+		logMessage(userID, username, "debug", fmt.Sprintf("Single model selected (%s), continuing conversation", selectedModels[0]))
+		return respondWithModel(requestCtx, b, msg, userID, username, userMode, selectedModels[0], content, nil, nil)
 	}
 
-	// If no target model (not replying to a model's message)
-	if targetModel == "" {
-		logMessage(userID, username, "debug", "No target model, checking if this is first message")
-		
-		// Check if any model has conversation history
-		hasHistory := false
-		for _, model := range selectedModels {
-			history, err := getConversationHistory(context.Background(), userID, model)
-			if err != nil {
-				logMessage(userID, username, "error", fmt.Sprintf("Failed to get history for model %s: %v", model, err))
-				continue
-			}
-			if len(history) > 0 {
-				hasHistory = true
-				break
-			}
-		}
-		
-		// If there's existing conversation and multiple models are selected, ask to reply to a specific model
-		if hasHistory && len(selectedModels) > 1 {
-			logMessage(userID, username, "debug", "Multiple models with existing conversation found, requesting reply to specific model")
-			_, err = msg.Reply(b, "Please reply to a specific model's message to continue the conversation.", &gotgbot.SendMessageOpts{
-				ReplyMarkup: getKeyboard(userMode),
-			})
-			return err
-		}
+	// This is the first message, use all selected models
+	logMessage(userID, username, "debug", "No existing conversation, using all models")
+	return respondWithModels(requestCtx, b, msg, userID, username, userMode, selectedModels, content)
+}
 
-		// If only one model is selected, use that model for direct messages
-		if len(selectedModels) == 1 {
-			model := selectedModels[0]
-			logMessage(userID, username, "debug", fmt.Sprintf("Single model selected (%s), continuing conversation", model))
-			
-			// Get conversation history for this model
-			history, err := getConversationHistory(context.Background(), userID, model)
-			if err != nil {
-				logMessage(userID, username, "error", "Failed to get conversation history")
-				history = []Message{}
-			}
+// respondWithModel sends the user message to a model together with its conversation history.
+// The answer is streamed into a reply that is edited as new chunks arrive. It has to be done within
+// the model timeout, and slot (optional) decides when the reply is posted. If the model fails,
+// the error is shown in the reply and returned. model is the conversation thread, a selected model
+// or a synthesis thread, which is continued by the judge model. replace (optional) are the messages
+// of a previous answer that are edited into the new one instead of posting a new reply.
+func respondWithModel(ctx context.Context, b *gotgbot.Bot, msg *gotgbot.Message, userID int64, username string, userMode string, model string, content MessageContent, slot *fanoutSlot, replace []int64) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(config.ModelTimeoutSecs)*time.Second)
+	defer cancel()
+	defer slot.release()
+	chatModel := threadModel(model)
+
+	// Images can only be sent to vision models, others are skipped
+	if content.HasImages() && !modelSupportsVision(chatModel) {
+		slot.skipped("can't see images")
+		slot.wait(ctx)
+		logMessage(userID, username, "debug", fmt.Sprintf("[%s] Skipped, model does not support images", model))
+		name := model
+		if slot.label() != "" {
+			name = slot.label()
+		}
+		_, err := msg.Reply(b, fmt.Sprintf("%s\n\n⚠️ This model can't see images, skipped.", name), &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
 
-			// If history is empty, add system prompt if configured
-			if len(history) == 0 && config.SystemPrompt != "" {
-				history = append(history, Message{Role: "system", Content: config.SystemPrompt})
-			}
+	// Get conversation history for this model
+	history, err := getConversationHistory(context.Background(), userID, model)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to get conversation history", model))
+		history = []Message{}
+	}
 
-			// Add user message to history
-			history = append(history, Message{Role: "user", Content: msg.Text})
+	// The system prompt isn't stored in the history, but resolved for every message,
+	// so a newly selected persona or /system override applies right away
+	history = withoutSystemPrompt(history)
+	systemPrompt, persona, err := getSystemPrompt(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to get system prompt: %v", err))
+	}
 
-			// Call OpenRouter API with this model
-			aiResponse, err := callOpenRouter(context.Background(), userID, username, history, model)
-			if err != nil {
-				logMessage(userID, username, "error", fmt.Sprintf("[%s] %s", model, err.Error()))
-				_, err := msg.Reply(b, "Sorry, I encountered an error processing your request.", &gotgbot.SendMessageOpts{
-					ReplyMarkup: getKeyboard(userMode),
-				})
-				return err
-			}
+	// Add user message to history, its ID lets the buttons below the answer find this turn
+	turnID := newMessageID()
+	history = append(history, Message{ID: turnID, Role: "user", Content: content})
 
-			// Add AI response to history
-			history = append(history, Message{Role: "assistant", Content: aiResponse})
+	// Show the documents the message is about in the reply header
+	var notes []string
+	if strings.HasPrefix(model, synthesisThreadPrefix) {
+		notes = append(notes, "⚖️ Continuing the synthesis")
+	} else if strings.HasPrefix(model, pipelineThreadPrefix) {
+		notes = append(notes, "🔗 Continuing the pipeline answer")
+	} else if strings.HasPrefix(model, debateThreadPrefix) {
+		notes = append(notes, "🗣 Continuing the debate summary")
+	}
+	for _, document := range content.Documents() {
+		notes = append(notes, fmt.Sprintf("📄 %s (%s)", document.FileName, formatFileSize(document.FileSize)))
+	}
 
-			// Save updated conversation history
-			if err := saveConversationHistory(context.Background(), userID, model, history); err != nil {
-				logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save conversation history", model))
-			}
+	// Relevant parts of the user's knowledge base are sent with the message, but not saved
+	// in the history, so the history doesn't grow with every retrieval
+	knowledge, sources := getKnowledgeContext(ctx, userID, username, content.Text())
+	if sources != "" {
+		notes = append(notes, sources)
+	}
+	var request []Message
+	if systemPrompt != "" {
+		request = append(request, Message{Role: "system", Content: TextContent(systemPrompt)})
+	}
+	request = append(request, history[:len(history)-1]...)
+	if knowledge != nil {
+		// The excerpts go right before the user message
+		request = append(request, *knowledge)
+	}
+	request = append(request, history[len(history)-1])
+	sent := len(request)
 
-			// Log AI response
-			logMessage(userID, username, "ai_response", fmt.Sprintf("[%s] %s", model, aiResponse))
+	// Send a placeholder right away so the user sees that the model is working
+	slot.wait(ctx)
+	var reply *streamingReply
+	if len(replace) > 0 {
+		reply, err = replaceStreamingReply(b, msg.Chat.Id, replace, chatModel, slot.label(), persona, notes)
+	} else {
+		reply, err = startStreamingReply(b, msg, chatModel, slot.label(), persona, notes)
+	}
+	slot.release()
+	if err != nil {
+		return err
+	}
+	slot.thinking()
 
-			// Format response with model name in italics
-			formattedResponse := fmt.Sprintf("_%s_\n\n%s", model, aiResponse)
-			
-			// Split message if it's too long
-			const maxLength = 4000 // Leave some room for formatting
-			var resp *gotgbot.Message
-			
-			if len(formattedResponse) > maxLength {
-				parts := splitMessage(formattedResponse, maxLength)
-				for i, part := range parts {
-					opts := &gotgbot.SendMessageOpts{
-						ReplyMarkup: getKeyboard(userMode),
-						ParseMode:   "Markdown",
-					}
-					
-					// Only first part replies to original message
-					if i == 0 {
-						opts.ReplyParameters = &gotgbot.ReplyParameters{
-							MessageId: msg.MessageId,
-						}
-					}
-					
-					partResp, err := msg.Reply(b, part, opts)
-					if err != nil {
-						logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to send message part %d: %v", model, i+1, err))
-						continue
-					}
-					resp = partResp // Keep track of last response for message model mapping
-				}
-			} else {
-				var err error
-				resp, err = msg.Reply(b, formattedResponse, &gotgbot.SendMessageOpts{
-					ReplyMarkup: getKeyboard(userMode),
-					ParseMode:   "Markdown",
-				})
-				if err != nil {
-					logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to send response: %v", model, err))
-					return err
-				}
-			}
+	// The status board follows the reply, if there is one
+	onFallback := func(fallback string) {
+		reply.SetModel(fallback)
+		slot.fallback(fallback)
+	}
+	onDelta := func(text string) {
+		slot.streaming()
+		reply.Update(text)
+	}
 
-			// Save the message ID with its associated model
-			if err := saveMessageModel(context.Background(), resp.MessageId, model); err != nil {
-				logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save message model mapping", model))
-			}
-			return nil
+	// Call the model with streaming, updating the reply as chunks arrive
+	// If the model fails, a fallback model may answer instead. Tool calls and their
+	// results are added to the history and shown above the answer.
+	aiResponse, request, err := chatWithTools(ctx, userID, username, request, chatModel, onFallback, onDelta, reply.AddTrace)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] %s", model, err.Error()))
+		// A timeout or cancellation is reported as such, not as the error it caused
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
 		}
+		reply.Fail(answerErrorMessage(err))
+		return fmt.Errorf("model %s failed: %w", model, err)
+	}
 
-		// This is the first message, use all selected models
-		logMessage(userID, username, "debug", "No existing conversation, using all models")
-		for _, model := range selectedModels {
-			// Get conversation history for this model
-			history, err := getConversationHistory(context.Background(), userID, model)
-			if err != nil {
-				logMessage(userID, username, "error", "Failed to get conversation history")
-				history = []Message{}
-			}
+	slot.finished(aiResponse)
 
-			// If history is empty, add system prompt if configured
-			if len(history) == 0 && config.SystemPrompt != "" {
-				history = append(history, Message{Role: "system", Content: config.SystemPrompt})
-			}
+	// Keep the tool calls in the history, but not the system prompt and knowledge base excerpts
+	history = append(history, request[sent:]...)
 
-			// Add user message to history
-			history = append(history, Message{Role: "user", Content: msg.Text})
+	// Add AI response to history. The conversation stays under the requested model's key,
+	// so replies continue the same thread, but the message records which model answered.
+	history = append(history, Message{Role: "assistant", Content: TextContent(aiResponse.Content), Model: aiResponse.Model})
 
-			// Call OpenRouter API with this model
-			aiResponse, err := callOpenRouter(context.Background(), userID, username, history, model)
-			if err != nil {
-				logMessage(userID, username, "error", fmt.Sprintf("[%s] %s", model, err.Error()))
-				continue // Try next model instead of failing completely
-			}
+	// Save updated conversation history
+	if err := saveConversationHistory(context.Background(), userID, model, history); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save conversation history", model))
+	}
 
-			// Add AI response to history
-			history = append(history, Message{Role: "assistant", Content: aiResponse})
+	// Log AI response
+	if aiResponse.Model != model {
+		logMessage(userID, username, "ai_response", fmt.Sprintf("[%s via %s] %s", model, aiResponse.Model, aiResponse.Content))
+	} else {
+		logMessage(userID, username, "ai_response", fmt.Sprintf("[%s] %s", model, aiResponse.Content))
+	}
 
-			// Save updated conversation history
-			if err := saveConversationHistory(context.Background(), userID, model, history); err != nil {
-				logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save conversation history", model))
-			}
+	// The reasoning of thinking models is kept out of the history and shown on demand
+	answer := Answer{
+		UserID:    userID,
+		Thread:    model,
+		TurnID:    turnID,
+		PromptID:  msg.MessageId,
+		Label:     slot.label(),
+		Truncated: aiResponse.FinishReason == "length",
+	}
+	if aiResponse.Reasoning != "" {
+		if err := saveReasoning(context.Background(), reply.MessageID(), aiResponse.Reasoning); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save reasoning: %v", model, err))
+		} else {
+			answer.Reasoning = true
+		}
+	}
 
-			// Log AI response
-			logMessage(userID, username, "ai_response", fmt.Sprintf("[%s] %s", model, aiResponse))
+	// Replace the streamed text with the final formatted answer. The buttons below it
+	// regenerate, continue or re-ask it.
+	messageIDs, err := reply.Finish(aiResponse.Content, answerButtons(reply.MessageID(), answer))
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] %v", model, err))
+	}
 
-			// Format response with model name in italics
-			formattedResponse := fmt.Sprintf("_%s_\n\n%s", model, aiResponse)
-			
-			// Split message if it's too long
-			const maxLength = 4000 // Leave some room for formatting
-			var resp *gotgbot.Message
-			
-			if len(formattedResponse) > maxLength {
-				parts := splitMessage(formattedResponse, maxLength)
-				for i, part := range parts {
-					opts := &gotgbot.SendMessageOpts{
-						ReplyMarkup: getKeyboard(userMode),
-						ParseMode:   "Markdown",
-					}
-					
-					// Only first part replies to original message
-					if i == 0 {
-						opts.ReplyParameters = &gotgbot.ReplyParameters{
-							MessageId: msg.MessageId,
-						}
-					}
-					
-					partResp, err := msg.Reply(b, part, opts)
-					if err != nil {
-						logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to send message part %d: %v", model, i+1, err))
-						continue
-					}
-					resp = partResp // Keep track of last response for message model mapping
-				}
-			} else {
-				var err error
-				resp, err = msg.Reply(b, formattedResponse, &gotgbot.SendMessageOpts{
-					ReplyMarkup: getKeyboard(userMode),
-					ParseMode:   "Markdown",
-				})
-				if err != nil {
-					logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to send response: %v", model, err))
-					continue
-				}
-			}
+	// The answer is saved with its messages, so the buttons and edits of the user message can replace it
+	answer.MessageIDs = messageIDs
+	if err := saveAnswer(context.Background(), answer); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save answer: %v", model, err))
+	}
 
-			// Save the message ID with its associated model
-			if err := saveMessageModel(context.Background(), resp.MessageId, model); err != nil {
-				logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save message model mapping", model))
-			}
+	// Save every message ID of the answer with its associated model, so replying to any part works
+	for _, messageID := range messageIDs {
+		if err := saveMessageModel(context.Background(), messageID, model); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save message model mapping", model))
 		}
-		return nil
 	}
-	return nil
+
+	// Condense old turns once the conversation gets long. The summary model is called in the
+	// background, so other answers of a fan-out and the synthesis don't wait for it.
+	go compactConversation(context.Background(), userID, username, model, append([]Message(nil), history...))
+	return err
 }
 
 func handleStart(b *gotgbot.Bot, ctx *ext.Context) error {
@@ -606,13 +611,38 @@ func handleHelp(b *gotgbot.Bot, ctx *ext.Context) error {
 	helpText := "Available commands:\n" +
 		"/start - Start the bot\n" +
 		"/help - Show this help message\n" +
-		"/set_models - Select AI models for text chat (you can select multiple)\n"
+		"/set_models - Select AI models for text chat (you can select multiple)\n" +
+		"/usage - Show your token usage and costs\n" +
+		"/budget - Show your spending budgets\n" +
+		"/summary - Show the summary of older messages, /summary refresh to update it\n" +
+		"/persona - Create and select personas\n" +
+		"/system - Override the system prompt for this conversation\n" +
+		"/settings - Change temperature, answer length and other generation settings\n" +
+		"/debate - Let your selected models debate a question, e.g. /debate 3 Tabs or spaces?\n" +
+		"/pipeline - Chain models, e.g. draft → critique → revise\n" +
+		"/run - Run a pipeline: /run <pipeline> <input>\n"
+
+	if isKnowledgeBaseEnabled() {
+		helpText += "/kb - Manage your knowledge base\n"
+	}
+
+	if isModelCatalogEnabled() {
+		helpText += "/catalog - Browse and search all models\n"
+	}
+
+	if isAnswerVotingEnabled() {
+		helpText += "/leaderboard - Show which models won the most votes, /leaderboard blind on to hide model names until you vote\n"
+	}
 
 	if isImageGenerationEnabled() {
 		helpText += "/set_image_models - Select AI model for image generation\n" +
 			"/my_images - Show your generated images\n"
 	}
 
+	if isAdmin(userID) {
+		helpText += "/models_refresh - Refresh model prices from OpenRouter (admin)\n"
+	}
+
 	helpText += "\nUse \"🔄 Restart Conversation\" to start a new conversation."
 	if isImageGenerationEnabled() {
 		helpText += "\nUse mode buttons to switch between text and image generation."
@@ -657,7 +687,7 @@ func handleSetModels(b *gotgbot.Bot, ctx *ext.Context) error {
 
 	// Create inline keyboard with model options including pricing
 	var buttons [][]gotgbot.InlineKeyboardButton
-	for _, modelInfo := range config.AvailableModels {
+	for _, modelInfo := range getAvailableModels() {
 		// Add checkmark and pricing for current model
 		modelText := modelInfo.ID
 		if modelInfo.PriceIn > 0 || modelInfo.PriceOut > 0 {
@@ -672,6 +702,13 @@ func handleSetModels(b *gotgbot.Bot, ctx *ext.Context) error {
 		})
 	}
 
+	// Models outside of AVAILABLE_MODELS can be picked from the catalog
+	if isModelCatalogEnabled() {
+		buttons = append(buttons, []gotgbot.InlineKeyboardButton{
+			{Text: "📚 Browse all models", CallbackData: "cat:p:0"},
+		})
+	}
+
 	// Add a "Done" button at the bottom
 	buttons = append(buttons, []gotgbot.InlineKeyboardButton{
 		{Text: "✨ Done", CallbackData: "models:done"},
@@ -743,7 +780,19 @@ func handleCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 	}
 
 	data := callback.Data
-	if len(data) > 10 && data[:10] == "img_model:" {
+	if strings.HasPrefix(data, "settings:") {
+		return handleSettingsCallback(b, callback, userID, username, strings.TrimPrefix(data, "settings:"))
+	} else if strings.HasPrefix(data, "reasoning:") {
+		return handleReasoningCallback(b, callback, userID, username, strings.TrimPrefix(data, "reasoning:"))
+	} else if strings.HasPrefix(data, "cat:") {
+		return handleCatalogCallback(b, callback, userID, username, strings.TrimPrefix(data, "cat:"))
+	} else if strings.HasPrefix(data, "vote:") {
+		return handleVoteCallback(b, callback, userID, username, strings.TrimPrefix(data, "vote:"))
+	} else if strings.HasPrefix(data, "debate:") {
+		return handleDebateCallback(b, callback, userID, username, strings.TrimPrefix(data, "debate:"))
+	} else if strings.HasPrefix(data, "answer:") {
+		return handleAnswerCallback(b, callback, userID, username, strings.TrimPrefix(data, "answer:"))
+	} else if len(data) > 10 && data[:10] == "img_model:" {
 		selectedModel := data[10:]
 
 		// Save user's image model preference
@@ -821,7 +870,7 @@ func handleCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 
 		// Update the message with new selection state
 		var buttons [][]gotgbot.InlineKeyboardButton
-		for _, modelInfo := range config.AvailableModels {
+		for _, modelInfo := range getAvailableModels() {
 			modelText := modelInfo.ID
 			if modelInfo.PriceIn > 0 || modelInfo.PriceOut > 0 {
 				modelText = fmt.Sprintf("%s (In: $%.2f, Out: $%.2f per 1M tokens)", 
@@ -835,6 +884,12 @@ func handleCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 			})
 		}
 
+		if isModelCatalogEnabled() {
+			buttons = append(buttons, []gotgbot.InlineKeyboardButton{
+				{Text: "📚 Browse all models", CallbackData: "cat:p:0"},
+			})
+		}
+
 		// Add "Done" button
 		buttons = append(buttons, []gotgbot.InlineKeyboardButton{
 			{Text: "✨ Done", CallbackData: "models:done"},
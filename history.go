@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// tokensPerImage is a rough average of what vision models charge for an image
+const tokensPerImage = 1000
+
+// tokensPerMessage covers the role and formatting tokens every message costs
+const tokensPerMessage = 4
+
+// estimateTokens estimates the number of tokens of a message. English text averages about
+// four characters per token, which is close enough to stay below the context length
+// without shipping every model's tokenizer.
+func estimateTokens(msg Message) int {
+	tokens := tokensPerMessage
+	for _, part := range msg.Content {
+		if part.Type == "image" {
+			tokens += tokensPerImage
+		} else {
+			tokens += (utf8.RuneCountInString(part.Text) + 3) / 4
+		}
+	}
+	for _, call := range msg.ToolCalls {
+		tokens += (len(call.Function.Name) + len(call.Function.Arguments) + 3) / 4
+	}
+	return tokens
+}
+
+// getContextTokens returns how many tokens of history can be sent to a model, leaving
+// room for the answer and some slack for the estimate
+func getContextTokens(model string) int {
+	contextLength := config.DefaultContextLen
+	if info, ok := findModelInfo(model); ok && info.ContextLength > 0 {
+		contextLength = info.ContextLength
+	}
+
+	tokens := contextLength - maxResponseTokens
+	if tokens < contextLength/2 {
+		tokens = contextLength / 2
+	}
+	tokens = tokens * 9 / 10
+	if config.MaxContextTokens > 0 && tokens > config.MaxContextTokens {
+		tokens = config.MaxContextTokens
+	}
+	return tokens
+}
+
+// trimHistory drops the oldest turns of a conversation until it fits the model's context.
+// System messages (the system prompt, summaries, knowledge base excerpts) and the latest
+// turn are always kept. A turn is a user message with everything that answers it.
+func trimHistory(userID int64, username string, messages []Message, model string) []Message {
+	budget := getContextTokens(model)
+
+	total := 0
+	for _, msg := range messages {
+		total += estimateTokens(msg)
+	}
+	if total <= budget {
+		return messages
+	}
+
+	// Find the start of every turn, the last one is never dropped
+	var turnStarts []int
+	for i, msg := range messages {
+		if msg.Role == "user" {
+			turnStarts = append(turnStarts, i)
+		}
+	}
+	if len(turnStarts) < 2 {
+		return messages
+	}
+
+	// Drop whole turns from the oldest on, everything before the first turn is kept
+	drop := make([]bool, len(messages))
+	for t := 0; t < len(turnStarts)-1 && total > budget; t++ {
+		for i := turnStarts[t]; i < turnStarts[t+1]; i++ {
+			if messages[i].Role != "system" {
+				drop[i] = true
+				total -= estimateTokens(messages[i])
+			}
+		}
+	}
+
+	trimmed := make([]Message, 0, len(messages))
+	for i, msg := range messages {
+		if !drop[i] {
+			trimmed = append(trimmed, msg)
+		}
+	}
+
+	logMessage(userID, username, "debug", fmt.Sprintf("[%s] Trimmed history from %d to %d messages (about %d of %d tokens)",
+		model, len(messages), len(trimmed), total, budget))
+	return trimmed
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want int
+	}{
+		{name: "empty", msg: Message{Role: "user"}, want: tokensPerMessage},
+		{name: "four characters", msg: Message{Role: "user", Content: TextContent("abcd")}, want: tokensPerMessage + 1},
+		{name: "rounds up", msg: Message{Role: "user", Content: TextContent("abcde")}, want: tokensPerMessage + 2},
+		{name: "counts characters, not bytes", msg: Message{Role: "user", Content: TextContent("ääää")}, want: tokensPerMessage + 1},
+		{
+			name: "image",
+			msg:  Message{Role: "user", Content: append(TextContent("abcd"), ContentPart{Type: "image"})},
+			want: tokensPerMessage + 1 + tokensPerImage,
+		},
+		{
+			name: "tool call",
+			msg: Message{Role: "assistant", ToolCalls: []ToolCall{
+				{Function: ToolCallFunction{Name: "get", Arguments: "{}"}},
+			}},
+			want: tokensPerMessage + 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateTokens(tt.msg); got != tt.want {
+				t.Errorf("estimateTokens() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	previous := config
+	t.Cleanup(func() { config = previous })
+	config = Config{DefaultContextLen: 100000, MaxContextTokens: 100}
+
+	// Every message is about 14 tokens, a long one about 104
+	message := func(id string, role string) Message {
+		return Message{ID: id, Role: role, Content: TextContent(strings.Repeat("x", 40))}
+	}
+	long := func(id string, role string) Message {
+		return Message{ID: id, Role: role, Content: TextContent(strings.Repeat("x", 400))}
+	}
+
+	tests := []struct {
+		name     string
+		messages []Message
+		want     []string
+	}{
+		{
+			name:     "fits",
+			messages: []Message{message("s", "system"), message("u1", "user"), message("a1", "assistant")},
+			want:     []string{"s", "u1", "a1"},
+		},
+		{
+			name: "drops the oldest turns",
+			messages: []Message{
+				message("s", "system"),
+				message("u1", "user"), message("a1", "assistant"),
+				message("u2", "user"), message("a2", "assistant"),
+				message("u3", "user"), message("a3", "assistant"),
+				message("u4", "user"), message("a4", "assistant"),
+			},
+			want: []string{"s", "u2", "a2", "u3", "a3", "u4", "a4"},
+		},
+		{
+			name: "drops tool calls with their turn",
+			messages: []Message{
+				message("u1", "user"), message("c1", "assistant"), message("r1", "tool"), message("a1", "assistant"),
+				message("u2", "user"), message("a2", "assistant"),
+				message("u3", "user"), message("a3", "assistant"),
+				message("u4", "user"), message("a4", "assistant"),
+			},
+			want: []string{"u2", "a2", "u3", "a3", "u4", "a4"},
+		},
+		{
+			name: "keeps system messages of dropped turns",
+			messages: []Message{
+				message("u1", "user"), message("k1", "system"), message("a1", "assistant"),
+				message("u2", "user"), message("a2", "assistant"),
+				message("u3", "user"), message("a3", "assistant"),
+				message("u4", "user"), message("a4", "assistant"),
+			},
+			want: []string{"k1", "u2", "a2", "u3", "a3", "u4", "a4"},
+		},
+		{
+			name:     "keeps the latest turn",
+			messages: []Message{message("u1", "user"), message("a1", "assistant"), long("u2", "user")},
+			want:     []string{"u2"},
+		},
+		{
+			name:     "a single turn is kept",
+			messages: []Message{long("u1", "user"), message("a1", "assistant")},
+			want:     []string{"u1", "a1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, msg := range trimHistory(0, "test", tt.messages, "test/model") {
+				got = append(got, msg.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("trimHistory() kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/go-redis/redis/v8"
+)
+
+// kbIndexName is the RediSearch index over the chunks of all knowledge bases
+const kbIndexName = "idx:kb"
+
+// kbChunkPrefix is the key prefix of chunk hashes, the index covers all keys with it
+const kbChunkPrefix = "kb:chunk:"
+
+// maxKBChunks limits how many chunks a single knowledge base document may have
+const maxKBChunks = 500
+
+// KBDocument is a document in a user's knowledge base
+type KBDocument struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Chunks    int       `json:"chunks"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// KBResult is a chunk found by a knowledge base search
+type KBResult struct {
+	DocumentID   string
+	DocumentName string
+	Chunk        int
+	Text         string
+	Score        float64 // Cosine similarity to the query, higher is more relevant
+}
+
+// kbIndex remembers whether the RediSearch index can be used. Redis servers without
+// the RediSearch module are searched by comparing the query with every chunk instead.
+var kbIndex struct {
+	sync.Mutex
+	checked   bool
+	available bool
+}
+
+// isKnowledgeBaseEnabled checks if an embeddings API is configured
+func isKnowledgeBaseEnabled() bool {
+	return config.EmbeddingsURL != ""
+}
+
+func kbDocumentsKey(userID int64) string {
+	return fmt.Sprintf("kb:%d:docs", userID)
+}
+
+func kbChunkKey(userID int64, documentID string, chunk int) string {
+	return fmt.Sprintf("%s%d:%s:%d", kbChunkPrefix, userID, documentID, chunk)
+}
+
+// ensureKBIndex reports whether vector search through RediSearch is available. The index is
+// created with the first document, since the vector dimension is only known then (dim > 0).
+func ensureKBIndex(ctx context.Context, dim int) bool {
+	kbIndex.Lock()
+	defer kbIndex.Unlock()
+	if kbIndex.checked {
+		return kbIndex.available
+	}
+
+	err := rdb.Do(ctx, "FT.INFO", kbIndexName).Err()
+	switch {
+	case err == nil:
+		kbIndex.checked, kbIndex.available = true, true
+	case strings.Contains(strings.ToLower(err.Error()), "unknown command"):
+		log.Printf("[Info] RediSearch is not available, knowledge base search compares every chunk")
+		kbIndex.checked = true
+	case dim > 0:
+		err = rdb.Do(ctx, "FT.CREATE", kbIndexName, "ON", "HASH", "PREFIX", "1", kbChunkPrefix,
+			"SCHEMA", "user", "TAG", "embedding", "VECTOR", "HNSW", "6",
+			"TYPE", "FLOAT32", "DIM", dim, "DISTANCE_METRIC", "COSINE").Err()
+		if err != nil {
+			log.Printf("[Warning] Failed to create knowledge base index: %v", err)
+		}
+		kbIndex.checked, kbIndex.available = true, err == nil
+	}
+	return kbIndex.available
+}
+
+// getKBDocuments returns the documents in a user's knowledge base, oldest first
+func getKBDocuments(ctx context.Context, userID int64) ([]KBDocument, error) {
+	values, err := rdb.HVals(ctx, kbDocumentsKey(userID)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis get error: %w", err)
+	}
+
+	documents := make([]KBDocument, 0, len(values))
+	for _, value := range values {
+		var document KBDocument
+		if err := json.Unmarshal([]byte(value), &document); err != nil {
+			return nil, fmt.Errorf("json unmarshal error: %w", err)
+		}
+		documents = append(documents, document)
+	}
+	sort.Slice(documents, func(i, j int) bool {
+		return documents[i].CreatedAt.Before(documents[j].CreatedAt)
+	})
+	return documents, nil
+}
+
+// addKBDocument splits text into chunks, embeds them and stores them in the user's knowledge base
+func addKBDocument(ctx context.Context, userID int64, username string, name string, size int64, text string) (*KBDocument, error) {
+	chunks := chunkText(text, config.KBChunkChars)
+	if len(chunks) == 0 {
+		return nil, fmt.Errorf("document is empty")
+	}
+	if len(chunks) > maxKBChunks {
+		return nil, fmt.Errorf("document is too long for the knowledge base (%d parts, at most %d allowed)", len(chunks), maxKBChunks)
+	}
+
+	embeddings, err := createEmbeddings(ctx, userID, username, chunks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embeddings: %w", err)
+	}
+
+	id, err := rdb.Incr(ctx, fmt.Sprintf("kb:%d:next_id", userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis incr error: %w", err)
+	}
+	document := KBDocument{
+		ID:        strconv.FormatInt(id, 10),
+		Name:      name,
+		Size:      size,
+		Chunks:    len(chunks),
+		CreatedAt: time.Now(),
+	}
+	data, err := json.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("json marshal error: %w", err)
+	}
+
+	ensureKBIndex(ctx, len(embeddings[0]))
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, chunk := range chunks {
+			pipe.HSet(ctx, kbChunkKey(userID, document.ID, i), map[string]interface{}{
+				"user":      userID,
+				"doc_id":    document.ID,
+				"doc_name":  name,
+				"chunk":     i,
+				"text":      chunk,
+				"embedding": encodeVector(embeddings[i]),
+			})
+		}
+		pipe.HSet(ctx, kbDocumentsKey(userID), document.ID, string(data))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis set error: %w", err)
+	}
+
+	logMessage(userID, username, "kb", fmt.Sprintf("Added document #%s %s with %d chunks", document.ID, name, len(chunks)))
+	return &document, nil
+}
+
+// deleteKBDocument removes a document and its chunks, it returns false if there is no such document
+func deleteKBDocument(ctx context.Context, userID int64, documentID string) (bool, error) {
+	data, err := rdb.HGet(ctx, kbDocumentsKey(userID), documentID).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("redis get error: %w", err)
+	}
+
+	var document KBDocument
+	if err := json.Unmarshal([]byte(data), &document); err != nil {
+		return false, fmt.Errorf("json unmarshal error: %w", err)
+	}
+
+	keys := make([]string, 0, document.Chunks)
+	for i := 0; i < document.Chunks; i++ {
+		keys = append(keys, kbChunkKey(userID, documentID, i))
+	}
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if len(keys) > 0 {
+			pipe.Del(ctx, keys...)
+		}
+		pipe.HDel(ctx, kbDocumentsKey(userID), documentID)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("redis delete error: %w", err)
+	}
+	return true, nil
+}
+
+// searchKnowledgeBase returns the k chunks of the user's knowledge base most similar to query
+func searchKnowledgeBase(ctx context.Context, userID int64, username string, query string, k int) ([]KBResult, error) {
+	documents, err := getKBDocuments(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(documents) == 0 {
+		return nil, nil
+	}
+
+	embeddings, err := createEmbeddings(ctx, userID, username, []string{query})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+
+	if ensureKBIndex(ctx, 0) {
+		results, err := vectorSearchKB(ctx, userID, embeddings[0], k)
+		if err == nil {
+			return results, nil
+		}
+		logMessage(userID, username, "error", fmt.Sprintf("Vector search failed, comparing every chunk instead: %v", err))
+	}
+	return bruteForceSearchKB(ctx, userID, documents, embeddings[0], k)
+}
+
+// vectorSearchKB finds the nearest chunks with a RediSearch KNN query
+func vectorSearchKB(ctx context.Context, userID int64, vector []float32, k int) ([]KBResult, error) {
+	query := fmt.Sprintf("(@user:{%d})=>[KNN %d @embedding $vec AS score]", userID, k)
+	res, err := rdb.Do(ctx, "FT.SEARCH", kbIndexName, query,
+		"PARAMS", "2", "vec", encodeVector(vector),
+		"SORTBY", "score",
+		"RETURN", "5", "doc_id", "doc_name", "chunk", "text", "score",
+		"LIMIT", "0", k,
+		"DIALECT", "2").Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis search error: %w", err)
+	}
+
+	// The reply is the number of results followed by key and field list pairs
+	rows, ok := res.([]interface{})
+	if !ok || len(rows) == 0 {
+		return nil, fmt.Errorf("unexpected search reply: %v", res)
+	}
+
+	var results []KBResult
+	for i := 1; i+1 < len(rows); i += 2 {
+		fields, ok := rows[i+1].([]interface{})
+		if !ok {
+			continue
+		}
+		values := make(map[string]string)
+		for j := 0; j+1 < len(fields); j += 2 {
+			values[fmt.Sprint(fields[j])] = fmt.Sprint(fields[j+1])
+		}
+
+		// The score is the cosine distance
+		distance, _ := strconv.ParseFloat(values["score"], 64)
+		chunk, _ := strconv.Atoi(values["chunk"])
+		results = append(results, KBResult{
+			DocumentID:   values["doc_id"],
+			DocumentName: values["doc_name"],
+			Chunk:        chunk,
+			Text:         values["text"],
+			Score:        1 - distance,
+		})
+	}
+	return results, nil
+}
+
+// bruteForceSearchKB compares the query with every chunk of the user's documents
+func bruteForceSearchKB(ctx context.Context, userID int64, documents []KBDocument, vector []float32, k int) ([]KBResult, error) {
+	pipe := rdb.Pipeline()
+	var cmds []*redis.SliceCmd
+	for _, document := range documents {
+		for i := 0; i < document.Chunks; i++ {
+			cmds = append(cmds, pipe.HMGet(ctx, kbChunkKey(userID, document.ID, i), "doc_id", "doc_name", "chunk", "text", "embedding"))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis get error: %w", err)
+	}
+
+	var results []KBResult
+	for _, cmd := range cmds {
+		values := cmd.Val()
+		if len(values) != 5 || values[4] == nil {
+			continue
+		}
+		embedding, _ := values[4].(string)
+		chunk, _ := strconv.Atoi(fmt.Sprint(values[2]))
+		results = append(results, KBResult{
+			DocumentID:   fmt.Sprint(values[0]),
+			DocumentName: fmt.Sprint(values[1]),
+			Chunk:        chunk,
+			Text:         fmt.Sprint(values[3]),
+			Score:        cosineSimilarity(vector, decodeVector([]byte(embedding))),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+// getKnowledgeContext searches the user's knowledge base for query and returns a system message
+// with the relevant excerpts, numbered for citations, and a note listing the sources.
+// It returns nil if the knowledge base is disabled or empty.
+func getKnowledgeContext(ctx context.Context, userID int64, username string, query string) (*Message, string) {
+	if !isKnowledgeBaseEnabled() || strings.TrimSpace(query) == "" {
+		return nil, ""
+	}
+
+	results, err := searchKnowledgeBase(ctx, userID, username, query, config.KBTopK)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Knowledge base search failed: %v", err))
+		return nil, ""
+	}
+	if len(results) == 0 {
+		return nil, ""
+	}
+
+	text := "Excerpts from the user's knowledge base that may be relevant to the next message. " +
+		"Use them if they help to answer and cite them by number like [1]. Ignore them if they are not relevant."
+	var sources []string
+	for i, result := range results {
+		text += fmt.Sprintf("\n\n[%d] %s, part %d:\n%s", i+1, result.DocumentName, result.Chunk+1, result.Text)
+		sources = append(sources, fmt.Sprintf("[%d] %s", i+1, result.DocumentName))
+	}
+
+	logMessage(userID, username, "kb", fmt.Sprintf("Retrieved %d chunks: %s", len(results), strings.Join(sources, ", ")))
+	return &Message{Role: "system", Content: TextContent(text)}, "📚 " + strings.Join(sources, ", ")
+}
+
+// encodeVector stores a vector as little-endian float32 values, the format RediSearch expects
+func encodeVector(vector []float32) []byte {
+	data := make([]byte, 4*len(vector))
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(value))
+	}
+	return data
+}
+
+func decodeVector(data []byte) []float32 {
+	vector := make([]float32, len(data)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return vector
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+func handleKB(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	// The command can also be the caption of a document
+	text := msg.Text
+	if text == "" {
+		text = msg.Caption
+	}
+
+	logMessage(userID, username, "command", text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	reply := func(text string) error {
+		_, err := msg.Reply(b, text, &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	if !isKnowledgeBaseEnabled() {
+		return reply("The knowledge base is not enabled.")
+	}
+
+	args := strings.Fields(text)[1:]
+	subcommand := ""
+	if len(args) > 0 {
+		subcommand = args[0]
+		args = args[1:]
+	}
+
+	switch subcommand {
+	case "add":
+		return reply(addKBFromMessage(context.Background(), msg, userID, username, strings.Join(args, " ")))
+
+	case "delete":
+		if len(args) != 1 {
+			return reply("Usage: /kb delete <id>")
+		}
+		documentID := strings.TrimPrefix(args[0], "#")
+		deleted, err := deleteKBDocument(context.Background(), userID, documentID)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to delete document %s: %v", documentID, err))
+			return reply("Sorry, I encountered an error deleting the document.")
+		}
+		if !deleted {
+			return reply(fmt.Sprintf("There is no document #%s in your knowledge base.", documentID))
+		}
+		logMessage(userID, username, "kb", fmt.Sprintf("Deleted document #%s", documentID))
+		return reply(fmt.Sprintf("🗑 Deleted document #%s.", documentID))
+
+	case "search":
+		if len(args) == 0 {
+			return reply("Usage: /kb search <query>")
+		}
+		results, err := searchKnowledgeBase(context.Background(), userID, username, strings.Join(args, " "), config.KBTopK)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Knowledge base search failed: %v", err))
+			return reply(userErrorMessage(err, "Sorry, I encountered an error searching your knowledge base."))
+		}
+		if len(results) == 0 {
+			return reply("Your knowledge base is empty.")
+		}
+		text := "🔍 Search results\n"
+		for i, result := range results {
+			text += fmt.Sprintf("\n[%d] #%s %s, part %d (score %.2f)\n%s\n", i+1, result.DocumentID, result.DocumentName,
+				result.Chunk+1, result.Score, truncateText(result.Text, 300))
+		}
+		return reply(text)
+
+	case "", "list":
+		documents, err := getKBDocuments(context.Background(), userID)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to get documents: %v", err))
+			return reply("Sorry, I encountered an error retrieving your knowledge base.")
+		}
+		text := "📚 Your knowledge base is empty.\n"
+		if len(documents) > 0 {
+			text = "📚 Your knowledge base\n\n"
+			for _, document := range documents {
+				text += fmt.Sprintf("#%s %s (%s, %d parts, added %s)\n", document.ID, document.Name,
+					formatFileSize(document.Size), document.Chunks, document.CreatedAt.Format("2006-01-02"))
+			}
+		}
+		text += "\nRelevant parts of your documents are added to every chat message.\n\n" +
+			"/kb add - Send with a document as caption, or reply to a document or message\n" +
+			"/kb add <text> - Add a note\n" +
+			"/kb list - List your documents\n" +
+			"/kb delete <id> - Delete a document\n" +
+			"/kb search <query> - Search your documents"
+		return reply(text)
+
+	default:
+		return reply("Unknown subcommand. Use /kb to see the available commands.")
+	}
+}
+
+// addKBFromMessage adds the document or text of the message (or the message it replies to)
+// to the knowledge base and returns the reply for the user
+func addKBFromMessage(ctx context.Context, msg *gotgbot.Message, userID int64, username string, note string) string {
+	source := msg
+	if msg.Document == nil && note == "" && msg.ReplyToMessage != nil {
+		source = msg.ReplyToMessage
+	}
+
+	var name, text string
+	var size int64
+	switch {
+	case source.Document != nil:
+		name = source.Document.FileName
+		if name == "" {
+			name = "document"
+		}
+		data, err := downloadTelegramFile(ctx, source.Document.FileId, maxDocumentSize)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to download %s: %v", name, err))
+			return fmt.Sprintf("Sorry, I couldn't download %s.", name)
+		}
+		if text, err = extractDocumentText(name, data); err != nil {
+			return fmt.Sprintf("Sorry, I couldn't read %s: %v", name, err)
+		}
+		size = int64(len(data))
+	case note != "":
+		name, text, size = truncateText(note, 40), note, int64(len(note))
+	case source != msg && source.Text != "":
+		name, text, size = truncateText(source.Text, 40), source.Text, int64(len(source.Text))
+	default:
+		return "Send /kb add as the caption of a document, reply with it to a document or message, or add a note with /kb add <text>."
+	}
+
+	document, err := addKBDocument(ctx, userID, username, name, size, text)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to add %s to the knowledge base: %v", name, err))
+		return userErrorMessage(err, fmt.Sprintf("Sorry, I couldn't add %s to your knowledge base.", name))
+	}
+	return fmt.Sprintf("📚 Added %s as #%s (%d parts).", document.Name, document.ID, document.Chunks)
+}
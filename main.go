@@ -27,20 +27,53 @@ func main() {
 		log.Fatal("[Error] Failed to connect to Redis: ", err)
 	}
 
+	// Load the model catalog and keep prices up to date
+	startCatalogRefresher(ctx)
+
 	// Create bot instance
 	b, err := gotgbot.NewBot(config.TelegramToken, nil)
 	if err != nil {
 		log.Fatal("[Error] Failed to create bot instance: ", err)
 	}
 
+	// Budget warnings and image downloads use the bot outside of handlers
+	telegramBot = b
+
 	// Set bot commands
 	var commands []gotgbot.BotCommand
 	commands = append(commands,
 		gotgbot.BotCommand{Command: "start", Description: "Start the bot"},
 		gotgbot.BotCommand{Command: "help", Description: "Show help message"},
 		gotgbot.BotCommand{Command: "set_models", Description: "Select AI model for text chat"},
+		gotgbot.BotCommand{Command: "usage", Description: "Show your token usage and costs"},
+		gotgbot.BotCommand{Command: "budget", Description: "Show your spending budgets"},
+		gotgbot.BotCommand{Command: "summary", Description: "Show or refresh the conversation summary"},
+		gotgbot.BotCommand{Command: "persona", Description: "Manage and select personas"},
+		gotgbot.BotCommand{Command: "system", Description: "Override the system prompt for this conversation"},
+		gotgbot.BotCommand{Command: "settings", Description: "Change generation settings"},
+		gotgbot.BotCommand{Command: "debate", Description: "Let your selected models debate a question"},
+		gotgbot.BotCommand{Command: "pipeline", Description: "Manage model pipelines"},
+		gotgbot.BotCommand{Command: "run", Description: "Run a pipeline"},
 	)
 	
+	if isKnowledgeBaseEnabled() {
+		commands = append(commands,
+			gotgbot.BotCommand{Command: "kb", Description: "Manage your knowledge base"},
+		)
+	}
+
+	if isModelCatalogEnabled() {
+		commands = append(commands,
+			gotgbot.BotCommand{Command: "catalog", Description: "Browse and search all models"},
+		)
+	}
+
+	if isAnswerVotingEnabled() {
+		commands = append(commands,
+			gotgbot.BotCommand{Command: "leaderboard", Description: "Show the model leaderboard of your votes"},
+		)
+	}
+
 	// Add image-related commands if enabled
 	if isImageGenerationEnabled() {
 		commands = append(commands,
@@ -71,6 +104,19 @@ func main() {
 	dispatcher.AddHandler(handlers.NewCommand("start", handleStart))
 	dispatcher.AddHandler(handlers.NewCommand("help", handleHelp))
 	dispatcher.AddHandler(handlers.NewCommand("set_models", handleSetModels))
+	dispatcher.AddHandler(handlers.NewCommand("usage", handleUsage))
+	dispatcher.AddHandler(handlers.NewCommand("budget", handleBudget))
+	dispatcher.AddHandler(handlers.NewCommand("kb", handleKB))
+	dispatcher.AddHandler(handlers.NewCommand("summary", handleSummary))
+	dispatcher.AddHandler(handlers.NewCommand("persona", handlePersona))
+	dispatcher.AddHandler(handlers.NewCommand("system", handleSystem))
+	dispatcher.AddHandler(handlers.NewCommand("settings", handleSettings))
+	dispatcher.AddHandler(handlers.NewCommand("debate", handleDebate))
+	dispatcher.AddHandler(handlers.NewCommand("pipeline", handlePipeline))
+	dispatcher.AddHandler(handlers.NewCommand("run", handleRun))
+	dispatcher.AddHandler(handlers.NewCommand("models_refresh", handleModelsRefresh))
+	dispatcher.AddHandler(handlers.NewCommand("catalog", handleCatalog))
+	dispatcher.AddHandler(handlers.NewCommand("leaderboard", handleLeaderboard))
 	
 	// Add image-related handlers if enabled
 	if isImageGenerationEnabled() {
@@ -78,6 +124,7 @@ func main() {
 		dispatcher.AddHandler(handlers.NewCommand("my_images", handleMyImages))
 	}
 	dispatcher.AddHandler(handlers.NewCallback(nil, handleCallback))
+	dispatcher.AddHandler(handlers.NewMessage(isEditedMessage, handleEditedMessage).SetAllowEdited(true))
 	dispatcher.AddHandler(handlers.NewMessage(nil, handleMessage))
 
 	// Create updater
@@ -6,7 +6,6 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -14,24 +13,219 @@ import (
 
 // ModelInfo represents information about an AI model including its price
 type ModelInfo struct {
-	ID       string
-	PriceIn  float64 // Price per 1M input tokens in USD
-	PriceOut float64 // Price per 1M output tokens in USD
+	ID              string
+	Name            string   // Display name from the OpenRouter catalog
+	InputModalities []string // Kinds of input the model accepts, e.g. "text", "image", "audio", "file"
+	Provider        string   // Name of the provider serving this model (see parseModelID)
+	PriceIn         float64  // Price per 1M input tokens in USD
+	PriceOut        float64  // Price per 1M output tokens in USD
+	SupportsTools   bool     // Whether the model accepts tool definitions
+	SupportsVision  bool     // Whether the model accepts images
+	ContextLength   int      // Maximum number of tokens of prompt and answer, zero if unknown
 }
 
 // Message represents a chat message structure
 type Message struct {
-	ID      string `json:"id"`      // Unique message ID
-	Role    string `json:"role"`    // Role (user/assistant/system)
-	Content string `json:"content"` // Message content
-	Model   string `json:"model"`   // Model that generated this message (for assistant messages)
+	ID         string         `json:"id,omitempty"`           // Unique message ID
+	Role       string         `json:"role"`                   // Role (user/assistant/system/tool)
+	Content    MessageContent `json:"content"`                // Message content
+	Model      string         `json:"model,omitempty"`        // Model that generated this message (for assistant messages)
+	ToolCalls  []ToolCall     `json:"tool_calls,omitempty"`   // Tools the model asked to run (for assistant messages)
+	ToolCallID string         `json:"tool_call_id,omitempty"` // Call this message answers (for tool messages)
+	Name       string         `json:"name,omitempty"`         // Name of the tool that ran (for tool messages)
+	Summary    bool           `json:"summary,omitempty"`      // Whether this system message summarizes earlier turns
+}
+
+// ContentPart is a text or image part of a message
+type ContentPart struct {
+	Type     string `json:"type"`                // "text" or "image"
+	Text     string `json:"text,omitempty"`      // For text parts
+	FileID   string `json:"file_id,omitempty"`   // Telegram file ID, for image parts
+	MimeType string `json:"mime_type,omitempty"` // For image parts
+	FileName string `json:"file_name,omitempty"` // For text parts holding an uploaded document
+	FileSize int64  `json:"file_size,omitempty"` // Size of the uploaded document in bytes
+	Data     []byte `json:"-"`                   // Image bytes, only loaded right before a request (see loadImages)
+}
+
+// MessageContent is the content of a message as a list of parts. Images are kept as
+// Telegram file IDs, so the history stays small.
+type MessageContent []ContentPart
+
+// TextContent returns content that consists of a single text part
+func TextContent(text string) MessageContent {
+	if text == "" {
+		return nil
+	}
+	return MessageContent{{Type: "text", Text: text}}
+}
+
+// Text returns the text parts of the content joined by newlines
+func (c MessageContent) Text() string {
+	var texts []string
+	for _, part := range c {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// HasImages reports whether the content contains at least one image
+func (c MessageContent) HasImages() bool {
+	for _, part := range c {
+		if part.Type == "image" {
+			return true
+		}
+	}
+	return false
+}
+
+// Documents returns the text parts that hold uploaded documents
+func (c MessageContent) Documents() []ContentPart {
+	var documents []ContentPart
+	for _, part := range c {
+		if part.Type == "text" && part.FileName != "" {
+			documents = append(documents, part)
+		}
+	}
+	return documents
+}
+
+// MarshalJSON stores plain text content as a string, which is also how
+// histories saved before images were supported look like
+func (c MessageContent) MarshalJSON() ([]byte, error) {
+	if !c.HasImages() && len(c.Documents()) == 0 {
+		return json.Marshal(c.Text())
+	}
+	return json.Marshal([]ContentPart(c))
+}
+
+// UnmarshalJSON accepts both a plain string and a list of parts
+func (c *MessageContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = TextContent(text)
+		return nil
+	}
+	var parts []ContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	*c = parts
+	return nil
+}
+
+// ToolCall is a tool invocation requested by a model, in OpenAI's format
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"` // Always "function"
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // JSON encoded arguments
+}
+
+// OpenRouterMessage is a chat message as sent to OpenRouter and other OpenAI-compatible APIs
+type OpenRouterMessage struct {
+	Role       string      `json:"role"`
+	Content    interface{} `json:"content"` // A string, or []OpenRouterContentPart for messages with images
+	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
+	ToolCallID string      `json:"tool_call_id,omitempty"`
+	Name       string      `json:"name,omitempty"`
+}
+
+// OpenRouterContentPart is a text or image_url part of a multimodal message
+type OpenRouterContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"` // May be a data URL with the base64 encoded image
+	} `json:"image_url,omitempty"`
+}
+
+// OpenRouterTool describes a function the model may call
+type OpenRouterTool struct {
+	Type     string                 `json:"type"` // Always "function"
+	Function OpenRouterToolFunction `json:"function"`
+}
+
+type OpenRouterToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"` // JSON schema
 }
 
 // OpenRouterRequest represents the request structure for OpenRouter API
 type OpenRouterRequest struct {
-	Model     string    `json:"model"`
-	Messages  []Message `json:"messages"`
-	MaxTokens int       `json:"max_tokens,omitempty"`
+	Model            string                   `json:"model"`
+	Messages         []OpenRouterMessage      `json:"messages"`
+	MaxTokens        int                      `json:"max_tokens,omitempty"`
+	Temperature      *float64                 `json:"temperature,omitempty"`
+	TopP             *float64                 `json:"top_p,omitempty"`
+	FrequencyPenalty *float64                 `json:"frequency_penalty,omitempty"`
+	Seed             *int                     `json:"seed,omitempty"`
+	ReasoningEffort  string                   `json:"reasoning_effort,omitempty"` // OpenAI-compatible servers
+	Reasoning        *OpenRouterReasoning     `json:"reasoning,omitempty"`        // OpenRouter
+	Stream           bool                     `json:"stream,omitempty"`
+	StreamOptions    *OpenRouterStreamOptions `json:"stream_options,omitempty"`
+	Usage            *OpenRouterUsageOptions  `json:"usage,omitempty"`
+	Tools            []OpenRouterTool         `json:"tools,omitempty"`
+	ToolChoice       string                   `json:"tool_choice,omitempty"`
+}
+
+// OpenRouterReasoning configures the reasoning of thinking models on OpenRouter.
+// Effort and MaxTokens are alternatives, only one of them may be set.
+type OpenRouterReasoning struct {
+	Effort    string `json:"effort,omitempty"`
+	MaxTokens int    `json:"max_tokens,omitempty"`
+}
+
+// OpenRouterReasoningFields holds the reasoning of a message or stream delta. OpenRouter sends it
+// as reasoning together with structured reasoning_details, other OpenAI-compatible servers
+// (DeepSeek, vLLM) as reasoning_content.
+type OpenRouterReasoningFields struct {
+	Reasoning        string `json:"reasoning"`
+	ReasoningContent string `json:"reasoning_content"`
+	ReasoningDetails []struct {
+		Type    string `json:"type"` // "reasoning.text", "reasoning.summary" or "reasoning.encrypted"
+		Text    string `json:"text"`
+		Summary string `json:"summary"`
+	} `json:"reasoning_details"`
+}
+
+// Text returns the readable reasoning, encrypted reasoning is skipped
+func (r OpenRouterReasoningFields) Text() string {
+	if r.Reasoning != "" {
+		return r.Reasoning
+	}
+	if r.ReasoningContent != "" {
+		return r.ReasoningContent
+	}
+	var text strings.Builder
+	for _, detail := range r.ReasoningDetails {
+		text.WriteString(detail.Text)
+		text.WriteString(detail.Summary)
+	}
+	return text.String()
+}
+
+// OpenRouterStreamOptions asks for a final stream chunk with token usage
+type OpenRouterStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// OpenRouterUsageOptions asks OpenRouter to include the request cost in the usage block
+type OpenRouterUsageOptions struct {
+	Include bool `json:"include"`
+}
+
+// OpenRouterUsage represents the token usage reported with a completion
+type OpenRouterUsage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"` // Only reported by OpenRouter
 }
 
 // OpenRouterErrorResponse represents the error response structure from OpenRouter API
@@ -43,31 +237,72 @@ type OpenRouterErrorResponse struct {
 }
 
 type OpenRouterResponse struct {
+	ID      string `json:"id"` // Generation ID
 	Choices []struct {
 		Message struct {
-			Content string `json:"content"`
+			Content   string     `json:"content"`
+			ToolCalls []ToolCall `json:"tool_calls"`
+			OpenRouterReasoningFields
 		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	Usage *OpenRouterUsage `json:"usage"`
+}
+
+// OpenRouterGenerationResponse represents the response from OpenRouter's generation stats endpoint
+type OpenRouterGenerationResponse struct {
+	Data struct {
+		TotalCost        float64 `json:"total_cost"`
+		TokensPrompt     int     `json:"tokens_prompt"`
+		TokensCompletion int     `json:"tokens_completion"`
+	} `json:"data"`
+}
+
+// OpenRouterStreamChunk represents a single SSE chunk from a streaming OpenRouter response
+type OpenRouterStreamChunk struct {
+	ID      string `json:"id"`
+	Choices []struct {
+		Delta struct {
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int              `json:"index"`
+				ID       string           `json:"id"`
+				Function ToolCallFunction `json:"function"` // Name and arguments arrive in fragments
+			} `json:"tool_calls"`
+			OpenRouterReasoningFields
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *OpenRouterUsage `json:"usage"` // Only set in the last chunk
+	Error *struct {
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	} `json:"error"`
 }
 
 // OpenRouterModelsResponse represents the response from OpenRouter's models endpoint
 type OpenRouterModelsResponse struct {
 	Data []struct {
-		ID          string `json:"id"`
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		Pricing     struct {
+		ID            string `json:"id"`
+		Name          string `json:"name"`
+		Description   string `json:"description"`
+		ContextLength int    `json:"context_length"`
+		Pricing       struct {
 			Prompt     string `json:"prompt"`
 			Completion string `json:"completion"`
 		} `json:"pricing"`
+		Architecture struct {
+			InputModalities []string `json:"input_modalities"`
+		} `json:"architecture"`
+		SupportedParameters []string `json:"supported_parameters"`
 	} `json:"data"`
 }
 
-// FetchModelPricing gets pricing information for available models from OpenRouter
+// FetchModelPricing gets pricing information for all models from OpenRouter
 func FetchModelPricing() (map[string]ModelInfo, error) {
 	client := &http.Client{Timeout: 10 * time.Second}
 	
-	req, err := http.NewRequest("GET", "https://openrouter.ai/api/v1/models", nil)
+	req, err := http.NewRequest("GET", openRouterBaseURL+"/models", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -94,26 +329,8 @@ func FetchModelPricing() (map[string]ModelInfo, error) {
 		return nil, fmt.Errorf("failed to decode response: %w, body: %s", err, string(body))
 	}
 
-	// Get list of our configured models from environment
-	configuredModels := make(map[string]bool)
-	if models := os.Getenv("AVAILABLE_MODELS"); models != "" {
-		for _, model := range strings.Split(models, ",") {
-			if trimmed := strings.TrimSpace(model); trimmed != "" {
-				configuredModels[trimmed] = true
-			}
-		}
-	} else {
-		// Use default model if none configured
-		configuredModels["google/gemini-flash-1.5"] = true
-	}
-
 	modelPricing := make(map[string]ModelInfo)
 	for _, model := range modelsResp.Data {
-		// Only process models that are in our configuration
-		if !configuredModels[model.ID] {
-			continue
-		}
-
 		// Parse pricing from scientific notation strings to float64 and convert to price per million tokens
 		promptPrice, err := strconv.ParseFloat(model.Pricing.Prompt, 64)
 		if err != nil {
@@ -131,10 +348,29 @@ func FetchModelPricing() (map[string]ModelInfo, error) {
 		// Convert to price per million tokens
 		completionPrice = completionPrice * 1_000_000
 
+		supportsTools := false
+		for _, param := range model.SupportedParameters {
+			if param == "tools" {
+				supportsTools = true
+			}
+		}
+
+		supportsVision := false
+		for _, modality := range model.Architecture.InputModalities {
+			if modality == "image" {
+				supportsVision = true
+			}
+		}
+
 		modelPricing[model.ID] = ModelInfo{
-			ID:       model.ID,
-			PriceIn:  promptPrice,     // Price per 1M input tokens
-			PriceOut: completionPrice, // Price per 1M output tokens
+			ID:              model.ID,
+			Name:            model.Name,
+			InputModalities: model.Architecture.InputModalities,
+			PriceIn:         promptPrice,     // Price per 1M input tokens
+			PriceOut:        completionPrice, // Price per 1M output tokens
+			SupportsTools:   supportsTools,
+			SupportsVision:  supportsVision,
+			ContextLength:   model.ContextLength,
 		}
 	}
 
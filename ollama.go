@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ollamaProvider talks to Ollama's native /api/chat endpoint
+type ollamaProvider struct {
+	baseURL string
+}
+
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"` // Base64 encoded
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	Thinking  string           `json:"thinking,omitempty"` // Reasoning of thinking models, only in responses
+}
+
+// OllamaToolCall is like OpenAI's tool call, but without an ID and with the arguments as an object
+type OllamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type OllamaChatRequest struct {
+	Model    string           `json:"model"`
+	Messages []OllamaMessage  `json:"messages"`
+	Stream   bool             `json:"stream"`
+	Tools    []OpenRouterTool `json:"tools,omitempty"` // Same format as OpenAI
+	Options  struct {
+		NumPredict       int      `json:"num_predict,omitempty"`
+		Temperature      *float64 `json:"temperature,omitempty"`
+		TopP             *float64 `json:"top_p,omitempty"`
+		FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+		Seed             *int     `json:"seed,omitempty"`
+	} `json:"options"`
+}
+
+// OllamaChatResponse is both the full response and a single streamed chunk
+type OllamaChatResponse struct {
+	Message         OllamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	Error           string        `json:"error"`
+	PromptEvalCount int           `json:"prompt_eval_count"` // Prompt tokens, set when done
+	EvalCount       int           `json:"eval_count"`        // Completion tokens, set when done
+}
+
+func newOllamaProvider(baseURL string) *ollamaProvider {
+	return &ollamaProvider{baseURL: strings.TrimRight(baseURL, "/")}
+}
+
+func (p *ollamaProvider) Name() string {
+	return "ollama"
+}
+
+func (p *ollamaProvider) newRequest(ctx context.Context, userID int64, username string, chatReq ChatRequest, stream bool) (*http.Request, error) {
+	reqBody := OllamaChatRequest{
+		Model:  chatReq.Model,
+		Stream: stream,
+	}
+	reqBody.Options.NumPredict = chatReq.MaxTokens
+	reqBody.Options.Temperature = chatReq.Temperature
+	reqBody.Options.TopP = chatReq.TopP
+	reqBody.Options.FrequencyPenalty = chatReq.FrequencyPenalty
+	reqBody.Options.Seed = chatReq.Seed
+	for _, msg := range chatReq.Messages {
+		ollamaMsg := OllamaMessage{Role: msg.Role, Content: msg.Content.Text()}
+		for _, part := range msg.Content {
+			if part.Type == "image" {
+				ollamaMsg.Images = append(ollamaMsg.Images, base64.StdEncoding.EncodeToString(part.Data))
+			}
+		}
+		for _, call := range msg.ToolCalls {
+			var ollamaCall OllamaToolCall
+			ollamaCall.Function.Name = call.Function.Name
+			ollamaCall.Function.Arguments = json.RawMessage(call.Function.Arguments)
+			if strings.TrimSpace(call.Function.Arguments) == "" {
+				ollamaCall.Function.Arguments = json.RawMessage("{}")
+			}
+			ollamaMsg.ToolCalls = append(ollamaMsg.ToolCalls, ollamaCall)
+		}
+		reqBody.Messages = append(reqBody.Messages, ollamaMsg)
+	}
+
+	// Ollama has no tool_choice, leaving out the tools has the same effect
+	if chatReq.ToolChoice != "none" {
+		reqBody.Tools = toOpenRouterTools(chatReq.Tools)
+	}
+
+	reqData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	logMessage(userID, username, "ollama_request", fmt.Sprintf("Model: %s, Messages: %d, Stream: %t", reqBody.Model, len(reqBody.Messages), stream))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/api/chat", bytes.NewBuffer(reqData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (p *ollamaProvider) Complete(ctx context.Context, userID int64, username string, chatReq ChatRequest) (*ChatResponse, error) {
+	client := &http.Client{Timeout: completionTimeout}
+
+	req, err := p.newRequest(ctx, userID, username, chatReq, false)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call Ollama API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	logMessage(userID, username, "ollama_response", fmt.Sprintf("Status: %d, Response length: %d", resp.StatusCode, len(respBody)))
+
+	var ollamaResp OllamaChatResponse
+	if err := json.Unmarshal(respBody, &ollamaResp); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, newAPIError("ollama", resp, fmt.Sprintf("Ollama API returned status %d: %s", resp.StatusCode, string(respBody)))
+		}
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || ollamaResp.Error != "" {
+		return nil, newAPIError("ollama", resp, fmt.Sprintf("Ollama API error (status %d): %s", resp.StatusCode, ollamaResp.Error))
+	}
+
+	toolCalls := toToolCalls(ollamaResp.Message.ToolCalls, 0)
+	if ollamaResp.Message.Content == "" && len(toolCalls) == 0 {
+		return nil, fmt.Errorf("no response from Ollama API")
+	}
+
+	return &ChatResponse{
+		Content:   ollamaResp.Message.Content,
+		Reasoning: ollamaResp.Message.Thinking,
+		Usage: Usage{
+			PromptTokens:     ollamaResp.PromptEvalCount,
+			CompletionTokens: ollamaResp.EvalCount,
+		},
+		ToolCalls:    toolCalls,
+		FinishReason: ollamaFinishReason(ollamaResp.DoneReason, toolCalls),
+	}, nil
+}
+
+// Stream reads Ollama's newline-delimited JSON stream
+func (p *ollamaProvider) Stream(ctx context.Context, userID int64, username string, chatReq ChatRequest, onDelta func(text string)) (*ChatResponse, error) {
+	client := &http.Client{Timeout: streamTimeout}
+
+	req, err := p.newRequest(ctx, userID, username, chatReq, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call Ollama API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+		return nil, newAPIError("ollama", resp, fmt.Sprintf("Ollama API returned status %d: %s", resp.StatusCode, string(respBody)))
+	}
+
+	var content, reasoning strings.Builder
+	var usage Usage
+	var toolCalls []ToolCall
+	finishReason := ""
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var chunk OllamaChatResponse
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			logMessage(userID, username, "ollama_error", fmt.Sprintf("Failed to decode stream chunk: %v", err))
+			continue
+		}
+		if chunk.Error != "" {
+			return nil, fmt.Errorf("Ollama stream error: %s", chunk.Error)
+		}
+
+		toolCalls = append(toolCalls, toToolCalls(chunk.Message.ToolCalls, len(toolCalls))...)
+		reasoning.WriteString(chunk.Message.Thinking)
+
+		if chunk.Message.Content != "" {
+			content.WriteString(chunk.Message.Content)
+			if onDelta != nil {
+				onDelta(content.String())
+			}
+		}
+		if chunk.Done {
+			usage = Usage{PromptTokens: chunk.PromptEvalCount, CompletionTokens: chunk.EvalCount}
+			finishReason = ollamaFinishReason(chunk.DoneReason, toolCalls)
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	logMessage(userID, username, "ollama_response", fmt.Sprintf("Status: %d, Streamed response length: %d", resp.StatusCode, content.Len()))
+
+	if content.Len() == 0 && len(toolCalls) == 0 {
+		return nil, fmt.Errorf("no response from Ollama API")
+	}
+
+	return &ChatResponse{Content: content.String(), Reasoning: reasoning.String(), Usage: usage, ToolCalls: toolCalls, FinishReason: finishReason}, nil
+}
+
+// toToolCalls converts Ollama tool calls to OpenAI's format. Ollama doesn't assign IDs,
+// so they are numbered starting at offset.
+func toToolCalls(calls []OllamaToolCall, offset int) []ToolCall {
+	var result []ToolCall
+	for i, call := range calls {
+		result = append(result, ToolCall{
+			ID:   fmt.Sprintf("call_%d", offset+i),
+			Type: "function",
+			Function: ToolCallFunction{
+				Name:      call.Function.Name,
+				Arguments: string(call.Function.Arguments),
+			},
+		})
+	}
+	return result
+}
+
+// ollamaFinishReason maps Ollama's done reason to OpenAI's finish reasons
+func ollamaFinishReason(doneReason string, toolCalls []ToolCall) string {
+	if len(toolCalls) > 0 {
+		return "tool_calls"
+	}
+	return doneReason // "stop" and "length" match OpenAI already
+}
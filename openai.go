@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// openAICompatibleProvider talks to any API that implements OpenAI's /chat/completions endpoint,
+// such as OpenRouter, vLLM, llama.cpp server or LM Studio
+type openAICompatibleProvider struct {
+	name    string
+	baseURL string
+	apiKey  string
+	// reportsCost asks the API for the request cost, only OpenRouter supports this
+	reportsCost bool
+}
+
+func newOpenAICompatibleProvider(name, baseURL, apiKey string) *openAICompatibleProvider {
+	return &openAICompatibleProvider{
+		name:    name,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+	}
+}
+
+func (p *openAICompatibleProvider) Name() string {
+	return p.name
+}
+
+func (p *openAICompatibleProvider) newRequest(ctx context.Context, userID int64, username string, reqBody OpenRouterRequest) (*http.Request, error) {
+	if reqBody.Stream {
+		reqBody.StreamOptions = &OpenRouterStreamOptions{IncludeUsage: true}
+	}
+	if p.reportsCost {
+		reqBody.Usage = &OpenRouterUsageOptions{Include: true}
+	}
+
+	reqData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	logMessage(userID, username, p.name+"_request", fmt.Sprintf("Model: %s, Messages: %d, Stream: %t", reqBody.Model, len(reqBody.Messages), reqBody.Stream))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/chat/completions", bytes.NewBuffer(reqData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Local servers usually don't need a key
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// toRequest converts a chat request to the provider's request body
+func (p *openAICompatibleProvider) toRequest(chatReq ChatRequest, stream bool) OpenRouterRequest {
+	reqBody := OpenRouterRequest{
+		Model:            chatReq.Model,
+		Messages:         toOpenRouterMessages(chatReq.Messages),
+		MaxTokens:        chatReq.MaxTokens,
+		Temperature:      chatReq.Temperature,
+		TopP:             chatReq.TopP,
+		FrequencyPenalty: chatReq.FrequencyPenalty,
+		Seed:             chatReq.Seed,
+		Stream:           stream,
+		Tools:            toOpenRouterTools(chatReq.Tools),
+		ToolChoice:       chatReq.ToolChoice,
+	}
+
+	// OpenRouter normalizes reasoning settings across providers, other servers follow OpenAI
+	// and only know the effort. A token budget takes precedence over the effort on OpenRouter.
+	switch {
+	case p.name == defaultProvider && chatReq.ReasoningTokens > 0:
+		reqBody.Reasoning = &OpenRouterReasoning{MaxTokens: chatReq.ReasoningTokens}
+	case p.name == defaultProvider && chatReq.ReasoningEffort != "":
+		reqBody.Reasoning = &OpenRouterReasoning{Effort: chatReq.ReasoningEffort}
+	case chatReq.ReasoningEffort != "":
+		reqBody.ReasoningEffort = chatReq.ReasoningEffort
+	}
+	return reqBody
+}
+
+func (p *openAICompatibleProvider) Complete(ctx context.Context, userID int64, username string, chatReq ChatRequest) (*ChatResponse, error) {
+	client := &http.Client{Timeout: completionTimeout}
+
+	req, err := p.newRequest(ctx, userID, username, p.toRequest(chatReq, false))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s API: %w", p.name, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	logMessage(userID, username, p.name+"_response", fmt.Sprintf("Status: %d, Response length: %d", resp.StatusCode, len(respBody)))
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, p.parseError(userID, username, resp, respBody)
+	}
+
+	var openRouterResp OpenRouterResponse
+	if err := json.Unmarshal(respBody, &openRouterResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if len(openRouterResp.Choices) == 0 {
+		return nil, fmt.Errorf("no response from %s API", p.name)
+	}
+
+	return &ChatResponse{
+		Content:      openRouterResp.Choices[0].Message.Content,
+		Usage:        openRouterResp.Usage.toUsage(),
+		GenerationID: openRouterResp.ID,
+		ToolCalls:    openRouterResp.Choices[0].Message.ToolCalls,
+		FinishReason: openRouterResp.Choices[0].FinishReason,
+		Reasoning:    openRouterResp.Choices[0].Message.OpenRouterReasoningFields.Text(),
+	}, nil
+}
+
+func (p *openAICompatibleProvider) Stream(ctx context.Context, userID int64, username string, chatReq ChatRequest, onDelta func(text string)) (*ChatResponse, error) {
+	client := &http.Client{Timeout: streamTimeout}
+
+	req, err := p.newRequest(ctx, userID, username, p.toRequest(chatReq, true))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s API: %w", p.name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+		return nil, p.parseError(userID, username, resp, respBody)
+	}
+
+	var content, reasoning strings.Builder
+	var usage *OpenRouterUsage
+	var toolCalls []ToolCall
+	generationID := ""
+	finishReason := ""
+	err = readSSE(resp.Body, func(event, data string) (bool, error) {
+		if data == "[DONE]" {
+			return false, nil
+		}
+
+		var chunk OpenRouterStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			logMessage(userID, username, p.name+"_error", fmt.Sprintf("Failed to decode stream chunk: %v", err))
+			return true, nil
+		}
+
+		// Errors that happen mid-stream are delivered as a chunk with an error field
+		if chunk.Error != nil {
+			return false, &APIError{
+				Provider:   p.name,
+				StatusCode: chunk.Error.Code,
+				Message:    fmt.Sprintf("%s stream error (code %d): %s", p.name, chunk.Error.Code, chunk.Error.Message),
+			}
+		}
+
+		if chunk.ID != "" {
+			generationID = chunk.ID
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+
+		if len(chunk.Choices) == 0 {
+			return true, nil
+		}
+		if chunk.Choices[0].FinishReason != "" {
+			finishReason = chunk.Choices[0].FinishReason
+		}
+
+		// Tool calls arrive in fragments, the index tells which call a fragment belongs to
+		for _, fragment := range chunk.Choices[0].Delta.ToolCalls {
+			for len(toolCalls) <= fragment.Index {
+				toolCalls = append(toolCalls, ToolCall{Type: "function"})
+			}
+			call := &toolCalls[fragment.Index]
+			if fragment.ID != "" {
+				call.ID = fragment.ID
+			}
+			call.Function.Name += fragment.Function.Name
+			call.Function.Arguments += fragment.Function.Arguments
+		}
+
+		reasoning.WriteString(chunk.Choices[0].Delta.OpenRouterReasoningFields.Text())
+
+		if chunk.Choices[0].Delta.Content == "" {
+			return true, nil
+		}
+
+		content.WriteString(chunk.Choices[0].Delta.Content)
+		if onDelta != nil {
+			onDelta(content.String())
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logMessage(userID, username, p.name+"_response", fmt.Sprintf("Status: %d, Streamed response length: %d", resp.StatusCode, content.Len()))
+
+	if content.Len() == 0 && len(toolCalls) == 0 {
+		return nil, fmt.Errorf("no response from %s API", p.name)
+	}
+
+	return &ChatResponse{
+		Content:      content.String(),
+		Usage:        usage.toUsage(),
+		GenerationID: generationID,
+		ToolCalls:    toolCalls,
+		FinishReason: finishReason,
+		Reasoning:    reasoning.String(),
+	}, nil
+}
+
+// toUsage converts the reported usage, which may be missing, into a Usage
+func (u *OpenRouterUsage) toUsage() Usage {
+	if u == nil {
+		return Usage{}
+	}
+	return Usage{
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		Cost:             u.Cost,
+	}
+}
+
+// parseError converts a non-200 response into an error
+func (p *openAICompatibleProvider) parseError(userID int64, username string, resp *http.Response, respBody []byte) error {
+	// Try to parse error response
+	var errorResp OpenRouterErrorResponse
+	if err := json.Unmarshal(respBody, &errorResp); err == nil && errorResp.Error.Message != "" {
+		logMessage(userID, username, p.name+"_error", fmt.Sprintf("Status: %d, Error type: %s, message: %s",
+			resp.StatusCode, errorResp.Error.Type, errorResp.Error.Message))
+		return newAPIError(p.name, resp, fmt.Sprintf("%s API error (status %d): %s - %s",
+			p.name, resp.StatusCode, errorResp.Error.Type, errorResp.Error.Message))
+	}
+	// If error parsing fails, log raw response
+	logMessage(userID, username, p.name+"_error", fmt.Sprintf("Status: %d, Raw response: %s",
+		resp.StatusCode, string(respBody)))
+	return newAPIError(p.name, resp, fmt.Sprintf("%s API returned status %d: %s", p.name, resp.StatusCode, string(respBody)))
+}
+
+// readSSE reads a server-sent events stream and calls handle for every data line.
+// Reading stops when handle returns false or an error.
+func readSSE(body io.Reader, handle func(event, data string) (bool, error)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	event := ""
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Empty lines end an event, lines starting with a colon are comments
+		// (OpenRouter sends ": OPENROUTER PROCESSING" keep-alives)
+		if line == "" {
+			event = ""
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "event:") {
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			continue
+		}
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		more, err := handle(event, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read stream: %w", err)
+	}
+	return nil
+}
+
+// toOpenRouterMessages strips bot-internal fields from the history before sending it
+func toOpenRouterMessages(messages []Message) []OpenRouterMessage {
+	result := make([]OpenRouterMessage, 0, len(messages))
+	for _, msg := range messages {
+		result = append(result, OpenRouterMessage{
+			Role:       msg.Role,
+			Content:    toOpenRouterContent(msg.Content),
+			ToolCalls:  msg.ToolCalls,
+			ToolCallID: msg.ToolCallID,
+			Name:       msg.Name,
+		})
+	}
+	return result
+}
+
+// toOpenRouterContent returns text-only content as a string and content with images
+// as a list of text and image_url parts with the images inlined
+func toOpenRouterContent(content MessageContent) interface{} {
+	if !content.HasImages() {
+		return content.Text()
+	}
+
+	parts := make([]OpenRouterContentPart, 0, len(content))
+	for _, part := range content {
+		openRouterPart := OpenRouterContentPart{Type: part.Type, Text: part.Text}
+		if part.Type == "image" {
+			openRouterPart.Type = "image_url"
+			openRouterPart.ImageURL = &struct {
+				URL string `json:"url"`
+			}{URL: imageDataURL(part)}
+		}
+		parts = append(parts, openRouterPart)
+	}
+	return parts
+}
+
+// toOpenRouterTools converts tools into OpenAI function definitions
+func toOpenRouterTools(tools []*Tool) []OpenRouterTool {
+	var result []OpenRouterTool
+	for _, tool := range tools {
+		result = append(result, OpenRouterTool{
+			Type: "function",
+			Function: OpenRouterToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return result
+}
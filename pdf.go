@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// pdfStreamStart matches the start of a stream object, the dictionary in front of it
+// tells how the stream data is encoded
+var pdfStreamStart = regexp.MustCompile(`stream\r?\n`)
+
+// extractPDFText pulls the text out of a PDF's page content streams. This is a best-effort
+// extractor: it understands uncompressed and Flate compressed streams and the text showing
+// operators, which covers PDFs exported by office software. Scanned PDFs and fonts with
+// custom encodings don't produce usable text.
+func extractPDFText(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return "", fmt.Errorf("not a PDF file")
+	}
+
+	var text strings.Builder
+	offset := 0
+	decompressed := int64(0)
+	for {
+		loc := pdfStreamStart.FindIndex(data[offset:])
+		if loc == nil {
+			break
+		}
+		keyword := offset + loc[0]
+		start := offset + loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		end += start
+		offset = end + len("endstream")
+
+		// The stream dictionary is between the last "obj" and the "stream" keyword
+		dictStart := bytes.LastIndex(data[:keyword], []byte("obj"))
+		if dictStart < 0 {
+			continue
+		}
+		dict := data[dictStart:keyword]
+
+		// Skip images, fonts and other binary streams
+		if bytes.Contains(dict, []byte("/Image")) || bytes.Contains(dict, []byte("/FontFile")) ||
+			bytes.Contains(dict, []byte("/Length1")) || bytes.Contains(dict, []byte("/XRef")) ||
+			bytes.Contains(dict, []byte("/ObjStm")) || bytes.Contains(dict, []byte("/Metadata")) {
+			continue
+		}
+
+		content := data[start:end]
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			reader, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			// Streams are often followed by garbage, so read errors after some output are ignored.
+			// All streams together may only expand up to maxDecompressedSize.
+			content, err = io.ReadAll(&limitedReader{r: reader, n: maxDecompressedSize - decompressed})
+			reader.Close()
+			if errors.Is(err, errDecompressedTooLarge) {
+				return "", err
+			}
+			decompressed += int64(len(content))
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			continue // Other filters are not supported
+		}
+
+		text.WriteString(extractPDFContentText(content))
+	}
+
+	result := cleanExtractedText(text.String())
+	if result == "" {
+		return "", fmt.Errorf("no text found, the PDF may be scanned or use unsupported fonts")
+	}
+	return result, nil
+}
+
+// extractPDFContentText interprets the text operators of a page content stream
+func extractPDFContentText(content []byte) string {
+	var text strings.Builder
+	var operands []interface{} // Strings, numbers and arrays for the next operator
+	var array []interface{}
+	inArray := false
+	inText := false
+
+	lexer := &pdfLexer{data: content}
+	for {
+		token, kind := lexer.next()
+		if kind == pdfTokenEOF {
+			break
+		}
+
+		switch kind {
+		case pdfTokenString, pdfTokenNumber:
+			var value interface{} = token
+			if kind == pdfTokenNumber {
+				number, _ := strconv.ParseFloat(token, 64)
+				value = number
+			}
+			if inArray {
+				array = append(array, value)
+			} else {
+				operands = append(operands, value)
+			}
+		case pdfTokenArrayStart:
+			inArray = true
+			array = nil
+		case pdfTokenArrayEnd:
+			inArray = false
+			operands = append(operands, array)
+		case pdfTokenOperator:
+			switch token {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				text.WriteString("\n")
+			case "Tj":
+				if s, ok := lastOperand(operands).(string); ok && inText {
+					text.WriteString(s)
+				}
+			case "'", "\"":
+				if s, ok := lastOperand(operands).(string); ok && inText {
+					text.WriteString("\n" + s)
+				}
+			case "TJ":
+				items, _ := lastOperand(operands).([]interface{})
+				for _, item := range items {
+					switch value := item.(type) {
+					case string:
+						text.WriteString(value)
+					case float64:
+						// Large negative kerning is how many PDFs encode spaces between words
+						if value < -200 {
+							text.WriteString(" ")
+						}
+					}
+				}
+			case "T*":
+				text.WriteString("\n")
+			case "Td", "TD":
+				if len(operands) >= 2 {
+					if ty, ok := operands[len(operands)-1].(float64); ok && ty != 0 {
+						text.WriteString("\n")
+					} else {
+						text.WriteString(" ")
+					}
+				}
+			case "Tm":
+				text.WriteString("\n")
+			case "ID":
+				lexer.skipInlineImage()
+			}
+			operands = operands[:0]
+		}
+	}
+	return text.String()
+}
+
+func lastOperand(operands []interface{}) interface{} {
+	if len(operands) == 0 {
+		return nil
+	}
+	return operands[len(operands)-1]
+}
+
+type pdfTokenKind int
+
+const (
+	pdfTokenEOF pdfTokenKind = iota
+	pdfTokenString
+	pdfTokenNumber
+	pdfTokenName
+	pdfTokenArrayStart
+	pdfTokenArrayEnd
+	pdfTokenDict
+	pdfTokenOperator
+)
+
+// pdfLexer splits a content stream into tokens
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func (l *pdfLexer) next() (string, pdfTokenKind) {
+	// Skip whitespace and comments
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if isPDFSpace(c) {
+			l.pos++
+		} else if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		} else {
+			break
+		}
+	}
+	if l.pos >= len(l.data) {
+		return "", pdfTokenEOF
+	}
+
+	c := l.data[l.pos]
+	switch {
+	case c == '(':
+		return l.literalString(), pdfTokenString
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		l.pos += 2
+		return "<<", pdfTokenDict
+	case c == '>' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '>':
+		l.pos += 2
+		return ">>", pdfTokenDict
+	case c == '<':
+		return l.hexString(), pdfTokenString
+	case c == '[':
+		l.pos++
+		return "[", pdfTokenArrayStart
+	case c == ']':
+		l.pos++
+		return "]", pdfTokenArrayEnd
+	case c == '/':
+		l.pos++
+		return l.regular(), pdfTokenName
+	case c == ')' || c == '>' || c == '{' || c == '}':
+		l.pos++
+		return l.next()
+	}
+
+	token := l.regular()
+	if _, err := strconv.ParseFloat(token, 64); err == nil {
+		return token, pdfTokenNumber
+	}
+	return token, pdfTokenOperator
+}
+
+// regular reads a run of regular characters (numbers, names and operators)
+func (l *pdfLexer) regular() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+// literalString reads a (string) with balanced parentheses and backslash escapes
+func (l *pdfLexer) literalString() string {
+	var result []byte
+	depth := 0
+	l.pos++ // Opening parenthesis
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+			result = append(result, c)
+		case ')':
+			if depth == 0 {
+				return decodePDFString(result)
+			}
+			depth--
+			result = append(result, c)
+		case '\\':
+			if l.pos >= len(l.data) {
+				break
+			}
+			escaped := l.data[l.pos]
+			l.pos++
+			switch escaped {
+			case 'n':
+				result = append(result, '\n')
+			case 'r':
+				result = append(result, '\r')
+			case 't':
+				result = append(result, '\t')
+			case 'b', 'f':
+				// Backspace and form feed carry no text
+			case '\r', '\n':
+				// Line continuation
+				if escaped == '\r' && l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+			default:
+				if escaped >= '0' && escaped <= '7' {
+					// Up to three octal digits
+					value := int(escaped - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						value = value*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					result = append(result, byte(value))
+				} else {
+					result = append(result, escaped)
+				}
+			}
+		default:
+			result = append(result, c)
+		}
+	}
+	return decodePDFString(result)
+}
+
+// hexString reads a <hex string>
+func (l *pdfLexer) hexString() string {
+	l.pos++ // Opening bracket
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if c := l.data[l.pos]; !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	l.pos++ // Closing bracket
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+
+	result := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		value, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		if err != nil {
+			return ""
+		}
+		result = append(result, byte(value))
+	}
+	return decodePDFString(result)
+}
+
+// skipInlineImage skips the binary data of an inline image up to the EI operator
+func (l *pdfLexer) skipInlineImage() {
+	for l.pos+2 < len(l.data) {
+		if l.data[l.pos] == 'E' && l.data[l.pos+1] == 'I' && isPDFSpace(l.data[l.pos-1]) &&
+			(l.pos+2 == len(l.data) || isPDFSpace(l.data[l.pos+2])) {
+			l.pos += 2
+			return
+		}
+		l.pos++
+	}
+	l.pos = len(l.data)
+}
+
+// decodePDFString converts a PDF string to UTF-8. Strings starting with a byte order mark are
+// UTF-16, everything else is treated as Latin-1, which matches the common encodings for ASCII text.
+func decodePDFString(raw []byte) string {
+	if len(raw) >= 2 && raw[0] == 0xFE && raw[1] == 0xFF {
+		var runes []rune
+		for i := 2; i+1 < len(raw); i += 2 {
+			runes = append(runes, rune(raw[i])<<8|rune(raw[i+1]))
+		}
+		return string(runes)
+	}
+
+	var result strings.Builder
+	for _, c := range raw {
+		r := rune(c)
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			continue // Glyph IDs of custom font encodings
+		}
+		result.WriteRune(r)
+	}
+	return result.String()
+}
+
+// cleanExtractedText normalizes whitespace and drops text that is not valid UTF-8
+func cleanExtractedText(text string) string {
+	if !utf8.ValidString(text) {
+		text = strings.ToValidUTF8(text, "")
+	}
+
+	lines := strings.Split(text, "\n")
+	var result []string
+	blank := false
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			// Keep at most one blank line in a row
+			if !blank && len(result) > 0 {
+				result = append(result, "")
+			}
+			blank = true
+			continue
+		}
+		result = append(result, line)
+		blank = false
+	}
+	return strings.TrimSpace(strings.Join(result, "\n"))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExtractPDFContentText(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "show string", content: "BT (Hello) Tj ET", want: "Hello\n"},
+		{name: "text outside a text object", content: "(Hidden) Tj", want: ""},
+		{name: "kerning as spaces", content: "BT [(Hel) -50 (lo) -300 (world)] TJ ET", want: "Hello world\n"},
+		{name: "escapes", content: `BT (a\(b\)c\\d\101\nz) Tj ET`, want: "a(b)c\\dA\nz\n"},
+		{name: "balanced parentheses", content: "BT (a (b) c) Tj ET", want: "a (b) c\n"},
+		{name: "line continuation", content: "BT (one \\\ntwo) Tj ET", want: "one two\n"},
+		{name: "hex string", content: "BT <48656C 6C6F> Tj ET", want: "Hello\n"},
+		{name: "odd hex string", content: "BT <4869 7> Tj ET", want: "Hip\n"},
+		{name: "utf-16 string", content: "BT <FEFF00E4006F> Tj ET", want: "äo\n"},
+		{name: "next line operator", content: "BT (a) Tj (b) ' ET", want: "a\nb\n"},
+		{name: "vertical move", content: "BT (a) Tj 0 -12 Td (b) Tj ET", want: "a\nb\n"},
+		{name: "horizontal move", content: "BT (a) Tj 10 0 Td (b) Tj ET", want: "a b\n"},
+		{name: "comment", content: "% (hidden) Tj\nBT (shown) Tj ET", want: "shown\n"},
+		{name: "inline image", content: "BT (a) Tj ET BI /W 1 ID \x00\xff(x) EI BT (b) Tj ET", want: "a\nb\n"},
+		{name: "custom encoding glyphs", content: "BT <0102> Tj ET", want: "\n"},
+		{name: "unterminated string", content: "BT (abc", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractPDFContentText([]byte(tt.content)); got != tt.want {
+				t.Errorf("extractPDFContentText(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+// pdfWithStreams returns a minimal PDF with one object per stream
+func pdfWithStreams(streams ...string) []byte {
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	for i, stream := range streams {
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendstream\nendobj\n", i+1, stream)
+	}
+	return pdf.Bytes()
+}
+
+func flate(data []byte) string {
+	var buf bytes.Buffer
+	writer := zlib.NewWriter(&buf)
+	writer.Write(data)
+	writer.Close()
+	return buf.String()
+}
+
+func TestExtractPDFText(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{
+			name: "uncompressed stream",
+			data: pdfWithStreams("<< /Length 16 >>\nstream\nBT (Hello) Tj ET"),
+			want: "Hello",
+		},
+		{
+			name: "flate stream",
+			data: pdfWithStreams("<< /Filter /FlateDecode >>\nstream\n" + flate([]byte("BT (Hello) Tj ET"))),
+			want: "Hello",
+		},
+		{
+			name: "several pages",
+			data: pdfWithStreams("<< >>\nstream\nBT (One) Tj ET", "<< >>\nstream\nBT (Two) Tj ET"),
+			want: "One\nTwo",
+		},
+		{
+			name: "images are skipped",
+			data: pdfWithStreams("<< /Subtype /Image >>\nstream\nBT (Pixels) Tj ET", "<< >>\nstream\nBT (Text) Tj ET"),
+			want: "Text",
+		},
+		{
+			name:    "unsupported filter",
+			data:    pdfWithStreams("<< /Filter /LZWDecode >>\nstream\nBT (Hello) Tj ET"),
+			wantErr: errors.New("no text found"),
+		},
+		{
+			name:    "not a PDF",
+			data:    []byte("BT (Hello) Tj ET"),
+			wantErr: errors.New("not a PDF file"),
+		},
+		{
+			name:    "decompression bomb",
+			data:    pdfWithStreams("<< /Filter /FlateDecode >>\nstream\n" + flate(make([]byte, maxDecompressedSize+1))),
+			wantErr: errDecompressedTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractPDFText(tt.data)
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("got %q, want error %v", got, tt.wantErr)
+				}
+				if !errors.Is(err, tt.wantErr) && !bytes.Contains([]byte(err.Error()), []byte(tt.wantErr.Error())) {
+					t.Errorf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanExtractedText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "collapses spaces", text: "  a   b\t c  ", want: "a b c"},
+		{name: "keeps one blank line", text: "a\n\n\n\nb", want: "a\n\nb"},
+		{name: "trims blank lines", text: "\n\na\n\n", want: "a"},
+		{name: "drops invalid utf-8", text: "a\xffb", want: "ab"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanExtractedText(tt.text); got != tt.want {
+				t.Errorf("cleanExtractedText(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
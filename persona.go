@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/go-redis/redis/v8"
+)
+
+// sharedPersonasKey holds the personas admins made available to every user
+const sharedPersonasKey = "personas:shared"
+
+// customPromptLabel is shown in the reply header when /system overrides the prompt
+const customPromptLabel = "custom prompt"
+
+func userPersonasKey(userID int64) string {
+	return fmt.Sprintf("user:%d:personas", userID)
+}
+
+func activePersonaKey(userID int64) string {
+	return fmt.Sprintf("user:%d:persona", userID)
+}
+
+func systemOverrideKey(userID int64) string {
+	return fmt.Sprintf("user:%d:system_prompt", userID)
+}
+
+// getPersonaPrompt looks up a persona of the user, falling back to the shared personas
+func getPersonaPrompt(ctx context.Context, userID int64, name string) (string, bool, error) {
+	for _, key := range []string{userPersonasKey(userID), sharedPersonasKey} {
+		prompt, err := rdb.HGet(ctx, key, name).Result()
+		if err == nil {
+			return prompt, true, nil
+		}
+		if err != redis.Nil {
+			return "", false, fmt.Errorf("redis get error: %w", err)
+		}
+	}
+	return "", false, nil
+}
+
+// getSystemPrompt returns the system prompt for the user's conversations and a label
+// for the reply header. A /system override wins over the active persona, which wins
+// over the configured SYSTEM_PROMPT. The label is empty for the configured prompt.
+func getSystemPrompt(ctx context.Context, userID int64) (string, string, error) {
+	override, err := rdb.Get(ctx, systemOverrideKey(userID)).Result()
+	if err != nil && err != redis.Nil {
+		return config.SystemPrompt, "", fmt.Errorf("redis get error: %w", err)
+	}
+	if override != "" {
+		return override, customPromptLabel, nil
+	}
+
+	persona, err := rdb.Get(ctx, activePersonaKey(userID)).Result()
+	if err != nil && err != redis.Nil {
+		return config.SystemPrompt, "", fmt.Errorf("redis get error: %w", err)
+	}
+	if persona != "" {
+		prompt, ok, err := getPersonaPrompt(ctx, userID, persona)
+		if err != nil {
+			return config.SystemPrompt, "", err
+		}
+		// A deleted persona falls back to the configured prompt
+		if ok {
+			return prompt, persona, nil
+		}
+	}
+	return config.SystemPrompt, "", nil
+}
+
+// withoutSystemPrompt removes the system prompt from the start of a stored history. The prompt
+// is added to every request instead, so persona changes apply to running conversations.
+// Summaries are kept.
+func withoutSystemPrompt(history []Message) []Message {
+	start := 0
+	for start < len(history) && history[start].Role == "system" && !history[start].Summary {
+		start++
+	}
+	return history[start:]
+}
+
+// splitCommand splits the text of a command into its first n words (including the command)
+// and the rest of the text with line breaks preserved
+func splitCommand(text string, n int) ([]string, string) {
+	var words []string
+	rest := strings.TrimSpace(text)
+	for len(words) < n && rest != "" {
+		end := strings.IndexFunc(rest, func(r rune) bool { return r == ' ' || r == '\n' || r == '\t' })
+		if end < 0 {
+			end = len(rest)
+		}
+		words = append(words, rest[:end])
+		rest = strings.TrimSpace(rest[end:])
+	}
+	return words, rest
+}
+
+// listPersonas returns the sorted persona names stored under key
+func listPersonas(ctx context.Context, key string) ([]string, error) {
+	names, err := rdb.HKeys(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis get error: %w", err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func handlePersona(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	reply := func(text string) error {
+		_, err := msg.Reply(b, text, &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	words, prompt := splitCommand(msg.Text, 3)
+	subcommand, name := "", ""
+	if len(words) > 1 {
+		subcommand = words[1]
+	}
+	if len(words) > 2 {
+		name = strings.ToLower(words[2])
+	}
+
+	bg := context.Background()
+	switch subcommand {
+	case "add", "edit", "share":
+		if name == "" || prompt == "" {
+			return reply(fmt.Sprintf("Usage: /persona %s <name> <system prompt>", subcommand))
+		}
+		key := userPersonasKey(userID)
+		if subcommand == "share" {
+			if !isAdmin(userID) {
+				return reply("Only admins can share personas.")
+			}
+			key = sharedPersonasKey
+		}
+		if err := rdb.HSet(bg, key, name, prompt).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to save persona %s: %v", name, err))
+			return reply("Sorry, I encountered an error saving the persona.")
+		}
+		logMessage(userID, username, "persona", fmt.Sprintf("Saved persona %s (%s)", name, subcommand))
+		if subcommand == "share" {
+			return reply(fmt.Sprintf("🎭 Shared persona %s is now available to everyone.", name))
+		}
+		return reply(fmt.Sprintf("🎭 Saved persona %s. Use /persona use %s to select it.", name, name))
+
+	case "delete", "unshare":
+		if name == "" {
+			return reply(fmt.Sprintf("Usage: /persona %s <name>", subcommand))
+		}
+		key := userPersonasKey(userID)
+		if subcommand == "unshare" {
+			if !isAdmin(userID) {
+				return reply("Only admins can remove shared personas.")
+			}
+			key = sharedPersonasKey
+		}
+		deleted, err := rdb.HDel(bg, key, name).Result()
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to delete persona %s: %v", name, err))
+			return reply("Sorry, I encountered an error deleting the persona.")
+		}
+		if deleted == 0 {
+			return reply(fmt.Sprintf("There is no persona %s.", name))
+		}
+		return reply(fmt.Sprintf("🗑 Deleted persona %s.", name))
+
+	case "use":
+		if name == "" {
+			return reply("Usage: /persona use <name>, or /persona use default for the default prompt")
+		}
+		if name == "default" {
+			if err := rdb.Del(bg, activePersonaKey(userID)).Err(); err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("Failed to reset persona: %v", err))
+				return reply("Sorry, I encountered an error selecting the persona.")
+			}
+			return reply("🎭 Using the default system prompt.")
+		}
+		if _, ok, err := getPersonaPrompt(bg, userID, name); err != nil || !ok {
+			return reply(fmt.Sprintf("There is no persona %s. Use /persona to see the available personas.", name))
+		}
+		if err := rdb.Set(bg, activePersonaKey(userID), name, 0).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to select persona %s: %v", name, err))
+			return reply("Sorry, I encountered an error selecting the persona.")
+		}
+		logMessage(userID, username, "persona", fmt.Sprintf("Selected persona %s", name))
+		return reply(fmt.Sprintf("🎭 Using persona %s.", name))
+
+	case "show":
+		prompt, ok, err := getPersonaPrompt(bg, userID, name)
+		if err != nil || !ok {
+			return reply(fmt.Sprintf("There is no persona %s.", name))
+		}
+		return reply(fmt.Sprintf("🎭 %s\n\n%s", name, prompt))
+
+	case "", "list":
+		own, err := listPersonas(bg, userPersonasKey(userID))
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to list personas: %v", err))
+			return reply("Sorry, I encountered an error retrieving your personas.")
+		}
+		shared, err := listPersonas(bg, sharedPersonasKey)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to list personas: %v", err))
+			return reply("Sorry, I encountered an error retrieving your personas.")
+		}
+		_, active, _ := getSystemPrompt(bg, userID)
+		if active == "" {
+			active = "default"
+		}
+
+		text := fmt.Sprintf("🎭 Active: %s\n", active)
+		if len(own) > 0 {
+			text += "\nYour personas: " + strings.Join(own, ", ") + "\n"
+		}
+		if len(shared) > 0 {
+			text += "\nShared personas: " + strings.Join(shared, ", ") + "\n"
+		}
+		text += "\n/persona use <name> - Select a persona (default for the default prompt)\n" +
+			"/persona add <name> <prompt> - Create or change a persona\n" +
+			"/persona show <name> - Show a persona's prompt\n" +
+			"/persona delete <name> - Delete a persona\n" +
+			"/system <prompt> - Override the prompt for the current conversation"
+		if isAdmin(userID) {
+			text += "\n\nAdmin commands:\n" +
+				"/persona share <name> <prompt> - Create or change a shared persona\n" +
+				"/persona unshare <name> - Delete a shared persona"
+		}
+		return reply(text)
+
+	default:
+		return reply("Unknown subcommand. Use /persona to see the available commands.")
+	}
+}
+
+func handleSystem(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	reply := func(text string) error {
+		_, err := msg.Reply(b, text, &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	_, prompt := splitCommand(msg.Text, 1)
+	switch prompt {
+	case "":
+		current, label, err := getSystemPrompt(context.Background(), userID)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to get system prompt: %v", err))
+		}
+		if label == "" {
+			label = "default"
+		}
+		if current == "" {
+			current = "(none)"
+		}
+		return reply(fmt.Sprintf("Current system prompt (%s):\n\n%s\n\n"+
+			"/system <prompt> - Override it for the current conversation\n"+
+			"/system reset - Go back to your persona", label, current))
+
+	case "reset":
+		if err := rdb.Del(context.Background(), systemOverrideKey(userID)).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to reset system prompt: %v", err))
+			return reply("Sorry, I encountered an error resetting the system prompt.")
+		}
+		return reply("The system prompt override was removed.")
+
+	default:
+		if err := rdb.Set(context.Background(), systemOverrideKey(userID), prompt, 0).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to set system prompt: %v", err))
+			return reply("Sorry, I encountered an error setting the system prompt.")
+		}
+		logMessage(userID, username, "persona", "Set system prompt override")
+		return reply("The system prompt is overridden until the conversation is restarted.")
+	}
+}
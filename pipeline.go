@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/go-redis/redis/v8"
+)
+
+// pipelineThreadPrefix starts the conversation key of pipeline outputs, it is followed by the
+// pipeline name and the model of the last stage, which continues the conversation when the user replies
+const pipelineThreadPrefix = "pipeline:"
+
+// maxPipelineStages limits the number of model calls of a pipeline run
+const maxPipelineStages = 6
+
+// Default prompt templates of the first and the later stages
+const (
+	firstStageTemplate = "{{input}}"
+	laterStageTemplate = "Request:\n{{input}}\n\nPrevious result:\n{{previous}}"
+)
+
+// PipelineStage is a model call of a pipeline. The prompt template may contain {{input}}, the
+// message the pipeline runs on, and {{previous}}, the output of the previous stage.
+type PipelineStage struct {
+	Model    string `json:"model"`
+	Template string `json:"template"`
+}
+
+// Pipeline chains models, each stage works on the output of the previous one
+type Pipeline struct {
+	Stages []PipelineStage `json:"stages"`
+}
+
+// render returns the prompt of the stage
+func (s PipelineStage) render(input string, previous string) string {
+	return strings.NewReplacer("{{input}}", input, "{{previous}}", previous).Replace(s.Template)
+}
+
+// String lists the stages of the pipeline, one per line
+func (p Pipeline) String() string {
+	var lines []string
+	for i, stage := range p.Stages {
+		lines = append(lines, fmt.Sprintf("%d. %s | %s", i+1, stage.Model, strings.ReplaceAll(stage.Template, "\n", `\n`)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func userPipelinesKey(userID int64) string {
+	return fmt.Sprintf("user:%d:pipelines", userID)
+}
+
+func defaultPipelineKey(userID int64) string {
+	return fmt.Sprintf("user:%d:default_pipeline", userID)
+}
+
+// pipelineThread returns the conversation key of a pipeline's output. Every pipeline has its own,
+// even if pipelines end with the same model.
+func pipelineThread(name string, pipeline Pipeline) string {
+	return pipelineThreadPrefix + name + ":" + pipeline.Stages[len(pipeline.Stages)-1].Model
+}
+
+// getPipeline returns a pipeline of the user, or nil if there is none with this name
+func getPipeline(ctx context.Context, userID int64, name string) (*Pipeline, error) {
+	data, err := rdb.HGet(ctx, userPipelinesKey(userID), name).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis get error: %w", err)
+	}
+	var pipeline Pipeline
+	if err := json.Unmarshal([]byte(data), &pipeline); err != nil {
+		return nil, fmt.Errorf("json unmarshal error: %w", err)
+	}
+	return &pipeline, nil
+}
+
+// getDefaultPipeline returns the pipeline that answers the user's messages instead of the
+// selected models, or nil if the user has none
+func getDefaultPipeline(ctx context.Context, userID int64) (string, *Pipeline, error) {
+	name, err := rdb.Get(ctx, defaultPipelineKey(userID)).Result()
+	if err == redis.Nil {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("redis get error: %w", err)
+	}
+	pipeline, err := getPipeline(ctx, userID, name)
+	return name, pipeline, err
+}
+
+// isModelAvailable reports whether the user may chat with the model: a configured
+// model, or an allowed catalog model if the catalog is enabled
+func isModelAvailable(ctx context.Context, model string) bool {
+	for _, info := range getAvailableModels() {
+		if info.ID == model {
+			return true
+		}
+	}
+	if !isModelCatalogEnabled() {
+		return false
+	}
+	if _, ok := findCatalogModel(model); !ok {
+		return false
+	}
+	patterns, err := getModelPatterns(ctx)
+	if err != nil {
+		return false
+	}
+	return isModelAllowed(patterns, model)
+}
+
+// parsePipeline reads stages given one per line as "model | prompt template". The template
+// is optional and "\n" in it starts a new line.
+func parsePipeline(ctx context.Context, text string) (Pipeline, error) {
+	var pipeline Pipeline
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		model, template, _ := strings.Cut(line, "|")
+		model = strings.TrimSpace(model)
+		template = strings.ReplaceAll(strings.TrimSpace(template), `\n`, "\n")
+		if !isModelAvailable(ctx, model) {
+			return Pipeline{}, fmt.Errorf("model %s is not available", model)
+		}
+		if template == "" {
+			template = laterStageTemplate
+			if len(pipeline.Stages) == 0 {
+				template = firstStageTemplate
+			}
+		}
+		pipeline.Stages = append(pipeline.Stages, PipelineStage{Model: model, Template: template})
+	}
+	if len(pipeline.Stages) == 0 {
+		return Pipeline{}, fmt.Errorf("a pipeline needs at least one stage")
+	}
+	if len(pipeline.Stages) > maxPipelineStages {
+		return Pipeline{}, fmt.Errorf("a pipeline can have at most %d stages", maxPipelineStages)
+	}
+	return pipeline, nil
+}
+
+// runPipeline runs the stages one after another on content. Intermediate outputs are
+// collapsed once their stage is done, the last stage's output is the answer and starts
+// the pipeline thread, so replying to it continues with the last stage's model.
+func runPipeline(ctx context.Context, b *gotgbot.Bot, msg *gotgbot.Message, userID int64, username string, userMode string, name string, pipeline Pipeline, content MessageContent) error {
+	logMessage(userID, username, "pipeline", fmt.Sprintf("Running %s on: %s", name, content.Text()))
+
+	input := content.Text()
+	previous := ""
+	for i, stage := range pipeline.Stages {
+		last := i == len(pipeline.Stages)-1
+		title := fmt.Sprintf("🔗 %s · stage %d of %d", name, i+1, len(pipeline.Stages))
+
+		// Images of the message go to the first stage, later stages work on text
+		prompt := TextContent(stage.render(input, previous))
+		if i == 0 {
+			for _, part := range content {
+				if part.Type == "image" {
+					prompt = append(prompt, part)
+				}
+			}
+		}
+
+		if last {
+			// The last stage's output is the answer, it starts the pipeline thread
+			answer := Answer{
+				UserID:   userID,
+				Thread:   pipelineThread(name, pipeline),
+				PromptID: msg.MessageId,
+				Request:  []Message{{Role: "user", Content: prompt}},
+				Notes:    []string{title},
+			}
+			if err := answerRequest(ctx, b, msg, userID, username, answer, content); err != nil {
+				return fmt.Errorf("pipeline %s stage %d: %w", name, i+1, err)
+			}
+			return nil
+		}
+
+		reply, err := startStreamingReply(b, msg, stage.Model, "", "", []string{title})
+		if err != nil {
+			return err
+		}
+		stageCtx, cancel := context.WithTimeout(ctx, time.Duration(config.ModelTimeoutSecs)*time.Second)
+		resp, err := streamModel(stageCtx, userID, username, []Message{{Role: "user", Content: prompt}}, stage.Model, ChatOptions{}, reply.SetModel, reply.Update)
+		if err != nil {
+			if ctxErr := stageCtx.Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			cancel()
+			reply.Fail(answerErrorMessage(err))
+			return fmt.Errorf("pipeline %s stage %d (%s) failed: %w", name, i+1, stage.Model, err)
+		}
+		cancel()
+		logMessage(userID, username, "ai_response", fmt.Sprintf("[%s stage %d via %s] %s", name, i+1, resp.Model, resp.Content))
+
+		// The intermediate output is kept, but collapsed
+		parts := expandableParts(fmt.Sprintf("%s · %s", title, resp.Model), resp.Content)
+		if _, _, err := b.EditMessageText(parts[0], &gotgbot.EditMessageTextOpts{
+			ChatId:    reply.chatID,
+			MessageId: reply.MessageID(),
+			ParseMode: "HTML",
+		}); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to collapse pipeline stage: %v", err))
+		}
+		for _, part := range parts[1:] {
+			if _, err := msg.Reply(b, part, &gotgbot.SendMessageOpts{ParseMode: "HTML"}); err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("Failed to send pipeline stage: %v", err))
+			}
+		}
+		previous = resp.Content
+	}
+	return nil
+}
+
+// handlePipeline manages the user's pipelines:
+//
+//	/pipeline
+//	/pipeline add <name>
+//	<model> | <prompt template>
+//	...
+//	/pipeline show|delete <name>
+//	/pipeline default <name>|off
+func handlePipeline(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	reply := func(text string) error {
+		for _, part := range chunkText(text, maxMessageLength) {
+			if _, err := msg.Reply(b, part, &gotgbot.SendMessageOpts{
+				ReplyMarkup: getKeyboard(userMode),
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	bg := context.Background()
+	args, rest := splitCommand(msg.Text, 3)
+	action, name := "", ""
+	if len(args) > 1 {
+		action = strings.ToLower(args[1])
+	}
+	if len(args) > 2 {
+		name = strings.ToLower(args[2])
+	}
+
+	switch action {
+	case "":
+		names, err := rdb.HKeys(bg, userPipelinesKey(userID)).Result()
+		if err != nil && err != redis.Nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to list pipelines: %v", err))
+			return reply("Sorry, your pipelines could not be loaded.")
+		}
+		sort.Strings(names)
+		defaultName, _, err := getDefaultPipeline(bg, userID)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to get default pipeline: %v", err))
+		}
+
+		text := "Your pipelines:\n"
+		if len(names) == 0 {
+			text += "(none)\n"
+		}
+		for _, pipelineName := range names {
+			if pipelineName == defaultName {
+				text += fmt.Sprintf("• %s (default)\n", pipelineName)
+			} else {
+				text += fmt.Sprintf("• %s\n", pipelineName)
+			}
+		}
+		return reply(text + "\n/pipeline add <name> - Add a pipeline, with one stage per line below:\n" +
+			"<model> | <prompt template>\n" +
+			"Templates can use {{input}} for your message and {{previous}} for the output of the previous stage\n" +
+			"/pipeline show <name> - Show the stages of a pipeline\n" +
+			"/pipeline delete <name> - Delete a pipeline\n" +
+			"/pipeline default <name>|off - Run a pipeline on every message instead of asking your selected models\n" +
+			"/run <name> <input> - Run a pipeline once")
+
+	case "add":
+		if strings.Contains(name, ":") {
+			return reply("Sorry, pipeline names can't contain \":\".")
+		}
+		if name == "" || rest == "" {
+			return reply("Usage:\n/pipeline add review\n" +
+				"google/gemini-flash-1.5 | {{input}}\n" +
+				"anthropic/claude-3.5-sonnet | Critique this answer to \"{{input}}\":\\n{{previous}}\n" +
+				"openai/gpt-4o-mini | Rewrite the answer to \"{{input}}\" following this critique:\\n{{previous}}")
+		}
+		pipeline, err := parsePipeline(bg, rest)
+		if err != nil {
+			return reply(fmt.Sprintf("Sorry, the pipeline is invalid: %v", err))
+		}
+		// A replaced pipeline starts a new conversation
+		if previous, err := getPipeline(bg, userID, name); err == nil && previous != nil {
+			if err := clearConversationHistory(bg, userID, pipelineThread(name, *previous)); err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("Failed to clear pipeline conversation: %v", err))
+			}
+		}
+		data, err := json.Marshal(pipeline)
+		if err != nil {
+			return fmt.Errorf("json marshal error: %w", err)
+		}
+		if err := rdb.HSet(bg, userPipelinesKey(userID), name, data).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to save pipeline: %v", err))
+			return reply("Sorry, the pipeline could not be saved.")
+		}
+		logMessage(userID, username, "pipeline", fmt.Sprintf("Saved pipeline %s", name))
+		return reply(fmt.Sprintf("✅ Pipeline %s saved:\n%s\n\nRun it with /run %s <input>", name, pipeline, name))
+
+	case "show", "delete", "default":
+		if name == "" {
+			return reply(fmt.Sprintf("Usage: /pipeline %s <name>", action))
+		}
+		if action == "default" && name == "off" {
+			if err := rdb.Del(bg, defaultPipelineKey(userID)).Err(); err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("Failed to reset default pipeline: %v", err))
+				return reply("Sorry, the default pipeline could not be turned off.")
+			}
+			return reply("Your messages are answered by your selected models again.")
+		}
+
+		pipeline, err := getPipeline(bg, userID, name)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to get pipeline: %v", err))
+			return reply("Sorry, the pipeline could not be loaded.")
+		}
+		if pipeline == nil {
+			return reply(fmt.Sprintf("You have no pipeline named %s.", name))
+		}
+
+		switch action {
+		case "show":
+			return reply(fmt.Sprintf("Pipeline %s:\n%s", name, pipeline))
+		case "delete":
+			defaultName, _, err := getDefaultPipeline(bg, userID)
+			if err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("Failed to get default pipeline: %v", err))
+			}
+			pipe := rdb.TxPipeline()
+			pipe.HDel(bg, userPipelinesKey(userID), name)
+			if defaultName == name {
+				pipe.Del(bg, defaultPipelineKey(userID))
+			}
+			if _, err := pipe.Exec(bg); err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("Failed to delete pipeline: %v", err))
+				return reply("Sorry, the pipeline could not be deleted.")
+			}
+			if err := clearConversationHistory(bg, userID, pipelineThread(name, *pipeline)); err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("Failed to clear pipeline conversation: %v", err))
+			}
+			return reply(fmt.Sprintf("Pipeline %s deleted.", name))
+		default:
+			if err := rdb.Set(bg, defaultPipelineKey(userID), name, 0).Err(); err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("Failed to set default pipeline: %v", err))
+				return reply("Sorry, the default pipeline could not be set.")
+			}
+			return reply(fmt.Sprintf("Pipeline %s now answers your messages. Replies to an answer continue with that model, "+
+				"/pipeline default off goes back to your selected models.", name))
+		}
+
+	default:
+		return reply("Unknown action. Use /pipeline to see what you can do.")
+	}
+}
+
+// handleRun runs a pipeline once: /run <name> <input>
+func handleRun(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	reply := func(text string) error {
+		_, err := msg.Reply(b, text, &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	args, input := splitCommand(msg.Text, 2)
+	if len(args) < 2 || input == "" {
+		return reply("Usage: /run <pipeline> <input>, see /pipeline for your pipelines.")
+	}
+	name := strings.ToLower(args[1])
+	pipeline, err := getPipeline(context.Background(), userID, name)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to get pipeline: %v", err))
+		return reply("Sorry, the pipeline could not be loaded.")
+	}
+	if pipeline == nil {
+		return reply(fmt.Sprintf("You have no pipeline named %s, see /pipeline.", name))
+	}
+
+	// The run stops when the conversation is restarted
+	requestCtx, done := startRequest(userID)
+	defer done()
+	return runPipeline(requestCtx, b, msg, userID, username, userMode, name, *pipeline, TextContent(input))
+}
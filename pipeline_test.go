@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParsePipeline(t *testing.T) {
+	previous := config
+	t.Cleanup(func() { config = previous })
+	config = Config{AvailableModels: []ModelInfo{{ID: "a/one"}, {ID: "b/two"}}}
+
+	tests := []struct {
+		name    string
+		text    string
+		want    []PipelineStage
+		wantErr string
+	}{
+		{
+			name: "default templates",
+			text: "a/one\nb/two",
+			want: []PipelineStage{
+				{Model: "a/one", Template: firstStageTemplate},
+				{Model: "b/two", Template: laterStageTemplate},
+			},
+		},
+		{
+			name: "custom templates",
+			text: "a/one | Answer: {{input}}\nb/two | Critique:\\n{{previous}}",
+			want: []PipelineStage{
+				{Model: "a/one", Template: "Answer: {{input}}"},
+				{Model: "b/two", Template: "Critique:\n{{previous}}"},
+			},
+		},
+		{
+			name: "blank lines and spaces",
+			text: "\n  a/one  |  {{input}}  \n\n",
+			want: []PipelineStage{{Model: "a/one", Template: "{{input}}"}},
+		},
+		{
+			name: "template with a bar",
+			text: "a/one | a | b",
+			want: []PipelineStage{{Model: "a/one", Template: "a | b"}},
+		},
+		{name: "unknown model", text: "a/one\nc/three", wantErr: "model c/three is not available"},
+		{name: "no stages", text: "\n \n", wantErr: "at least one stage"},
+		{name: "too many stages", text: strings.Repeat("a/one\n", maxPipelineStages+1), wantErr: "at most"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePipeline(context.Background(), tt.text)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got.Stages, tt.want) {
+				t.Errorf("got %+v, want %+v", got.Stages, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipelineStageRender(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{name: "input", template: firstStageTemplate, want: "question"},
+		{name: "input and previous", template: laterStageTemplate, want: "Request:\nquestion\n\nPrevious result:\nanswer"},
+		{name: "repeated placeholders", template: "{{input}} {{input}}", want: "question question"},
+		{name: "no placeholders", template: "Summarize", want: "Summarize"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stage := PipelineStage{Model: "a/one", Template: tt.template}
+			if got := stage.render("question", "answer"); got != tt.want {
+				t.Errorf("render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipelineReplyChunks(t *testing.T) {
+	long := strings.Repeat("ä", maxMessageLength)
+	tests := []struct {
+		name      string
+		pipeline  Pipeline
+		wantParts int
+	}{
+		{
+			name:      "short pipeline",
+			pipeline:  Pipeline{Stages: []PipelineStage{{Model: "a/one", Template: firstStageTemplate}}},
+			wantParts: 1,
+		},
+		{
+			name: "stages over the limit",
+			pipeline: Pipeline{Stages: []PipelineStage{
+				{Model: "a/one", Template: strings.Repeat("x", maxMessageLength/2)},
+				{Model: "b/two", Template: strings.Repeat("y", maxMessageLength/2)},
+			}},
+			wantParts: 2,
+		},
+		{
+			name:      "template over the limit",
+			pipeline:  Pipeline{Stages: []PipelineStage{{Model: "a/one", Template: long}}},
+			wantParts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := "Pipeline review:\n" + tt.pipeline.String()
+			parts := chunkText(text, maxMessageLength)
+			if len(parts) != tt.wantParts {
+				t.Fatalf("got %d parts, want %d", len(parts), tt.wantParts)
+			}
+			for i, part := range parts {
+				if n := utf8.RuneCountInString(part); n > maxMessageLength {
+					t.Errorf("part %d has %d characters, more than %d", i, n, maxMessageLength)
+				}
+			}
+			// Parts are split at line breaks or, within a line, between characters
+			joined := strings.Join(parts, "")
+			for _, stage := range tt.pipeline.Stages {
+				if !strings.Contains(joined, stage.Template) {
+					t.Errorf("template of %s is missing", stage.Model)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// completionTimeout limits regular (non-streaming) chat completion requests
+const completionTimeout = 30 * time.Second
+
+// streamTimeout limits streaming requests, which can take much longer than regular ones
+const streamTimeout = 5 * time.Minute
+
+// maxResponseTokens limits the length of an answer unless the user changed it in /settings
+const maxResponseTokens = 4000
+
+// defaultProvider serves models that have no provider prefix in their ID
+const defaultProvider = "openrouter"
+
+// ChatRequest is a provider independent chat completion request
+type ChatRequest struct {
+	Model    string // Model name as the provider knows it (without provider prefix)
+	Messages []Message
+	GenerationSettings
+	ChatOptions
+}
+
+// ChatOptions holds optional parameters of a chat completion request
+type ChatOptions struct {
+	Tools      []*Tool
+	ToolChoice string // "none" forces a text answer even though tools are defined
+}
+
+// ChatResponse is a provider independent chat completion response
+type ChatResponse struct {
+	Content      string
+	Model        string // Model that actually answered, may be a fallback of the requested one
+	Usage        Usage
+	GenerationID string     // Provider's ID for this completion, used to look up the exact cost
+	ToolCalls    []ToolCall // Tools the model wants to run before answering
+	FinishReason string     // Normalized to OpenAI's values: "stop", "length" or "tool_calls"
+	Reasoning    string     // Thinking of reasoning models, kept apart from the answer
+}
+
+// Usage holds the token usage and cost of a single completion
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64 // Cost in USD as reported by the provider, zero if unknown
+}
+
+// ChatProvider is a backend that can serve chat completions
+type ChatProvider interface {
+	// Name returns the provider name used as model ID prefix
+	Name() string
+	// Complete sends the request and waits for the full answer
+	Complete(ctx context.Context, userID int64, username string, req ChatRequest) (*ChatResponse, error)
+	// Stream sends the request and calls onDelta with the accumulated answer every time a chunk arrives
+	Stream(ctx context.Context, userID int64, username string, req ChatRequest, onDelta func(text string)) (*ChatResponse, error)
+}
+
+// chatProviders holds all configured providers by name
+var chatProviders = map[string]ChatProvider{}
+
+func initProviders() {
+	chatProviders = map[string]ChatProvider{
+		defaultProvider: newOpenRouterProvider(),
+	}
+
+	for name, provider := range config.CustomProviders {
+		chatProviders[name] = newOpenAICompatibleProvider(name, provider.BaseURL, provider.APIKey)
+	}
+
+	if config.OllamaBaseURL != "" {
+		chatProviders["ollama"] = newOllamaProvider(config.OllamaBaseURL)
+	}
+
+	if config.AnthropicAPIKey != "" {
+		chatProviders["anthropic"] = newAnthropicProvider(config.AnthropicAPIKey)
+	}
+}
+
+// parseModelID splits a model ID of the form "provider:model" into its parts.
+// IDs without a provider prefix (e.g. "openai/gpt-4o-mini") are served by OpenRouter.
+// OpenRouter variants like "meta-llama/llama-3-8b-instruct:free" are not treated as prefixed
+// since a provider name never contains a slash.
+func parseModelID(modelID string) (provider string, model string) {
+	prefix, rest, found := strings.Cut(modelID, ":")
+	if !found || prefix == "" || strings.Contains(prefix, "/") {
+		return defaultProvider, modelID
+	}
+	return prefix, rest
+}
+
+// getProvider returns the provider serving the model and the model name to send to it
+func getProvider(modelID string) (ChatProvider, string, error) {
+	providerName, model := parseModelID(modelID)
+	provider, ok := chatProviders[providerName]
+	if !ok {
+		return nil, "", fmt.Errorf("provider %q is not configured for model %s", providerName, modelID)
+	}
+	return provider, model, nil
+}
+
+// getVisionProvider is like getProvider, but fails for models that can't handle the images
+// in messages, so fallback chains skip them
+func getVisionProvider(modelID string, messages []Message) (ChatProvider, string, error) {
+	for _, msg := range messages {
+		if msg.Content.HasImages() && !modelSupportsVision(modelID) {
+			return nil, "", fmt.Errorf("model %s does not support images", modelID)
+		}
+	}
+	return getProvider(modelID)
+}
+
+// getRequestSettings returns the user's generation settings for a model, or the defaults
+// if they can't be loaded
+func getRequestSettings(ctx context.Context, userID int64, username string, model string) GenerationSettings {
+	settings, err := getGenerationSettings(ctx, userID, model)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to get generation settings: %v", model, err))
+	}
+	return settings
+}
+
+// callModel sends messages to the model's provider and waits for the full answer.
+// Transient errors are retried and the model's fallback chain is used when retries run out,
+// so the model in the response may differ from the requested one.
+func callModel(ctx context.Context, userID int64, username string, messages []Message, model string) (*ChatResponse, error) {
+	// If no model is specified, use the default from config
+	if model == "" {
+		model = config.OpenRouterModel
+	}
+
+	if err := checkBudget(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	messages, err := loadImages(ctx, messages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load images: %w", err)
+	}
+
+	resp, err := runWithFallback(ctx, userID, username, model, nil, func(candidate string) (*ChatResponse, error) {
+		provider, providerModel, err := getVisionProvider(candidate, messages)
+		if err != nil {
+			return nil, err
+		}
+
+		return provider.Complete(ctx, userID, username, ChatRequest{
+			Model:              providerModel,
+			Messages:           trimHistory(userID, username, messages, candidate),
+			GenerationSettings: getRequestSettings(ctx, userID, username, candidate),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	recordUsage(ctx, userID, username, resp)
+	return resp, nil
+}
+
+// streamModel sends messages to the model's provider and streams the answer into onDelta.
+// Like callModel it retries and falls back, onFallback is called when another model takes over.
+func streamModel(ctx context.Context, userID int64, username string, messages []Message, model string, opts ChatOptions, onFallback func(model string), onDelta func(text string)) (*ChatResponse, error) {
+	// If no model is specified, use the default from config
+	if model == "" {
+		model = config.OpenRouterModel
+	}
+
+	if err := checkBudget(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	messages, err := loadImages(ctx, messages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load images: %w", err)
+	}
+
+	resp, err := runWithFallback(ctx, userID, username, model, onFallback, func(candidate string) (*ChatResponse, error) {
+		provider, providerModel, err := getVisionProvider(candidate, messages)
+		if err != nil {
+			return nil, err
+		}
+
+		request := trimHistory(userID, username, messages, candidate)
+		partial := ""
+		resp, err := provider.Stream(ctx, userID, username, ChatRequest{
+			Model:              providerModel,
+			Messages:           request,
+			GenerationSettings: getRequestSettings(ctx, userID, username, candidate),
+			ChatOptions:        opts,
+		}, func(text string) {
+			partial = text
+			if onDelta != nil {
+				onDelta(text)
+			}
+		})
+		if err != nil && partial != "" {
+			// The output streamed before the failure is billed, so it counts against the budget as well
+			recordPartialUsage(userID, username, candidate, request, partial)
+		}
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	recordUsage(ctx, userID, username, resp)
+	return resp, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// reasoningTTL is how long the reasoning behind an answer can be shown
+const reasoningTTL = 7 * 24 * time.Hour
+
+// maxReasoningPart is the maximum length of an escaped part, it leaves room for the HTML markup
+// and the title in a Telegram message
+const maxReasoningPart = 3000
+
+// expandableParts renders text as collapsed quotes below a bold title, split into parts
+// that fit into Telegram HTML messages
+func expandableParts(title string, text string) []string {
+	var parts []string
+	chunks := escapedChunks(text, maxReasoningPart, maxReasoningPart)
+	if len(chunks) == 0 {
+		// Empty text still shows the title
+		chunks = []string{""}
+	}
+	for i, part := range chunks {
+		quote := fmt.Sprintf("<blockquote expandable>%s</blockquote>", part)
+		if i == 0 {
+			quote = fmt.Sprintf("<b>%s</b>\n%s", html.EscapeString(title), quote)
+		}
+		parts = append(parts, quote)
+	}
+	return parts
+}
+
+// escapedChunks splits text into HTML-escaped chunks of at most maxChars characters after
+// escaping. Chunks that grow too long by escaping are split again into smaller ones.
+func escapedChunks(text string, size int, maxChars int) []string {
+	var chunks []string
+	for _, chunk := range chunkText(text, size) {
+		escaped := html.EscapeString(chunk)
+		if length := utf8.RuneCountInString(chunk); utf8.RuneCountInString(escaped) > maxChars && length > 1 {
+			chunks = append(chunks, escapedChunks(chunk, length/2, maxChars)...)
+			continue
+		}
+		chunks = append(chunks, escaped)
+	}
+	return chunks
+}
+
+// saveReasoning stores the reasoning behind the answer starting with messageID. Reasoning is
+// not part of the conversation history, models only see their previous answers.
+func saveReasoning(ctx context.Context, messageID int64, reasoning string) error {
+	key := fmt.Sprintf("message:%d:reasoning", messageID)
+	return rdb.Set(ctx, key, reasoning, reasoningTTL).Err()
+}
+
+// getReasoning returns the reasoning behind an answer, or an empty string if there is none
+func getReasoning(ctx context.Context, messageID int64) (string, error) {
+	key := fmt.Sprintf("message:%d:reasoning", messageID)
+	reasoning, err := rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("redis get error: %w", err)
+	}
+	return reasoning, nil
+}
+
+// reasoningButton shows the reasoning behind the answer starting with messageID when tapped
+func reasoningButton(messageID int64) gotgbot.InlineKeyboardButton {
+	return gotgbot.InlineKeyboardButton{Text: "💭 Show reasoning", CallbackData: fmt.Sprintf("reasoning:%d", messageID)}
+}
+
+// handleReasoningCallback sends the reasoning behind an answer as expandable quotes,
+// data is the callback data without "reasoning:"
+func handleReasoningCallback(b *gotgbot.Bot, callback *gotgbot.CallbackQuery, userID int64, username string, data string) error {
+	msg := callback.Message
+	if msg == nil {
+		return fmt.Errorf("callback message is nil")
+	}
+
+	messageID, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid reasoning callback data: %s", data)
+	}
+	reasoning, err := getReasoning(context.Background(), messageID)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to get reasoning: %v", err))
+	}
+	if reasoning == "" {
+		_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "The reasoning is no longer available.",
+			ShowAlert: true,
+		})
+		return err
+	}
+
+	for _, text := range expandableParts("💭 Reasoning", reasoning) {
+		if _, err := b.SendMessage(msg.GetChat().Id, text, &gotgbot.SendMessageOpts{
+			ParseMode:       "HTML",
+			ReplyParameters: &gotgbot.ReplyParameters{MessageId: msg.GetMessageId()},
+		}); err != nil {
+			return fmt.Errorf("failed to send reasoning: %w", err)
+		}
+	}
+	logMessage(userID, username, "reasoning", fmt.Sprintf("Showed reasoning of message %d", messageID))
+
+	// Acknowledge the callback without showing alert
+	_, err = callback.Answer(b, nil)
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestExpandableParts(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		wantParts int
+		contains  []string
+	}{
+		{
+			name:      "short text keeps every line",
+			text:      "first line\nsecond line\nthird line",
+			wantParts: 1,
+			contains:  []string{"first line\nsecond line\nthird line"},
+		},
+		{
+			name:      "empty text shows the title",
+			text:      "",
+			wantParts: 1,
+		},
+		{
+			name:      "long single line is split",
+			text:      strings.Repeat("a", 2*maxReasoningPart+10),
+			wantParts: 3,
+		},
+		{
+			name:      "escaping is measured",
+			text:      strings.Repeat("<", maxReasoningPart),
+			wantParts: 4,
+			contains:  []string{"&lt;"},
+		},
+		{
+			name:      "multi-byte text is split at rune boundaries",
+			text:      strings.Repeat("ä", maxReasoningPart+1),
+			wantParts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := expandableParts("Title", tt.text)
+			if len(parts) != tt.wantParts {
+				t.Fatalf("got %d parts, want %d", len(parts), tt.wantParts)
+			}
+			if !strings.HasPrefix(parts[0], "<b>Title</b>\n") {
+				t.Errorf("first part has no title: %q", parts[0][:20])
+			}
+			joined := strings.Join(parts, "")
+			for _, want := range tt.contains {
+				if !strings.Contains(joined, want) {
+					t.Errorf("parts don't contain %q", want)
+				}
+			}
+			for i, part := range parts {
+				if !utf8.ValidString(part) {
+					t.Errorf("part %d is not valid UTF-8", i)
+				}
+				if n := utf8.RuneCountInString(part); n > maxMessageLength {
+					t.Errorf("part %d has %d characters, more than %d", i, n, maxMessageLength)
+				}
+			}
+		})
+	}
+}
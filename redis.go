@@ -49,6 +49,28 @@ func clearConversationHistory(ctx context.Context, userID int64, model string) e
 	return rdb.Del(ctx, key).Err()
 }
 
+// addUserThread records a conversation that isn't named after a model, like a synthesis,
+// so clearUserThreads can find it
+func addUserThread(ctx context.Context, userID int64, thread string) error {
+	key := fmt.Sprintf("user:%d:threads", userID)
+	return rdb.SAdd(ctx, key, thread).Err()
+}
+
+// clearUserThreads removes the conversations recorded with addUserThread
+func clearUserThreads(ctx context.Context, userID int64) error {
+	key := fmt.Sprintf("user:%d:threads", userID)
+	threads, err := rdb.SMembers(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("redis smembers error: %w", err)
+	}
+	for _, thread := range threads {
+		if err := clearConversationHistory(ctx, userID, thread); err != nil {
+			return err
+		}
+	}
+	return rdb.Del(ctx, key).Err()
+}
+
 func getUserModels(ctx context.Context, userID int64) ([]string, error) {
 	key := fmt.Sprintf("user:%d:models", userID)
 	models, err := rdb.SMembers(ctx, key).Result()
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryBaseDelay is the delay before the first retry, it doubles with every attempt
+const retryBaseDelay = 1 * time.Second
+
+// retryMaxDelay caps both the exponential backoff and the Retry-After header
+const retryMaxDelay = 30 * time.Second
+
+// APIError is returned by chat providers when the API answers with an unsuccessful status
+type APIError struct {
+	Provider   string
+	StatusCode int
+	RetryAfter time.Duration // Parsed Retry-After header, zero if absent
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// newAPIError creates an APIError from a provider response
+func newAPIError(provider string, resp *http.Response, message string) *APIError {
+	return &APIError{
+		Provider:   provider,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		Message:    message,
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// isRetryableError reports whether an error is transient and the same request may succeed later
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+			529: // Anthropic's "overloaded" status
+			return true
+		}
+		return false
+	}
+
+	// Network failures and connections dropped mid-stream
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isFallbackError reports whether another model may succeed where this one failed.
+// Authentication errors affect all models of a provider the same way, but other failures are model specific.
+func isFallbackError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode != http.StatusUnauthorized && apiErr.StatusCode != http.StatusForbidden
+	}
+	return true
+}
+
+// backoffDelay returns the delay before the given retry attempt (starting at 0).
+// The server's Retry-After takes precedence, otherwise exponential backoff with jitter is used.
+func backoffDelay(attempt int, err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return min(apiErr.RetryAfter, retryMaxDelay)
+	}
+
+	delay := min(retryBaseDelay<<attempt, retryMaxDelay)
+	// Full jitter between half and the whole delay spreads out retries of concurrent requests
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// getModelChain returns the model followed by its configured fallback models
+func getModelChain(model string) []string {
+	return append([]string{model}, config.FallbackModels[model]...)
+}
+
+// runWithFallback calls the model, retrying transient errors with backoff.
+// When retries are exhausted it moves on to the next model in the fallback chain.
+// onFallback (optional) is called before switching to a fallback model.
+func runWithFallback(ctx context.Context, userID int64, username string, model string, onFallback func(model string), call func(model string) (*ChatResponse, error)) (*ChatResponse, error) {
+	var lastErr error
+	for i, candidate := range getModelChain(model) {
+		if i > 0 {
+			// A fallback can't answer in time once the request was canceled or timed out
+			if !isFallbackError(lastErr) || ctx.Err() != nil {
+				break
+			}
+			logMessage(userID, username, "fallback", fmt.Sprintf("Model %s failed, falling back to %s", model, candidate))
+			if onFallback != nil {
+				onFallback(candidate)
+			}
+		}
+
+		for attempt := 0; ; attempt++ {
+			resp, err := call(candidate)
+			if err == nil {
+				resp.Model = candidate
+				return resp, nil
+			}
+			lastErr = err
+
+			if attempt >= config.MaxRetries || !isRetryableError(err) || ctx.Err() != nil {
+				break
+			}
+
+			delay := backoffDelay(attempt, err)
+			logMessage(userID, username, "retry", fmt.Sprintf("[%s] Attempt %d failed: %v, retrying in %s", candidate, attempt+1, err, delay))
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+	return nil, lastErr
+}
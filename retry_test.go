@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{name: "empty", value: "", wantMin: 0, wantMax: 0},
+		{name: "seconds", value: "30", wantMin: 30 * time.Second, wantMax: 30 * time.Second},
+		{name: "zero seconds", value: "0", wantMin: 0, wantMax: 0},
+		{name: "negative seconds", value: "-5", wantMin: 0, wantMax: 0},
+		{name: "garbage", value: "soon", wantMin: 0, wantMax: 0},
+		{
+			name:    "future date",
+			value:   time.Now().Add(time.Minute).UTC().Format(http.TimeFormat),
+			wantMin: 58 * time.Second,
+			wantMax: time.Minute,
+		},
+		{
+			name:    "past date",
+			value:   time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat),
+			wantMin: 0,
+			wantMax: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRetryAfter(tt.value)
+			if got < tt.wantMin || got > tt.wantMax {
+				t.Errorf("parseRetryAfter(%q) = %v, want between %v and %v", tt.value, got, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
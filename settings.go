@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/go-redis/redis/v8"
+)
+
+// settingsLimitsKey holds the ranges admins allow for every generation parameter
+const settingsLimitsKey = "settings:limits"
+
+// defaultSettingsScope is the settings scope that applies to all models
+const defaultSettingsScope = "default"
+
+// GenerationSettings holds the sampling parameters of a chat completion request.
+// Unset values are left to the provider's defaults.
+type GenerationSettings struct {
+	Temperature      *float64
+	TopP             *float64
+	FrequencyPenalty *float64
+	Seed             *int
+	ReasoningEffort  string
+	ReasoningTokens  int // Token budget for the reasoning of thinking models
+	MaxTokens        int
+}
+
+// generationParam describes a parameter that users can change with /settings
+type generationParam struct {
+	Name    string // Used in Redis, callback data and commands
+	Label   string
+	Min     float64
+	Max     float64
+	Integer bool
+	Levels  []string // Values of non-numeric parameters from lowest to highest
+	Choices []string // Values offered as buttons
+}
+
+var generationParams = []generationParam{
+	{Name: "temperature", Label: "Temperature", Min: 0, Max: 2, Choices: []string{"0", "0.3", "0.7", "1", "1.5"}},
+	{Name: "top_p", Label: "Top P", Min: 0, Max: 1, Choices: []string{"0.5", "0.8", "0.9", "0.95", "1"}},
+	{Name: "frequency_penalty", Label: "Frequency penalty", Min: -2, Max: 2, Choices: []string{"-0.5", "0", "0.3", "0.6", "1"}},
+	{Name: "seed", Label: "Seed", Min: 0, Max: math.MaxInt32, Integer: true, Choices: []string{"0", "1", "42", "1234"}},
+	{Name: "reasoning_effort", Label: "Reasoning effort", Levels: []string{"low", "medium", "high"}, Choices: []string{"low", "medium", "high"}},
+	{Name: "reasoning_tokens", Label: "Reasoning budget", Min: 1, Max: 128000, Integer: true, Choices: []string{"1024", "4000", "8000", "16000"}},
+	{Name: "max_tokens", Label: "Max tokens", Min: 1, Max: 128000, Integer: true, Choices: []string{"500", "1000", "2000", "4000", "8000"}},
+}
+
+// findGenerationParam returns the parameter with the given name
+func findGenerationParam(name string) (generationParam, bool) {
+	for _, param := range generationParams {
+		if param.Name == name {
+			return param, true
+		}
+	}
+	return generationParam{}, false
+}
+
+// parse converts a value to a number, levels are converted to their index
+func (p generationParam) parse(value string) (float64, error) {
+	if p.Levels != nil {
+		for i, level := range p.Levels {
+			if strings.EqualFold(level, value) {
+				return float64(i), nil
+			}
+		}
+		return 0, fmt.Errorf("%s must be one of %s", p.Name, strings.Join(p.Levels, ", "))
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(number) {
+		return 0, fmt.Errorf("%s must be a number", p.Name)
+	}
+	if p.Integer && number != math.Trunc(number) {
+		return 0, fmt.Errorf("%s must be a whole number", p.Name)
+	}
+	if number < p.Min || number > p.Max {
+		return 0, fmt.Errorf("%s must be between %s and %s", p.Name, p.format(p.Min), p.format(p.Max))
+	}
+	return number, nil
+}
+
+// format is the inverse of parse
+func (p generationParam) format(value float64) string {
+	if p.Levels != nil {
+		return p.Levels[int(value)]
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// paramRange is the range of values admins allow for a parameter
+type paramRange struct {
+	Min float64
+	Max float64
+}
+
+func (r paramRange) clamp(value float64) float64 {
+	return math.Max(r.Min, math.Min(r.Max, value))
+}
+
+func userSettingsKey(userID int64, scope string) string {
+	return fmt.Sprintf("user:%d:settings:%s", userID, scope)
+}
+
+func settingsScopeKey(userID int64) string {
+	return fmt.Sprintf("user:%d:settings_scope", userID)
+}
+
+// getSettingsLimits returns the allowed range of every parameter, narrowed by the admins' limits
+func getSettingsLimits(ctx context.Context) (map[string]paramRange, error) {
+	limits := make(map[string]paramRange)
+	for _, param := range generationParams {
+		limits[param.Name] = paramRange{Min: param.Min, Max: param.Max}
+		if param.Levels != nil {
+			limits[param.Name] = paramRange{Min: 0, Max: float64(len(param.Levels) - 1)}
+		}
+	}
+
+	stored, err := rdb.HGetAll(ctx, settingsLimitsKey).Result()
+	if err != nil && err != redis.Nil {
+		return limits, fmt.Errorf("redis get error: %w", err)
+	}
+	for name, value := range stored {
+		param, ok := findGenerationParam(name)
+		if !ok {
+			continue
+		}
+		bounds := strings.Fields(value)
+		if len(bounds) != 2 {
+			continue
+		}
+		low, errLow := param.parse(bounds[0])
+		high, errHigh := param.parse(bounds[1])
+		if errLow == nil && errHigh == nil {
+			limits[name] = paramRange{Min: low, Max: high}
+		}
+	}
+	return limits, nil
+}
+
+// getSettingsValues returns the values a user set for a scope
+func getSettingsValues(ctx context.Context, userID int64, scope string) (map[string]string, error) {
+	values, err := rdb.HGetAll(ctx, userSettingsKey(userID, scope)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis get error: %w", err)
+	}
+	return values, nil
+}
+
+// getGenerationSettings returns the parameters for a user's requests to a model: the user's
+// settings for all models, overridden by the settings for this model, clamped to the admins'
+// limits. On errors the defaults are returned together with the error.
+func getGenerationSettings(ctx context.Context, userID int64, model string) (GenerationSettings, error) {
+	settings := GenerationSettings{MaxTokens: maxResponseTokens}
+
+	values, err := getSettingsValues(ctx, userID, defaultSettingsScope)
+	if err != nil {
+		return settings, err
+	}
+	overrides, err := getSettingsValues(ctx, userID, model)
+	if err != nil {
+		return settings, err
+	}
+	for name, value := range overrides {
+		values[name] = value
+	}
+	limits, err := getSettingsLimits(ctx)
+	if err != nil {
+		return settings, err
+	}
+
+	// The default answer length has to respect the limits as well
+	if _, ok := values["max_tokens"]; !ok {
+		values["max_tokens"] = strconv.Itoa(maxResponseTokens)
+	}
+
+	for _, param := range generationParams {
+		value, ok := values[param.Name]
+		if !ok {
+			continue
+		}
+		number, err := param.parse(value)
+		if err != nil {
+			continue
+		}
+		number = limits[param.Name].clamp(number)
+
+		switch param.Name {
+		case "temperature":
+			settings.Temperature = &number
+		case "top_p":
+			settings.TopP = &number
+		case "frequency_penalty":
+			settings.FrequencyPenalty = &number
+		case "seed":
+			seed := int(number)
+			settings.Seed = &seed
+		case "reasoning_effort":
+			settings.ReasoningEffort = param.format(number)
+		case "reasoning_tokens":
+			settings.ReasoningTokens = int(number)
+		case "max_tokens":
+			settings.MaxTokens = int(number)
+		}
+	}
+	return settings, nil
+}
+
+// setGenerationParam validates and stores a parameter for a scope, an empty value removes it
+func setGenerationParam(ctx context.Context, userID int64, scope string, name string, value string) error {
+	param, ok := findGenerationParam(name)
+	if !ok {
+		return fmt.Errorf("unknown setting %s", name)
+	}
+	key := userSettingsKey(userID, scope)
+	if value == "" {
+		return rdb.HDel(ctx, key, name).Err()
+	}
+
+	number, err := param.parse(value)
+	if err != nil {
+		return err
+	}
+	limits, err := getSettingsLimits(ctx)
+	if err != nil {
+		return err
+	}
+	if limit := limits[name]; number < limit.Min || number > limit.Max {
+		return fmt.Errorf("%s must be between %s and %s", name, param.format(limit.Min), param.format(limit.Max))
+	}
+	return rdb.HSet(ctx, key, name, param.format(number)).Err()
+}
+
+// getSettingsScope returns the scope the user is editing in the /settings menu
+func getSettingsScope(ctx context.Context, userID int64) string {
+	scope, err := rdb.Get(ctx, settingsScopeKey(userID)).Result()
+	if err != nil || scope == "" {
+		return defaultSettingsScope
+	}
+	return scope
+}
+
+// getSortedUserModels returns the user's selected models in a stable order,
+// so they can be referenced by index in callback data
+func getSortedUserModels(ctx context.Context, userID int64) []string {
+	models, err := getUserModels(ctx, userID)
+	if err != nil {
+		models = []string{config.OpenRouterModel}
+	}
+	sort.Strings(models)
+	return models
+}
+
+func scopeName(scope string) string {
+	if scope == defaultSettingsScope {
+		return "all models"
+	}
+	return scope
+}
+
+// settingsMenu renders the overview of a scope with a button for every parameter
+func settingsMenu(ctx context.Context, userID int64, scope string) (string, gotgbot.InlineKeyboardMarkup) {
+	defaults, _ := getSettingsValues(ctx, userID, defaultSettingsScope)
+	values, _ := getSettingsValues(ctx, userID, scope)
+	limits, _ := getSettingsLimits(ctx)
+
+	text := fmt.Sprintf("⚙️ Settings for %s\n", scopeName(scope))
+	var buttons [][]gotgbot.InlineKeyboardButton
+	for _, param := range generationParams {
+		value, ok := values[param.Name]
+		switch {
+		case ok:
+		case scope != defaultSettingsScope && defaults[param.Name] != "":
+			value = defaults[param.Name] + " (all models)"
+		case param.Name == "max_tokens":
+			value = strconv.Itoa(maxResponseTokens) + " (default)"
+		default:
+			value = "default"
+		}
+		text += fmt.Sprintf("\n%s: %s", param.Label, value)
+		if limit := limits[param.Name]; limit.Min > param.Min || (param.Levels == nil && limit.Max < param.Max) ||
+			(param.Levels != nil && int(limit.Max) < len(param.Levels)-1) {
+			text += fmt.Sprintf(" [allowed %s to %s]", param.format(limit.Min), param.format(limit.Max))
+		}
+
+		buttons = append(buttons, []gotgbot.InlineKeyboardButton{
+			{Text: param.Label, CallbackData: "settings:param:" + param.Name},
+		})
+	}
+
+	buttons = append(buttons, []gotgbot.InlineKeyboardButton{
+		{Text: "🔀 Other model", CallbackData: "settings:scopes"},
+		{Text: "✨ Done", CallbackData: "settings:done"},
+	})
+	return text, gotgbot.InlineKeyboardMarkup{InlineKeyboard: buttons}
+}
+
+// paramMenu renders the choices for a single parameter
+func paramMenu(ctx context.Context, userID int64, scope string, param generationParam) (string, gotgbot.InlineKeyboardMarkup) {
+	values, _ := getSettingsValues(ctx, userID, scope)
+	limits, _ := getSettingsLimits(ctx)
+	limit := limits[param.Name]
+
+	current := values[param.Name]
+	if current == "" {
+		current = "not set"
+	}
+	text := fmt.Sprintf("⚙️ %s for %s: %s\n\nChoose a value or send /settings set %s <value>. "+
+		"Allowed: %s to %s.", param.Label, scopeName(scope), current, param.Name, param.format(limit.Min), param.format(limit.Max))
+
+	var row []gotgbot.InlineKeyboardButton
+	for _, choice := range param.Choices {
+		if number, err := param.parse(choice); err != nil || number < limit.Min || number > limit.Max {
+			continue
+		}
+		label := choice
+		if choice == values[param.Name] {
+			label = "✅ " + choice
+		}
+		row = append(row, gotgbot.InlineKeyboardButton{Text: label, CallbackData: fmt.Sprintf("settings:set:%s:%s", param.Name, choice)})
+	}
+	buttons := [][]gotgbot.InlineKeyboardButton{row}
+	buttons = append(buttons, []gotgbot.InlineKeyboardButton{
+		{Text: "↩️ Unset", CallbackData: "settings:set:" + param.Name + ":"},
+		{Text: "⬅️ Back", CallbackData: "settings:back"},
+	})
+	return text, gotgbot.InlineKeyboardMarkup{InlineKeyboard: buttons}
+}
+
+func handleSettings(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	args := strings.Fields(msg.Text)[1:]
+	if len(args) > 0 {
+		text := updateSettings(context.Background(), userID, username, args)
+		_, err = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	// The menu always starts with the settings for all models
+	if err := rdb.Del(context.Background(), settingsScopeKey(userID)).Err(); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to reset settings scope: %v", err))
+	}
+	text, keyboard := settingsMenu(context.Background(), userID, defaultSettingsScope)
+	if isAdmin(userID) {
+		text += "\n\nAdmin commands:\n" +
+			"/settings limit <setting> <min> <max> - Restrict a setting for everyone\n" +
+			"/settings unlimit <setting> - Remove the restriction"
+	}
+	_, err = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+		ReplyMarkup: keyboard,
+	})
+	return err
+}
+
+// updateSettings handles the text forms of /settings and returns the answer for the user
+func updateSettings(ctx context.Context, userID int64, username string, args []string) string {
+	const usage = "Usage:\n/settings set [model] <setting> <value>\n/settings unset [model] <setting>\n/settings reset [model]\n" +
+		"Settings: temperature, top_p, frequency_penalty, seed, reasoning_effort, reasoning_tokens, max_tokens"
+
+	switch args[0] {
+	case "set", "unset":
+		value := ""
+		rest := args[1:]
+		if args[0] == "set" {
+			if len(rest) < 2 {
+				return usage
+			}
+			value, rest = rest[len(rest)-1], rest[:len(rest)-1]
+		}
+		scope := getSettingsScope(ctx, userID)
+		switch len(rest) {
+		case 1:
+		case 2:
+			scope = rest[0]
+		default:
+			return usage
+		}
+		if err := setGenerationParam(ctx, userID, scope, rest[len(rest)-1], value); err != nil {
+			return fmt.Sprintf("Sorry, %v.", err)
+		}
+		logMessage(userID, username, "settings", fmt.Sprintf("Set %s to %q for %s", rest[len(rest)-1], value, scope))
+		if value == "" {
+			return fmt.Sprintf("%s is no longer set for %s.", rest[len(rest)-1], scopeName(scope))
+		}
+		return fmt.Sprintf("%s is now %s for %s.", rest[len(rest)-1], value, scopeName(scope))
+
+	case "reset":
+		scope := defaultSettingsScope
+		if len(args) > 1 {
+			scope = args[1]
+		}
+		if err := rdb.Del(ctx, userSettingsKey(userID, scope)).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to reset settings: %v", err))
+			return "Sorry, I encountered an error resetting your settings."
+		}
+		logMessage(userID, username, "settings", fmt.Sprintf("Reset settings for %s", scope))
+		return fmt.Sprintf("Your settings for %s were reset.", scopeName(scope))
+
+	case "limit", "unlimit":
+		if !isAdmin(userID) {
+			logMessage(userID, username, "access_denied", "User is not an admin")
+			return "Sorry, only admins can restrict settings."
+		}
+		if len(args) < 2 {
+			return "Usage:\n/settings limit <setting> <min> <max>\n/settings unlimit <setting>"
+		}
+		param, ok := findGenerationParam(args[1])
+		if !ok {
+			return "Unknown setting: " + args[1]
+		}
+		if args[0] == "unlimit" {
+			if err := rdb.HDel(ctx, settingsLimitsKey, param.Name).Err(); err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("Failed to remove limit: %v", err))
+				return "Sorry, I encountered an error updating the limits."
+			}
+			logMessage(userID, username, "settings", fmt.Sprintf("Removed limit of %s", param.Name))
+			return fmt.Sprintf("%s is no longer restricted.", param.Name)
+		}
+		if len(args) != 4 {
+			return "Usage: /settings limit <setting> <min> <max>"
+		}
+		low, err := param.parse(args[2])
+		if err != nil {
+			return fmt.Sprintf("Sorry, %v.", err)
+		}
+		high, err := param.parse(args[3])
+		if err != nil {
+			return fmt.Sprintf("Sorry, %v.", err)
+		}
+		if low > high {
+			return "The minimum must not be larger than the maximum."
+		}
+		limit := param.format(low) + " " + param.format(high)
+		if err := rdb.HSet(ctx, settingsLimitsKey, param.Name, limit).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to set limit: %v", err))
+			return "Sorry, I encountered an error updating the limits."
+		}
+		logMessage(userID, username, "settings", fmt.Sprintf("Limited %s to %s", param.Name, limit))
+		return fmt.Sprintf("%s is now limited to %s to %s for everyone.", param.Name, param.format(low), param.format(high))
+	}
+	return usage
+}
+
+// handleSettingsCallback handles the buttons of the /settings menu, data is the callback data without "settings:"
+func handleSettingsCallback(b *gotgbot.Bot, callback *gotgbot.CallbackQuery, userID int64, username string, data string) error {
+	msg := callback.Message
+	if msg == nil {
+		return fmt.Errorf("callback message is nil")
+	}
+	bg := context.Background()
+	scope := getSettingsScope(bg, userID)
+
+	var text string
+	var keyboard gotgbot.InlineKeyboardMarkup
+	action, arg, _ := strings.Cut(data, ":")
+	switch action {
+	case "done":
+		text, _ = settingsMenu(bg, userID, scope)
+
+	case "back":
+		text, keyboard = settingsMenu(bg, userID, scope)
+
+	case "scopes":
+		text = "Choose the model to change the settings for. Settings for a model override the ones for all models."
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []gotgbot.InlineKeyboardButton{
+			{Text: "All models", CallbackData: "settings:scope:all"},
+		})
+		for i, model := range getSortedUserModels(bg, userID) {
+			keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []gotgbot.InlineKeyboardButton{
+				{Text: model, CallbackData: fmt.Sprintf("settings:scope:%d", i)},
+			})
+		}
+
+	case "scope":
+		scope = defaultSettingsScope
+		if arg != "all" {
+			// Models are referenced by index, their IDs may not fit into the callback data
+			models := getSortedUserModels(bg, userID)
+			index, err := strconv.Atoi(arg)
+			if err != nil || index < 0 || index >= len(models) {
+				_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "This model is no longer selected", ShowAlert: true})
+				return err
+			}
+			scope = models[index]
+		}
+		if err := rdb.Set(bg, settingsScopeKey(userID), scope, 0).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to save settings scope: %v", err))
+		}
+		text, keyboard = settingsMenu(bg, userID, scope)
+
+	case "param":
+		param, ok := findGenerationParam(arg)
+		if !ok {
+			return fmt.Errorf("unknown setting %s", arg)
+		}
+		text, keyboard = paramMenu(bg, userID, scope, param)
+
+	case "set":
+		name, value, _ := strings.Cut(arg, ":")
+		if err := setGenerationParam(bg, userID, scope, name, value); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to save setting %s: %v", name, err))
+			_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: fmt.Sprintf("Error saving setting: %v", err), ShowAlert: true})
+			return err
+		}
+		logMessage(userID, username, "settings", fmt.Sprintf("Set %s to %q for %s", name, value, scope))
+		text, keyboard = settingsMenu(bg, userID, scope)
+
+	default:
+		return nil
+	}
+
+	_, _, err := b.EditMessageText(text, &gotgbot.EditMessageTextOpts{
+		ChatId:      msg.GetChat().Id,
+		MessageId:   msg.GetMessageId(),
+		ReplyMarkup: keyboard,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Acknowledge the callback without showing alert
+	_, err = callback.Answer(b, nil)
+	return err
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// streamEditInterval is the minimum delay between two edits of a streaming reply.
+// Telegram rate-limits message edits, so we can't update on every chunk.
+const streamEditInterval = 1500 * time.Millisecond
+
+// maxMessageLength leaves some room for formatting below Telegram's 4096 characters limit
+const maxMessageLength = 4000
+
+// streamingReply is a bot message that is progressively edited while a model streams its answer
+type streamingReply struct {
+	bot       *gotgbot.Bot
+	chatID    int64
+	messageID int64
+	model     string   // Requested model
+	answerBy  string   // Model that is actually answering, differs from model after a fallback
+	label     string   // Shown instead of the model names to hide which model answers
+	persona   string   // Active persona, shown next to the model name
+	notes     []string // Shown below the title, e.g. the documents the answer is about
+	traces    []string // Tool calls made while answering
+	previous  []int64  // Further messages of a previous answer that are reused for this one
+	lastEdit  time.Time
+	lastText  string
+}
+
+// startStreamingReply sends a placeholder reply to msg that will later be filled with the model output.
+// persona and notes are shown next to and below the model name for the whole lifetime of the reply,
+// and label (optional) is shown instead of the model name.
+// The placeholder has no reply keyboard, the one the user already has stays in place, so that
+// inline buttons can be added to the answer later.
+func startStreamingReply(b *gotgbot.Bot, msg *gotgbot.Message, model string, label string, persona string, notes []string) (*streamingReply, error) {
+	reply := &streamingReply{
+		bot:      b,
+		model:    model,
+		answerBy: model,
+		label:    label,
+		persona:  persona,
+		notes:    notes,
+	}
+
+	placeholder := fmt.Sprintf("%s\n\n⏳ Thinking...", reply.header())
+	resp, err := msg.Reply(b, placeholder, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send placeholder message: %w", err)
+	}
+
+	reply.chatID = resp.Chat.Id
+	reply.messageID = resp.MessageId
+	reply.lastEdit = time.Now()
+	reply.lastText = placeholder
+	return reply, nil
+}
+
+// replaceStreamingReply turns the messages of a previous answer into a streaming reply, so the new
+// answer is shown in their place. The first message becomes the placeholder, the others are reused
+// for the parts of the new answer or deleted on Finish.
+func replaceStreamingReply(b *gotgbot.Bot, chatID int64, messageIDs []int64, model string, label string, persona string, notes []string) (*streamingReply, error) {
+	reply := &streamingReply{
+		bot:       b,
+		chatID:    chatID,
+		messageID: messageIDs[0],
+		model:     model,
+		answerBy:  model,
+		label:     label,
+		persona:   persona,
+		notes:     notes,
+		previous:  messageIDs[1:],
+	}
+
+	// Editing the text without buttons also removes the buttons of the previous answer
+	placeholder := fmt.Sprintf("%s\n\n⏳ Thinking...", reply.header())
+	if _, _, err := b.EditMessageText(placeholder, &gotgbot.EditMessageTextOpts{
+		ChatId:    chatID,
+		MessageId: reply.messageID,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to replace previous answer: %w", err)
+	}
+
+	reply.lastEdit = time.Now()
+	reply.lastText = placeholder
+	return reply, nil
+}
+
+// title returns the model name shown above the answer
+func (s *streamingReply) title() string {
+	if s.label != "" {
+		return s.label
+	}
+	if s.answerBy != s.model {
+		return fmt.Sprintf("%s (fallback for %s)", s.answerBy, s.model)
+	}
+	return s.model
+}
+
+// SetModel switches the reply to a fallback model, discarding any partial output
+func (s *streamingReply) SetModel(model string) {
+	s.answerBy = model
+	s.edit(fmt.Sprintf("%s\n\n⏳ Thinking...", s.header()), "")
+}
+
+// AddTrace shows a tool call above the answer. Tool calls happen between model calls,
+// so the trace is shown right away instead of waiting for the next chunk.
+func (s *streamingReply) AddTrace(trace string) {
+	s.traces = append(s.traces, trace)
+	s.edit(fmt.Sprintf("%s\n\n⏳ Thinking...", s.header()), "")
+}
+
+// header returns the title followed by the notes and tool call traces, if any
+func (s *streamingReply) header() string {
+	header := s.title()
+	if s.persona != "" {
+		header += " · 🎭 " + s.persona
+	}
+	if len(s.notes) > 0 {
+		header += "\n" + strings.Join(s.notes, "\n")
+	}
+	if len(s.traces) > 0 {
+		header += "\n\n" + strings.Join(s.traces, "\n")
+	}
+	return header
+}
+
+// Update shows the partial response, but not more often than streamEditInterval.
+// Partial output is sent as plain text since it may contain unbalanced markdown.
+func (s *streamingReply) Update(content string) {
+	if time.Since(s.lastEdit) < streamEditInterval {
+		return
+	}
+
+	text := fmt.Sprintf("%s\n\n%s ▌", s.header(), content)
+	if len(text) > maxMessageLength {
+		// Keep the beginning visible, the full answer is sent on Finish. The cut is made
+		// at a character boundary, Telegram rejects invalid UTF-8.
+		cut := maxMessageLength
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut] + "…"
+	}
+	s.edit(text, "")
+}
+
+// Fail replaces the placeholder with an error message
+func (s *streamingReply) Fail(errText string) {
+	s.edit(fmt.Sprintf("%s\n\n%s", s.header(), errText), "")
+}
+
+// MessageID returns the ID of the first message of the reply
+func (s *streamingReply) MessageID() int64 {
+	return s.messageID
+}
+
+// Finish replaces the placeholder with the final markdown-formatted answer.
+// Answers that don't fit into one message are continued in new messages, buttons
+// are shown below the last one. It returns the IDs of all messages that make up the answer.
+func (s *streamingReply) Finish(content string, buttons [][]gotgbot.InlineKeyboardButton) ([]int64, error) {
+	// Format response with model name in italics
+	// Notes and traces are not markdown, escape them so they show as they are
+	title := fmt.Sprintf("_%s_", s.title())
+	if s.persona != "" {
+		title += " · 🎭 " + escapeMarkdown(s.persona)
+	}
+	header := title
+	for _, note := range s.notes {
+		header += "\n" + escapeMarkdown(note)
+	}
+	if len(s.traces) > 0 {
+		header += "\n"
+		for _, trace := range s.traces {
+			header += "\n" + escapeMarkdown(trace)
+		}
+	}
+	parts := splitAnswer(title, header, content, maxMessageLength)
+
+	s.edit(parts[0], "Markdown")
+	messageIDs := []int64{s.messageID}
+
+	markup := gotgbot.InlineKeyboardMarkup{InlineKeyboard: buttons}
+	if len(parts) == 1 && len(buttons) > 0 {
+		if _, _, err := s.bot.EditMessageReplyMarkup(&gotgbot.EditMessageReplyMarkupOpts{
+			ChatId:      s.chatID,
+			MessageId:   s.messageID,
+			ReplyMarkup: markup,
+		}); err != nil {
+			return messageIDs, fmt.Errorf("failed to add buttons: %w", err)
+		}
+	}
+
+	for i, part := range parts[1:] {
+		last := i == len(parts)-2 && len(buttons) > 0
+		if i < len(s.previous) {
+			if err := s.editPart(s.previous[i], part, last, markup); err != nil {
+				return messageIDs, fmt.Errorf("failed to edit message part %d: %w", i+2, err)
+			}
+			messageIDs = append(messageIDs, s.previous[i])
+			continue
+		}
+
+		opts := &gotgbot.SendMessageOpts{ParseMode: "Markdown"}
+		if last {
+			opts.ReplyMarkup = markup
+		}
+		resp, err := s.bot.SendMessage(s.chatID, part, opts)
+		if err != nil {
+			// Model output is not always valid markdown, retry as plain text
+			opts.ParseMode = ""
+			resp, err = s.bot.SendMessage(s.chatID, part, opts)
+		}
+		if err != nil {
+			return messageIDs, fmt.Errorf("failed to send message part %d: %w", i+2, err)
+		}
+		messageIDs = append(messageIDs, resp.MessageId)
+	}
+
+	// Parts of a previous answer that the new one doesn't need are removed
+	if len(parts)-1 < len(s.previous) {
+		for _, messageID := range s.previous[len(parts)-1:] {
+			if _, err := s.bot.DeleteMessage(s.chatID, messageID, nil); err != nil {
+				log.Printf("[Error] Failed to delete message %d of a previous answer: %v", messageID, err)
+			}
+		}
+	}
+
+	return messageIDs, nil
+}
+
+// splitAnswer splits an answer into messages of at most maxLength characters. The first one
+// starts with the full header, the others only with the title line of it.
+func splitAnswer(title string, header string, content string, maxLength int) []string {
+	chunks := chunkText(content, maxLength-utf8.RuneCountInString(title)-2)
+	if len(chunks) == 0 {
+		return []string{header}
+	}
+
+	// Notes and traces make the first message's header longer, so its chunk may have to be split again
+	firstLength := maxLength - utf8.RuneCountInString(header) - 2
+	if firstLength < 1 {
+		firstLength = 1
+	}
+	first := chunkText(chunks[0], firstLength)
+	parts := []string{header + "\n\n" + first[0]}
+	for _, chunk := range append(first[1:], chunks[1:]...) {
+		parts = append(parts, title+"\n\n"+chunk)
+	}
+	return parts
+}
+
+// editPart replaces a further message of a previous answer with a part of the new answer,
+// withButtons shows the buttons below it
+func (s *streamingReply) editPart(messageID int64, text string, withButtons bool, markup gotgbot.InlineKeyboardMarkup) error {
+	opts := &gotgbot.EditMessageTextOpts{ChatId: s.chatID, MessageId: messageID, ParseMode: "Markdown"}
+	if withButtons {
+		opts.ReplyMarkup = markup
+	}
+	_, _, err := s.bot.EditMessageText(text, opts)
+	if err != nil {
+		// Model output is not always valid markdown, retry as plain text
+		opts.ParseMode = ""
+		_, _, err = s.bot.EditMessageText(text, opts)
+	}
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		// The part is the same as before
+		return nil
+	}
+	return err
+}
+
+func (s *streamingReply) edit(text string, parseMode string) {
+	if text == s.lastText {
+		return
+	}
+
+	_, _, err := s.bot.EditMessageText(text, &gotgbot.EditMessageTextOpts{
+		ChatId:    s.chatID,
+		MessageId: s.messageID,
+		ParseMode: parseMode,
+	})
+	if err != nil && parseMode != "" {
+		// Model output is not always valid markdown, retry as plain text
+		_, _, err = s.bot.EditMessageText(text, &gotgbot.EditMessageTextOpts{
+			ChatId:    s.chatID,
+			MessageId: s.messageID,
+		})
+	}
+	if err != nil {
+		log.Printf("[Error] Failed to edit streaming message %d: %v", s.messageID, err)
+		return
+	}
+
+	s.lastEdit = time.Now()
+	s.lastText = text
+}
+
+// escapeMarkdown escapes the characters that have a meaning in Telegram's legacy Markdown
+func escapeMarkdown(text string) string {
+	return strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[").Replace(text)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitAnswer(t *testing.T) {
+	a := strings.Repeat("a", 10)
+	b := strings.Repeat("b", 10)
+	c := strings.Repeat("c", 10)
+
+	tests := []struct {
+		name      string
+		title     string
+		header    string
+		content   string
+		maxLength int
+		want      []string
+	}{
+		{
+			name:      "fits",
+			title:     "_m_",
+			header:    "_m_",
+			content:   "short answer",
+			maxLength: 30,
+			want:      []string{"_m_\n\nshort answer"},
+		},
+		{
+			name:      "empty answer",
+			title:     "_m_",
+			header:    "_m_\n📄 a.pdf",
+			content:   "",
+			maxLength: 30,
+			want:      []string{"_m_\n📄 a.pdf"},
+		},
+		{
+			name:      "splits between lines",
+			title:     "_m_",
+			header:    "_m_",
+			content:   a + "\n" + b + "\n" + c,
+			maxLength: 30,
+			want:      []string{"_m_\n\n" + a + "\n" + b, "_m_\n\n" + c},
+		},
+		{
+			name:      "keeps every note in the first part",
+			title:     "_m_",
+			header:    "_m_\n📄 a.pdf\n⚖️ Synthesis",
+			content:   a + "\n" + b + "\n" + c,
+			maxLength: 40,
+			want:      []string{"_m_\n📄 a.pdf\n⚖️ Synthesis\n\n" + a, "_m_\n\n" + b, "_m_\n\n" + c},
+		},
+		{
+			name:      "splits a line over the limit",
+			title:     "_m_",
+			header:    "_m_",
+			content:   strings.Repeat("x", 45),
+			maxLength: 20,
+			want: []string{
+				"_m_\n\n" + strings.Repeat("x", 15),
+				"_m_\n\n" + strings.Repeat("x", 15),
+				"_m_\n\n" + strings.Repeat("x", 15),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitAnswer(tt.title, tt.header, tt.content, tt.maxLength)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitAnswer() = %q, want %q", got, tt.want)
+			}
+			for i, part := range got {
+				if n := utf8.RuneCountInString(part); n > tt.maxLength {
+					t.Errorf("part %d has %d characters, more than %d", i, n, tt.maxLength)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+)
+
+// summaryPrefix starts the content of summary messages, so models know what they are reading
+const summaryPrefix = "Summary of the earlier conversation:\n"
+
+// getSummary returns the summary message of a history, or nil if it has none
+func getSummary(history []Message) *Message {
+	for i := range history {
+		if history[i].Summary {
+			return &history[i]
+		}
+	}
+	return nil
+}
+
+// summarizeHistory condenses all but the latest config.SummaryKeepTurns turns of a conversation,
+// together with an earlier summary, into a new summary message placed after the system prompt.
+// Unless force is set, this only happens once the history is longer than config.SummaryThreshold
+// tokens. It returns the history unchanged and false if there was nothing to summarize.
+func summarizeHistory(ctx context.Context, userID int64, username string, model string, history []Message, force bool) ([]Message, bool, error) {
+	if !force {
+		if config.SummaryThreshold <= 0 {
+			return history, false, nil
+		}
+		total := 0
+		for _, msg := range history {
+			total += estimateTokens(msg)
+		}
+		if total <= config.SummaryThreshold {
+			return history, false, nil
+		}
+	}
+
+	// Split the history into the system prompt, the current summary and the turns
+	var system []Message
+	var previous *Message
+	var turnStarts []int
+	for i, msg := range history {
+		switch {
+		case msg.Summary:
+			previous = &history[i]
+		case msg.Role == "user":
+			turnStarts = append(turnStarts, i)
+		case msg.Role == "system" && len(turnStarts) == 0:
+			system = append(system, msg)
+		}
+	}
+	if len(turnStarts) <= config.SummaryKeepTurns {
+		return history, false, nil
+	}
+	keepFrom := len(history)
+	if config.SummaryKeepTurns > 0 {
+		keepFrom = turnStarts[len(turnStarts)-config.SummaryKeepTurns]
+	}
+
+	// Render the old turns as a transcript
+	var transcript strings.Builder
+	for _, msg := range history[turnStarts[0]:keepFrom] {
+		if msg.Summary || msg.Role == "system" {
+			continue
+		}
+		text := msg.Content.Text()
+		if msg.Content.HasImages() {
+			text = "[image] " + text
+		}
+		for _, call := range msg.ToolCalls {
+			text += fmt.Sprintf("\n[called %s(%s)]", call.Function.Name, call.Function.Arguments)
+		}
+		role := strings.ToUpper(msg.Role[:1]) + msg.Role[1:]
+		if msg.Role == "tool" {
+			role = fmt.Sprintf("Tool %s", msg.Name)
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n\n", role, text)
+	}
+
+	prompt := "Condense the following conversation between a user and an AI assistant into a summary that lets the assistant " +
+		"continue the conversation. Keep the user's goals, decisions, facts, numbers, names and open questions. " +
+		"Respond with only the summary.\n\n"
+	if previous != nil {
+		prompt += fmt.Sprintf("<earlier_summary>\n%s\n</earlier_summary>\n\n", strings.TrimPrefix(previous.Content.Text(), summaryPrefix))
+	}
+	prompt += fmt.Sprintf("<conversation>\n%s</conversation>", transcript.String())
+
+	resp, err := callModel(ctx, userID, username, []Message{{Role: "user", Content: TextContent(prompt)}}, config.SummaryModel)
+	if err != nil {
+		return history, false, err
+	}
+
+	summarized := append([]Message{}, system...)
+	summarized = append(summarized, Message{
+		Role:    "system",
+		Content: TextContent(summaryPrefix + strings.TrimSpace(resp.Content)),
+		Model:   resp.Model,
+		Summary: true,
+	})
+	summarized = append(summarized, history[keepFrom:]...)
+
+	logMessage(userID, username, "summary", fmt.Sprintf("[%s] Summarized %d messages, history now has %d messages",
+		model, keepFrom-turnStarts[0], len(summarized)))
+	return summarized, true, nil
+}
+
+// compactConversation summarizes a model's stored history if it got too long. It runs in the
+// background, so the conversation may continue meanwhile: newer messages are kept after the
+// summary, and if the history was rewound or cleared, the summary is dropped.
+func compactConversation(ctx context.Context, userID int64, username string, model string, history []Message) {
+	summarized, changed, err := summarizeHistory(ctx, userID, username, model, history, false)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to summarize history: %v", model, err))
+		return
+	}
+	if !changed {
+		return
+	}
+
+	current, err := getConversationHistory(ctx, userID, model)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to get conversation history", model))
+		return
+	}
+	if !hasHistoryPrefix(current, history) {
+		logMessage(userID, username, "debug", fmt.Sprintf("[%s] History changed while it was summarized, summary dropped", model))
+		return
+	}
+	summarized = append(summarized, current[len(history):]...)
+	if err := saveConversationHistory(ctx, userID, model, summarized); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save conversation history", model))
+	}
+}
+
+// hasHistoryPrefix reports whether history starts with the messages of prefix. Messages are
+// compared as they are stored, since the stored history went through JSON.
+func hasHistoryPrefix(history []Message, prefix []Message) bool {
+	if len(history) < len(prefix) {
+		return false
+	}
+	stored, err := json.Marshal(history[:len(prefix)])
+	if err != nil {
+		return false
+	}
+	expected, err := json.Marshal(prefix)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(stored, expected)
+}
+
+func handleSummary(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	args := strings.Fields(msg.Text)[1:]
+	force := len(args) > 0 && args[0] == "refresh"
+	if len(args) > 0 && !force {
+		_, err = msg.Reply(b, "Usage: /summary to show the summaries, /summary refresh to summarize again now.", &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	// Get user's selected models
+	selectedModels, err := getUserModels(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user models")
+		selectedModels = []string{config.OpenRouterModel} // fallback to default
+	}
+
+	for _, model := range selectedModels {
+		history, err := getConversationHistory(context.Background(), userID, model)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to get conversation history", model))
+			continue
+		}
+
+		text := ""
+		if force {
+			summarized, changed, err := summarizeHistory(context.Background(), userID, username, model, history, true)
+			if err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to summarize history: %v", model, err))
+				text = userErrorMessage(err, "Sorry, I encountered an error summarizing the conversation.")
+			} else if changed {
+				history = summarized
+				if err := saveConversationHistory(context.Background(), userID, model, history); err != nil {
+					logMessage(userID, username, "error", fmt.Sprintf("[%s] Failed to save conversation history", model))
+				}
+			} else {
+				text = fmt.Sprintf("Nothing to summarize, the latest %d turns are always kept as they are.", config.SummaryKeepTurns)
+			}
+		}
+
+		if text == "" {
+			if summary := getSummary(history); summary != nil {
+				text = "📝 " + strings.TrimPrefix(summary.Content.Text(), summaryPrefix)
+			} else {
+				text = fmt.Sprintf("No summary yet, the conversation has %d messages.", len(history))
+			}
+		}
+
+		for _, part := range splitAnswer(model, model, text, maxMessageLength) {
+			if _, err := msg.Reply(b, part, &gotgbot.SendMessageOpts{
+				ReplyMarkup: getKeyboard(userMode),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
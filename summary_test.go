@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestHasHistoryPrefix(t *testing.T) {
+	user := Message{ID: "1", Role: "user", Content: TextContent("question")}
+	answer := Message{Role: "assistant", Content: TextContent("answer"), Model: "a/one"}
+	next := Message{ID: "2", Role: "user", Content: TextContent("next question")}
+	edited := Message{ID: "1", Role: "user", Content: TextContent("edited question")}
+
+	tests := []struct {
+		name    string
+		history []Message
+		prefix  []Message
+		want    bool
+	}{
+		{name: "unchanged", history: []Message{user, answer}, prefix: []Message{user, answer}, want: true},
+		{name: "continued", history: []Message{user, answer, next}, prefix: []Message{user, answer}, want: true},
+		{name: "cleared", history: []Message{}, prefix: []Message{user, answer}, want: false},
+		{name: "rewound", history: []Message{user}, prefix: []Message{user, answer}, want: false},
+		{name: "edited", history: []Message{edited, answer}, prefix: []Message{user, answer}, want: false},
+		{name: "compared as stored", history: []Message{{Role: "user"}}, prefix: []Message{{Role: "user", Content: MessageContent{}}}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasHistoryPrefix(tt.history, tt.prefix); got != tt.want {
+				t.Errorf("hasHistoryPrefix() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
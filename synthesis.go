@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// synthesisThreadPrefix starts the conversation key of a synthesized answer, it is followed by
+// the message the synthesis answers. Replies to a synthesis continue its thread with the judge
+// model instead of one of the selected models.
+const synthesisThreadPrefix = "synthesis:"
+
+// synthesisThread returns the conversation key of the synthesis of the answers to a message
+func synthesisThread(promptID int64) string {
+	return fmt.Sprintf("%s%d", synthesisThreadPrefix, promptID)
+}
+
+// judgePrompt instructs the judge model how to merge the answers
+const judgePrompt = "You combine the answers of several AI models to the same question into one answer. " +
+	"Write the best answer to the question, using what the given answers got right. " +
+	"Then briefly note where the answers agree and where they contradict each other, and which view you followed and why. " +
+	"Answer in the language of the question."
+
+func isSynthesisEnabled() bool {
+	return config.JudgeModel != ""
+}
+
+// threadModel returns the model that continues a conversation thread
+func threadModel(thread string) string {
+	if strings.HasPrefix(thread, synthesisThreadPrefix) {
+		return config.JudgeModel
+	}
+	if strings.HasPrefix(thread, debateThreadPrefix) {
+		return debateSummaryModel()
+	}
+	if rest, ok := strings.CutPrefix(thread, pipelineThreadPrefix); ok {
+		// The pipeline name is followed by the model, model IDs may contain ":" themselves
+		_, model, _ := strings.Cut(rest, ":")
+		return model
+	}
+	return thread
+}
+
+// synthesizeAnswers has the judge model merge the answers of several models into one reply.
+// names are how the models are called in the answers, their labels in blind mode. The prompt
+// and the merged answer start the synthesis thread, so replies can continue from there.
+func synthesizeAnswers(ctx context.Context, b *gotgbot.Bot, msg *gotgbot.Message, userID int64, username string, content MessageContent, names []string, answers []string) error {
+	question := content.Text()
+	if question == "" {
+		question = "(The question was sent without text, e.g. as an image.)"
+	}
+	var request strings.Builder
+	fmt.Fprintf(&request, "Question:\n%s", question)
+	for i, answer := range answers {
+		fmt.Fprintf(&request, "\n\n--- Answer of %s ---\n%s", names[i], answer)
+	}
+
+	answer := Answer{
+		UserID:   userID,
+		Thread:   synthesisThread(msg.MessageId),
+		PromptID: msg.MessageId,
+		Request: []Message{
+			{Role: "system", Content: TextContent(judgePrompt)},
+			{Role: "user", Content: TextContent(request.String())},
+		},
+		Notes: []string{fmt.Sprintf("⚖️ Synthesis of %d answers", len(answers))},
+	}
+	if err := answerRequest(ctx, b, msg, userID, username, answer, content); err != nil {
+		return fmt.Errorf("synthesis failed: %w", err)
+	}
+	return nil
+}
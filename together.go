@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 )
 
 // ImageModelConfig stores configuration for each image generation model
@@ -49,6 +50,11 @@ func generateImage(ctx context.Context, userID int64, username string, prompt st
 	// Log the request
 	logMessage(userID, username, "image_request", prompt)
 
+	// Refuse to generate if a spending cap is reached
+	if err := checkBudget(ctx, userID); err != nil {
+		return nil, err
+	}
+
 	// Get model configuration
 	modelConfig, ok := imageModels[model]
 	if !ok {
@@ -119,6 +125,22 @@ func generateImage(ctx context.Context, userID int64, username string, prompt st
 
 	// Log success
 	logMessage(userID, username, "image_generated", "Image generated successfully")
+	recordImageUsage(userID, username, model)
 
 	return imageData, nil
 }
+
+// recordImageUsage adds a generated image to the user's cost ledger, priced with IMAGE_PRICE
+func recordImageUsage(userID int64, username string, model string) {
+	// The image is paid for once it is generated, the ledger is written even if the request was canceled
+	ctx := context.Background()
+
+	cost := config.ImagePrice
+	logMessage(userID, username, "usage", fmt.Sprintf("[%s] Generated image, Cost: $%.6f", model, cost))
+
+	if err := addUsage(ctx, userID, model, time.Now(), 1, Usage{}, cost); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to record usage: %v", err))
+		return
+	}
+	checkBudgetWarnings(ctx, userID, username)
+}
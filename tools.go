@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// toolTimeout limits how long a single tool may run
+const toolTimeout = 30 * time.Second
+
+// maxToolResultLength keeps large tool results from blowing up the context
+const maxToolResultLength = 8000
+
+// Tool is a Go function that chat models can call
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage // JSON schema of the arguments object
+	Run         func(ctx context.Context, userID int64, args json.RawMessage) (string, error)
+}
+
+// Map of tools that can be enabled through ENABLED_TOOLS
+var availableTools = map[string]*Tool{
+	"get_current_time": {
+		Name:        "get_current_time",
+		Description: "Get the current date and time, optionally in a given IANA time zone such as Europe/Berlin.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"timezone": {"type": "string", "description": "IANA time zone name, defaults to UTC"}
+			}
+		}`),
+		Run: runGetCurrentTime,
+	},
+	"calculate": {
+		Name:        "calculate",
+		Description: "Evaluate an arithmetic expression with + - * / % ^ and parentheses, e.g. (2.5 + 3) * 4^2.",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"expression": {"type": "string", "description": "The expression to evaluate"}
+			},
+			"required": ["expression"]
+		}`),
+		Run: runCalculate,
+	},
+}
+
+// getEnabledTools returns the tools to offer to a model, none if the model can't use them
+func getEnabledTools(model string) []*Tool {
+	if len(config.EnabledTools) == 0 || !modelSupportsTools(model) {
+		return nil
+	}
+	tools := make([]*Tool, 0, len(config.EnabledTools))
+	for _, name := range config.EnabledTools {
+		tools = append(tools, availableTools[name])
+	}
+	return tools
+}
+
+// modelSupportsTools reports whether tool definitions can be sent to the model.
+// OpenRouter tells us which models support tools, other providers are trusted to.
+func modelSupportsTools(model string) bool {
+	if provider, _ := parseModelID(model); provider != defaultProvider {
+		return true
+	}
+	info, ok := findModelInfo(model)
+	return ok && info.SupportsTools
+}
+
+// chatWithTools streams the model's answer and runs the tools it asks for, feeding the
+// results back until the model answers with text. The assistant tool call messages and
+// tool results are appended to history, which is returned without the final answer.
+// onToolCall receives a short trace of every tool that ran. The reasoning and usage of all
+// model calls are combined in the returned response, with estimated costs where the provider
+// didn't report one.
+func chatWithTools(ctx context.Context, userID int64, username string, history []Message, model string, onFallback func(model string), onDelta func(text string), onToolCall func(trace string)) (*ChatResponse, []Message, error) {
+	opts := ChatOptions{Tools: getEnabledTools(model)}
+	var reasoning []string
+	var usage Usage
+
+	for iteration := 1; ; iteration++ {
+		// On the last iteration the model has to answer with what it has
+		if len(opts.Tools) > 0 && iteration >= config.MaxToolIterations {
+			opts.ToolChoice = "none"
+		}
+
+		resp, err := streamModel(ctx, userID, username, history, model, opts, onFallback, onDelta)
+		if err != nil {
+			return nil, history, err
+		}
+		if resp.Reasoning != "" {
+			reasoning = append(reasoning, strings.TrimSpace(resp.Reasoning))
+		}
+		usage.PromptTokens += resp.Usage.PromptTokens
+		usage.CompletionTokens += resp.Usage.CompletionTokens
+		usage.Cost += completionCost(resp)
+		if len(resp.ToolCalls) == 0 || opts.ToolChoice == "none" {
+			resp.Reasoning = strings.Join(reasoning, "\n\n")
+			resp.Usage = usage
+			return resp, history, nil
+		}
+
+		history = append(history, Message{Role: "assistant", Content: TextContent(resp.Content), Model: resp.Model, ToolCalls: resp.ToolCalls})
+		for _, call := range resp.ToolCalls {
+			result, trace := runToolCall(ctx, userID, username, call)
+			history = append(history, Message{Role: "tool", Content: TextContent(result), ToolCallID: call.ID, Name: call.Function.Name})
+			if onToolCall != nil {
+				onToolCall(trace)
+			}
+		}
+	}
+}
+
+// runToolCall executes a single tool call and returns the result for the model
+// together with a short trace for the user
+func runToolCall(ctx context.Context, userID int64, username string, call ToolCall) (string, string) {
+	logMessage(userID, username, "tool_call", fmt.Sprintf("%s(%s)", call.Function.Name, call.Function.Arguments))
+
+	tool, ok := availableTools[call.Function.Name]
+	enabled := false
+	for _, name := range config.EnabledTools {
+		enabled = enabled || name == call.Function.Name
+	}
+	if !ok || !enabled {
+		return fmt.Sprintf("Error: unknown tool %q", call.Function.Name),
+			fmt.Sprintf("⚠️ %s: unknown tool", call.Function.Name)
+	}
+
+	args := json.RawMessage(call.Function.Arguments)
+	if strings.TrimSpace(call.Function.Arguments) == "" {
+		args = json.RawMessage("{}")
+	}
+
+	toolCtx, cancel := context.WithTimeout(ctx, toolTimeout)
+	defer cancel()
+
+	result, err := tool.Run(toolCtx, userID, args)
+	if err != nil {
+		logMessage(userID, username, "tool_error", fmt.Sprintf("%s: %v", call.Function.Name, err))
+		return "Error: " + err.Error(),
+			fmt.Sprintf("⚠️ %s(%s) failed: %s", tool.Name, truncateText(call.Function.Arguments, 60), truncateText(err.Error(), 60))
+	}
+
+	if len(result) > maxToolResultLength {
+		result = result[:maxToolResultLength] + "\n[truncated]"
+	}
+	logMessage(userID, username, "tool_result", fmt.Sprintf("%s: %s", tool.Name, truncateText(result, 200)))
+	return result, fmt.Sprintf("🔧 %s(%s) → %s", tool.Name, truncateText(call.Function.Arguments, 60), truncateText(result, 60))
+}
+
+// truncateText shortens text to at most maxLength characters for display
+func truncateText(text string, maxLength int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= maxLength {
+		return text
+	}
+	return string(runes[:maxLength]) + "…"
+}
+
+func runGetCurrentTime(ctx context.Context, userID int64, args json.RawMessage) (string, error) {
+	var params struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	location := time.UTC
+	if params.Timezone != "" {
+		loc, err := time.LoadLocation(params.Timezone)
+		if err != nil {
+			return "", fmt.Errorf("unknown time zone %q", params.Timezone)
+		}
+		location = loc
+	}
+	return time.Now().In(location).Format("Monday, 2006-01-02 15:04:05 MST"), nil
+}
+
+func runCalculate(ctx context.Context, userID int64, args json.RawMessage) (string, error) {
+	var params struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+
+	parser := &expressionParser{input: []rune(params.Expression)}
+	value, err := parser.parse()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(value, 'g', 15, 64), nil
+}
+
+// expressionParser is a recursive descent parser for arithmetic expressions:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = power { ("*" | "/" | "%") power }
+//	power      = unary [ "^" power ]
+//	unary      = [ "-" | "+" ] unary | primary
+//	primary    = number | "(" expression ")"
+type expressionParser struct {
+	input []rune
+	pos   int
+}
+
+func (p *expressionParser) parse() (float64, error) {
+	value, err := p.expression()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+	}
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("result is not a finite number")
+	}
+	return value, nil
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// accept consumes op if it is the next non-space character
+func (p *expressionParser) accept(op rune) bool {
+	p.skipSpaces()
+	if p.pos < len(p.input) && p.input[p.pos] == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *expressionParser) expression() (float64, error) {
+	value, err := p.term()
+	for err == nil {
+		if p.accept('+') {
+			var right float64
+			right, err = p.term()
+			value += right
+		} else if p.accept('-') {
+			var right float64
+			right, err = p.term()
+			value -= right
+		} else {
+			break
+		}
+	}
+	return value, err
+}
+
+func (p *expressionParser) term() (float64, error) {
+	value, err := p.power()
+	for err == nil {
+		if p.accept('*') {
+			var right float64
+			right, err = p.power()
+			value *= right
+		} else if p.accept('/') {
+			var right float64
+			right, err = p.power()
+			if err == nil && right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			value /= right
+		} else if p.accept('%') {
+			var right float64
+			right, err = p.power()
+			if err == nil && right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			value = math.Mod(value, right)
+		} else {
+			break
+		}
+	}
+	return value, err
+}
+
+func (p *expressionParser) power() (float64, error) {
+	base, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	if p.accept('^') {
+		exponent, err := p.power() // right associative
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(base, exponent), nil
+	}
+	return base, nil
+}
+
+func (p *expressionParser) unary() (float64, error) {
+	if p.accept('-') {
+		value, err := p.unary()
+		return -value, err
+	}
+	if p.accept('+') {
+		return p.unary()
+	}
+	return p.primary()
+}
+
+func (p *expressionParser) primary() (float64, error) {
+	if p.accept('(') {
+		value, err := p.expression()
+		if err != nil {
+			return 0, err
+		}
+		if !p.accept(')') {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		return value, nil
+	}
+
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos < len(p.input) {
+			return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos+1)
+		}
+		return 0, fmt.Errorf("unexpected end of expression")
+	}
+	return strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+}
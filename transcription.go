@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// maxAudioSize is the largest voice message or audio file that is transcribed.
+// Bots can't download larger files, Whisper accepts up to 25 MB.
+const maxAudioSize = 20 * 1024 * 1024
+
+// transcriptionTimeout limits a single transcription request, long recordings take a while
+const transcriptionTimeout = 2 * time.Minute
+
+// TranscriptionResponse represents the response of a Whisper-compatible transcription endpoint
+type TranscriptionResponse struct {
+	Text string `json:"text"`
+}
+
+// isTranscriptionEnabled checks if a transcription API is configured
+func isTranscriptionEnabled() bool {
+	return config.TranscriptionURL != ""
+}
+
+// getAudioFile returns the file ID and a file name of the voice message or audio file
+// attached to msg, or an empty file ID if there is none
+func getAudioFile(msg *gotgbot.Message) (string, string) {
+	if msg.Voice != nil {
+		// Voice messages are always OGG/Opus
+		return msg.Voice.FileId, "voice.ogg"
+	}
+	if msg.Audio != nil {
+		// Whisper detects the format from the file extension
+		fileName := msg.Audio.FileName
+		if fileName == "" {
+			fileName = "audio.mp3"
+		}
+		return msg.Audio.FileId, fileName
+	}
+	return "", ""
+}
+
+// transcribeAudio downloads an audio file sent to the bot and turns it into text
+func transcribeAudio(ctx context.Context, userID int64, username string, fileID string, fileName string) (string, error) {
+	if err := checkBudget(ctx, userID); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, transcriptionTimeout)
+	defer cancel()
+
+	audio, err := downloadTelegramFile(ctx, fileID, maxAudioSize)
+	if err != nil {
+		return "", fmt.Errorf("failed to download audio: %w", err)
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.WriteField("model", config.TranscriptionModel); err != nil {
+		return "", fmt.Errorf("failed to write model field: %w", err)
+	}
+	part, err := writer.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file field: %w", err)
+	}
+	if _, err := part.Write(audio); err != nil {
+		return "", fmt.Errorf("failed to write audio: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("failed to finish request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", config.TranscriptionURL+"/audio/transcriptions", &body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if config.TranscriptionAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+config.TranscriptionAPIKey)
+	}
+
+	logMessage(userID, username, "debug", fmt.Sprintf("Transcribing %s (%d bytes) with %s", fileName, len(audio), config.TranscriptionModel))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var transcription TranscriptionResponse
+	if err := json.Unmarshal(respBody, &transcription); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	text := strings.TrimSpace(transcription.Text)
+	if text == "" {
+		return "", fmt.Errorf("no speech recognized")
+	}
+
+	logMessage(userID, username, "transcription", text)
+	return text, nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/go-redis/redis/v8"
+)
+
+// generationLookupDelay is how long to wait before asking OpenRouter for a generation's cost,
+// the stats are not available right after the completion finishes
+const generationLookupDelay = 3 * time.Second
+
+// generationLookupAttempts is how often the generation endpoint is tried before giving up
+const generationLookupAttempts = 3
+
+// ModelUsage holds the accumulated usage of a single model in a ledger period
+type ModelUsage struct {
+	Requests         int64
+	PromptTokens     int64
+	CompletionTokens int64
+	Cost             float64 // USD
+}
+
+// usageKeys returns the ledger keys (day, month and all time) a usage entry at the given time belongs to
+func usageKeys(userID int64, at time.Time) []string {
+	return []string{
+		fmt.Sprintf("usage:%d:day:%s", userID, at.Format("2006-01-02")),
+		fmt.Sprintf("usage:%d:month:%s", userID, at.Format("2006-01")),
+		fmt.Sprintf("usage:%d:total", userID),
+	}
+}
+
+// addUsage adds usage of a model to the user's and the global ledger. Every ledger key is a hash
+// with "<metric>:<model>" fields, so a period can be broken down by model.
+func addUsage(ctx context.Context, userID int64, model string, at time.Time, requests int64, usage Usage, cost float64) error {
+	// The global keys are used to enforce the bot-wide budget
+	keys := append(usageKeys(userID, at), globalUsageKeys(at)...)
+
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			if requests != 0 {
+				pipe.HIncrBy(ctx, key, "requests:"+model, requests)
+			}
+			if usage.PromptTokens != 0 {
+				pipe.HIncrBy(ctx, key, "prompt_tokens:"+model, int64(usage.PromptTokens))
+			}
+			if usage.CompletionTokens != 0 {
+				pipe.HIncrBy(ctx, key, "completion_tokens:"+model, int64(usage.CompletionTokens))
+			}
+			if cost != 0 {
+				pipe.HIncrByFloat(ctx, key, "cost:"+model, cost)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// getUsage returns the per-model usage stored under a ledger key
+func getUsage(ctx context.Context, key string) (map[string]*ModelUsage, error) {
+	fields, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("redis get error: %w", err)
+	}
+
+	result := make(map[string]*ModelUsage)
+	for field, value := range fields {
+		metric, model, found := strings.Cut(field, ":")
+		if !found {
+			continue
+		}
+		if result[model] == nil {
+			result[model] = &ModelUsage{}
+		}
+		switch metric {
+		case "requests":
+			result[model].Requests, _ = strconv.ParseInt(value, 10, 64)
+		case "prompt_tokens":
+			result[model].PromptTokens, _ = strconv.ParseInt(value, 10, 64)
+		case "completion_tokens":
+			result[model].CompletionTokens, _ = strconv.ParseInt(value, 10, 64)
+		case "cost":
+			result[model].Cost, _ = strconv.ParseFloat(value, 64)
+		}
+	}
+	return result, nil
+}
+
+// findModelInfo returns the configured information (including pricing) of a model.
+// OpenRouter models picked from the catalog are looked up there.
+func findModelInfo(modelID string) (ModelInfo, bool) {
+	for _, info := range getAvailableModels() {
+		if info.ID == modelID {
+			return info, true
+		}
+	}
+	return findCatalogModel(modelID)
+}
+
+// estimateCost calculates the cost of a completion from the model's per-1M-token prices
+func estimateCost(model string, usage Usage) float64 {
+	info, ok := findModelInfo(model)
+	if !ok {
+		return 0
+	}
+	return float64(usage.PromptTokens)*info.PriceIn/1_000_000 +
+		float64(usage.CompletionTokens)*info.PriceOut/1_000_000
+}
+
+// completionCost returns the cost reported by the provider, or the estimated cost if there is none
+func completionCost(resp *ChatResponse) float64 {
+	if resp.Usage.Cost > 0 {
+		return resp.Usage.Cost
+	}
+	return estimateCost(resp.Model, resp.Usage)
+}
+
+// recordUsage adds a completion to the user's cost ledger. When the provider didn't report
+// the cost, it is estimated from the model pricing and corrected later from OpenRouter's
+// generation stats if possible.
+func recordUsage(ctx context.Context, userID int64, username string, resp *ChatResponse) {
+	now := time.Now()
+	cost := completionCost(resp)
+	exact := resp.Usage.Cost > 0
+
+	logMessage(userID, username, "usage", fmt.Sprintf("[%s] Prompt tokens: %d, Completion tokens: %d, Cost: $%.6f (exact: %t)",
+		resp.Model, resp.Usage.PromptTokens, resp.Usage.CompletionTokens, cost, exact))
+
+	if err := addUsage(ctx, userID, resp.Model, now, 1, resp.Usage, cost); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to record usage: %v", err))
+		return
+	}
+	checkBudgetWarnings(ctx, userID, username)
+
+	if provider, _ := parseModelID(resp.Model); !exact && provider == defaultProvider && resp.GenerationID != "" {
+		go correctUsageFromGeneration(userID, username, resp.Model, resp.GenerationID, now, resp.Usage, cost)
+	}
+}
+
+// recordPartialUsage adds an estimate of a stream that failed partway to the user's cost ledger.
+// Providers bill the tokens generated until then, but don't report usage for a failed stream.
+func recordPartialUsage(userID int64, username string, model string, messages []Message, partial string) {
+	// The request may have failed because it was canceled, the ledger is still written
+	ctx := context.Background()
+
+	var usage Usage
+	for _, msg := range messages {
+		usage.PromptTokens += estimateTokens(msg)
+	}
+	usage.CompletionTokens = estimateTokens(Message{Role: "assistant", Content: TextContent(partial)})
+	cost := estimateCost(model, usage)
+
+	logMessage(userID, username, "usage", fmt.Sprintf("[%s] Stream failed partway, estimated prompt tokens: %d, completion tokens: %d, cost: $%.6f",
+		model, usage.PromptTokens, usage.CompletionTokens, cost))
+
+	if err := addUsage(ctx, userID, model, time.Now(), 1, usage, cost); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to record usage: %v", err))
+		return
+	}
+	checkBudgetWarnings(ctx, userID, username)
+}
+
+// correctUsageFromGeneration replaces an estimated ledger entry with the exact numbers from OpenRouter
+func correctUsageFromGeneration(userID int64, username string, model string, generationID string, at time.Time, recorded Usage, recordedCost float64) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var stats *OpenRouterGenerationResponse
+	var err error
+	for attempt := 1; attempt <= generationLookupAttempts; attempt++ {
+		time.Sleep(generationLookupDelay * time.Duration(attempt))
+		if stats, err = fetchGenerationStats(ctx, generationID); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to fetch generation stats for %s: %v", generationID, err))
+		return
+	}
+
+	// Only add the difference to what was already recorded. Token counts are only
+	// taken over if the response had none, to avoid mixing two ways of counting.
+	var delta Usage
+	if recorded.PromptTokens == 0 && recorded.CompletionTokens == 0 {
+		delta = Usage{
+			PromptTokens:     stats.Data.TokensPrompt,
+			CompletionTokens: stats.Data.TokensCompletion,
+		}
+	}
+	if err := addUsage(ctx, userID, model, at, 0, delta, stats.Data.TotalCost-recordedCost); err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to correct usage: %v", err))
+		return
+	}
+	checkBudgetWarnings(ctx, userID, username)
+	logMessage(userID, username, "usage", fmt.Sprintf("[%s] Exact cost for %s: $%.6f", model, generationID, stats.Data.TotalCost))
+}
+
+// fetchGenerationStats gets the stats of a completion from OpenRouter's generation endpoint
+func fetchGenerationStats(ctx context.Context, generationID string) (*OpenRouterGenerationResponse, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", openRouterBaseURL+"/generation?id="+generationID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+config.OpenRouterAPIKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch generation: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var stats OpenRouterGenerationResponse
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &stats, nil
+}
+
+// formatUsage renders the usage of a ledger period with a per-model breakdown
+func formatUsage(title string, usage map[string]*ModelUsage) string {
+	var total ModelUsage
+	models := make([]string, 0, len(usage))
+	for model, u := range usage {
+		models = append(models, model)
+		total.Requests += u.Requests
+		total.PromptTokens += u.PromptTokens
+		total.CompletionTokens += u.CompletionTokens
+		total.Cost += u.Cost
+	}
+
+	// Most expensive models first
+	sort.Slice(models, func(i, j int) bool {
+		return usage[models[i]].Cost > usage[models[j]].Cost
+	})
+
+	text := fmt.Sprintf("%s: $%.4f (%d requests, %d in / %d out tokens)\n",
+		title, total.Cost, total.Requests, total.PromptTokens, total.CompletionTokens)
+	for _, model := range models {
+		u := usage[model]
+		text += fmt.Sprintf("  • %s: $%.4f (%d requests, %d in / %d out tokens)\n",
+			model, u.Cost, u.Requests, u.PromptTokens, u.CompletionTokens)
+	}
+	return text
+}
+
+func handleUsage(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", "/usage")
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	keys := usageKeys(userID, time.Now())
+	titles := []string{"Today", "This month", "All time"}
+
+	text := "📊 Your usage\n"
+	for i, key := range keys {
+		usage, err := getUsage(context.Background(), key)
+		if err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to get usage: %v", err))
+			_, err = msg.Reply(b, "Sorry, I encountered an error retrieving your usage.", &gotgbot.SendMessageOpts{
+				ReplyMarkup: getKeyboard(userMode),
+			})
+			return err
+		}
+		text += "\n" + formatUsage(titles[i], usage)
+	}
+
+	_, err = msg.Reply(b, text, &gotgbot.SendMessageOpts{
+		ReplyMarkup: getKeyboard(userMode),
+	})
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// maxImageSize is the largest image sent to a model. Bots can download files up to 20 MB,
+// but vision APIs reject much smaller images already.
+const maxImageSize = 10 * 1024 * 1024
+
+// imageCacheSize limits how many downloaded images are kept in memory, so the images
+// in a conversation history are not downloaded again for every new message
+const imageCacheSize = 32
+
+// imageCache holds downloaded images by Telegram file ID
+var imageCache = struct {
+	sync.Mutex
+	images map[string][]byte
+}{images: make(map[string][]byte)}
+
+// modelSupportsVision reports whether images can be sent to the model.
+// OpenRouter tells us which models accept images, other providers are trusted to.
+func modelSupportsVision(model string) bool {
+	if provider, _ := parseModelID(model); provider != defaultProvider {
+		return true
+	}
+	info, ok := findModelInfo(model)
+	return ok && info.SupportsVision
+}
+
+// getMessageContent builds the content of an incoming message from its text or caption
+// and an attached photo or image document
+func getMessageContent(msg *gotgbot.Message) MessageContent {
+	text := msg.Text
+	if text == "" {
+		text = msg.Caption
+	}
+
+	// Images go first, most models follow instructions about an image better that way
+	var content MessageContent
+	if len(msg.Photo) > 0 {
+		// Telegram sends the photo in several sizes, the last one is the largest
+		photo := msg.Photo[len(msg.Photo)-1]
+		content = append(content, ContentPart{Type: "image", FileID: photo.FileId, MimeType: "image/jpeg"})
+	} else if msg.Document != nil && strings.HasPrefix(msg.Document.MimeType, "image/") {
+		content = append(content, ContentPart{Type: "image", FileID: msg.Document.FileId, MimeType: msg.Document.MimeType})
+	}
+	return append(content, TextContent(text)...)
+}
+
+// loadImages returns a copy of messages with the bytes of every image loaded, so providers
+// can send them inline. The messages passed in are not modified.
+func loadImages(ctx context.Context, messages []Message) ([]Message, error) {
+	var result []Message
+	for i, msg := range messages {
+		if !msg.Content.HasImages() {
+			continue
+		}
+		if result == nil {
+			result = append([]Message(nil), messages...)
+		}
+
+		content := append(MessageContent(nil), msg.Content...)
+		for j, part := range content {
+			if part.Type != "image" || part.Data != nil {
+				continue
+			}
+			data, err := downloadImage(ctx, part.FileID)
+			if err != nil {
+				return nil, err
+			}
+			content[j].Data = data
+		}
+		result[i].Content = content
+	}
+
+	if result == nil {
+		return messages, nil
+	}
+	return result, nil
+}
+
+// downloadImage downloads an image through the Bot API, using the cache if possible
+func downloadImage(ctx context.Context, fileID string) ([]byte, error) {
+	imageCache.Lock()
+	data, ok := imageCache.images[fileID]
+	imageCache.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	data, err := downloadTelegramFile(ctx, fileID, maxImageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	imageCache.Lock()
+	if len(imageCache.images) >= imageCacheSize {
+		// Dropping everything is good enough, a conversation only has a few images
+		imageCache.images = make(map[string][]byte)
+	}
+	imageCache.images[fileID] = data
+	imageCache.Unlock()
+
+	return data, nil
+}
+
+// imageDataURL returns a data URL with the base64 encoded image of a loaded image part
+func imageDataURL(part ContentPart) string {
+	return fmt.Sprintf("data:%s;base64,%s", part.MimeType, base64.StdEncoding.EncodeToString(part.Data))
+}
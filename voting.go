@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/go-redis/redis/v8"
+)
+
+// comparisonTTL is how long the answers of a multi-model request can be voted on
+const comparisonTTL = 7 * 24 * time.Hour
+
+// allCategories is the leaderboard of votes in every category
+const allCategories = "all"
+
+// promptCategories are checked in order, the first one whose pattern matches the prompt is used
+var promptCategories = []struct {
+	Name    string
+	Pattern *regexp.Regexp
+}{
+	{"code", regexp.MustCompile("(?i)```|\\b(code|function|bug|error|compile|python|golang|javascript|typescript|java|sql|regex|api|script|debug)\\b")},
+	{"math", regexp.MustCompile(`(?i)\b(calculate|equation|integral|derivative|probability|proof|solve|math)\b|\d+\s*[-+*/^]\s*\d+`)},
+	{"translation", regexp.MustCompile(`(?i)\b(translate|translation|in english|in spanish|in german|in french|in russian)\b`)},
+	{"writing", regexp.MustCompile(`(?i)\b(write|rewrite|essay|story|poem|email|letter|summarize|summary|blog|article|tweet)\b`)},
+}
+
+// defaultCategory is used for prompts that match no category
+const defaultCategory = "general"
+
+// Comparison is a multi-model request whose answers can be voted on
+type Comparison struct {
+	UserID   int64    `json:"user_id"`
+	Category string   `json:"category"`
+	Models   []string `json:"models"` // Models that answered, in the order of the vote buttons
+	Labels   []string `json:"labels"` // Shown instead of the model names in blind mode
+}
+
+// name returns what the i-th answer is called before the vote
+func (c *Comparison) name(i int) string {
+	if len(c.Labels) > 0 {
+		return c.Labels[i]
+	}
+	return c.Models[i]
+}
+
+// categorizePrompt returns the category a prompt is counted under on the leaderboard
+func categorizePrompt(text string) string {
+	for _, category := range promptCategories {
+		if category.Pattern.MatchString(text) {
+			return category.Name
+		}
+	}
+	return defaultCategory
+}
+
+// categoryNames returns every category, including the default one
+func categoryNames() []string {
+	names := make([]string, 0, len(promptCategories)+1)
+	for _, category := range promptCategories {
+		names = append(names, category.Name)
+	}
+	return append(names, defaultCategory)
+}
+
+func isAnswerVotingEnabled() bool {
+	return config.AnswerVoting
+}
+
+func blindVotingKey(userID int64) string {
+	return fmt.Sprintf("user:%d:blind_voting", userID)
+}
+
+// isBlindVoting reports whether the user wants model names hidden until they voted
+func isBlindVoting(ctx context.Context, userID int64) (bool, error) {
+	blind, err := rdb.Get(ctx, blindVotingKey(userID)).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("redis get error: %w", err)
+	}
+	return blind == "true", nil
+}
+
+// answerLabel names the i-th answer of a blind comparison
+func answerLabel(i int) string {
+	return fmt.Sprintf("Answer %c", 'A'+i)
+}
+
+// leaderboardKey holds the votes of a category as "<model>:wins" and "<model>:games" hash
+// fields, for the whole team or for a single user if userID is not zero
+func leaderboardKey(userID int64, category string) string {
+	if userID == 0 {
+		return "leaderboard:" + category
+	}
+	return fmt.Sprintf("user:%d:leaderboard:%s", userID, category)
+}
+
+// saveComparison stores the comparison and returns its ID
+func saveComparison(ctx context.Context, comparison Comparison) (int64, error) {
+	id, err := rdb.Incr(ctx, "comparison:next_id").Result()
+	if err != nil {
+		return 0, fmt.Errorf("redis incr error: %w", err)
+	}
+	data, err := json.Marshal(comparison)
+	if err != nil {
+		return 0, fmt.Errorf("json marshal error: %w", err)
+	}
+	if err := rdb.Set(ctx, fmt.Sprintf("comparison:%d", id), data, comparisonTTL).Err(); err != nil {
+		return 0, fmt.Errorf("redis set error: %w", err)
+	}
+	return id, nil
+}
+
+// getComparison returns a stored comparison, or nil if it expired
+func getComparison(ctx context.Context, id int64) (*Comparison, error) {
+	data, err := rdb.Get(ctx, fmt.Sprintf("comparison:%d", id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis get error: %w", err)
+	}
+	var comparison Comparison
+	if err := json.Unmarshal([]byte(data), &comparison); err != nil {
+		return nil, fmt.Errorf("json unmarshal error: %w", err)
+	}
+	return &comparison, nil
+}
+
+// recordVote counts a win for the chosen model and a game for every model of the comparison,
+// on the user's and the team's leaderboard of the category and of all categories.
+// It returns false if the comparison was already voted on.
+func recordVote(ctx context.Context, id int64, comparison *Comparison, winner int) (bool, error) {
+	first, err := rdb.SetNX(ctx, fmt.Sprintf("comparison:%d:voted", id), winner, comparisonTTL).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis setnx error: %w", err)
+	}
+	if !first {
+		return false, nil
+	}
+
+	pipe := rdb.TxPipeline()
+	for _, userID := range []int64{0, comparison.UserID} {
+		for _, category := range []string{comparison.Category, allCategories} {
+			key := leaderboardKey(userID, category)
+			for _, model := range comparison.Models {
+				pipe.HIncrBy(ctx, key, model+":games", 1)
+			}
+			pipe.HIncrBy(ctx, key, comparison.Models[winner]+":wins", 1)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, fmt.Errorf("redis pipeline error: %w", err)
+	}
+	return true, nil
+}
+
+// sendVote asks which answer of a multi-model request was best. models are the models that
+// answered and labels their names in blind mode, nil otherwise.
+func sendVote(ctx context.Context, b *gotgbot.Bot, msg *gotgbot.Message, userID int64, prompt string, models []string, labels []string) error {
+	comparison := Comparison{
+		UserID:   userID,
+		Category: categorizePrompt(prompt),
+		Models:   models,
+		Labels:   labels,
+	}
+	id, err := saveComparison(ctx, comparison)
+	if err != nil {
+		return err
+	}
+
+	var keyboard [][]gotgbot.InlineKeyboardButton
+	for i := range models {
+		keyboard = append(keyboard, []gotgbot.InlineKeyboardButton{{
+			Text:         comparison.name(i),
+			CallbackData: fmt.Sprintf("vote:%d:%d", id, i),
+		}})
+	}
+	_, err = msg.Reply(b, "🗳 Which answer was best?", &gotgbot.SendMessageOpts{
+		ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: keyboard},
+	})
+	return err
+}
+
+// handleVoteCallback records a vote and reveals the models of a blind comparison,
+// data is the callback data without "vote:"
+func handleVoteCallback(b *gotgbot.Bot, callback *gotgbot.CallbackQuery, userID int64, username string, data string) error {
+	msg := callback.Message
+	if msg == nil {
+		return fmt.Errorf("callback message is nil")
+	}
+	bg := context.Background()
+
+	idText, indexText, _ := strings.Cut(data, ":")
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid vote callback data: %s", data)
+	}
+	winner, err := strconv.Atoi(indexText)
+	if err != nil {
+		return fmt.Errorf("invalid vote callback data: %s", data)
+	}
+
+	comparison, err := getComparison(bg, id)
+	if err != nil {
+		return err
+	}
+	if comparison == nil || comparison.UserID != userID || winner < 0 || winner >= len(comparison.Models) {
+		_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{
+			Text:      "This vote is no longer available.",
+			ShowAlert: true,
+		})
+		return err
+	}
+
+	recorded, err := recordVote(bg, id, comparison, winner)
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to record vote: %v", err))
+		_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "Error saving your vote", ShowAlert: true})
+		return err
+	}
+	if !recorded {
+		_, err := callback.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "You already voted."})
+		return err
+	}
+	logMessage(userID, username, "vote", fmt.Sprintf("[%s] Voted for %s out of %s", comparison.Category, comparison.Models[winner], strings.Join(comparison.Models, ", ")))
+
+	text := fmt.Sprintf("🗳 You voted for %s", comparison.name(winner))
+	if len(comparison.Labels) > 0 {
+		text += fmt.Sprintf(" (%s).\n", comparison.Models[winner])
+		for i, model := range comparison.Models {
+			text += fmt.Sprintf("\n%s: %s", comparison.Labels[i], model)
+		}
+	} else {
+		text += "."
+	}
+	text += fmt.Sprintf("\n\nCounted under \"%s\", see /leaderboard.", comparison.Category)
+	if _, _, err := b.EditMessageText(text, &gotgbot.EditMessageTextOpts{
+		ChatId:    msg.GetChat().Id,
+		MessageId: msg.GetMessageId(),
+	}); err != nil {
+		return fmt.Errorf("failed to edit vote message: %w", err)
+	}
+
+	// Acknowledge the callback without showing alert
+	_, err = callback.Answer(b, nil)
+	return err
+}
+
+// leaderboardEntry is a model's record in a leaderboard
+type leaderboardEntry struct {
+	Model string
+	Wins  int64
+	Games int64
+}
+
+// getLeaderboard returns the models of a leaderboard, best win rate first
+func getLeaderboard(ctx context.Context, key string) ([]leaderboardEntry, error) {
+	fields, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis hgetall error: %w", err)
+	}
+
+	entries := make(map[string]*leaderboardEntry)
+	for field, value := range fields {
+		separator := strings.LastIndex(field, ":")
+		if separator < 0 {
+			continue
+		}
+		model, counter := field[:separator], field[separator+1:]
+		count, _ := strconv.ParseInt(value, 10, 64)
+		if entries[model] == nil {
+			entries[model] = &leaderboardEntry{Model: model}
+		}
+		switch counter {
+		case "wins":
+			entries[model].Wins = count
+		case "games":
+			entries[model].Games = count
+		}
+	}
+
+	leaderboard := make([]leaderboardEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Games > 0 {
+			leaderboard = append(leaderboard, *entry)
+		}
+	}
+	sort.Slice(leaderboard, func(i, j int) bool {
+		rateI := float64(leaderboard[i].Wins) / float64(leaderboard[i].Games)
+		rateJ := float64(leaderboard[j].Wins) / float64(leaderboard[j].Games)
+		if rateI != rateJ {
+			return rateI > rateJ
+		}
+		if leaderboard[i].Games != leaderboard[j].Games {
+			return leaderboard[i].Games > leaderboard[j].Games
+		}
+		return leaderboard[i].Model < leaderboard[j].Model
+	})
+	return leaderboard, nil
+}
+
+// formatLeaderboard renders a leaderboard with win rates
+func formatLeaderboard(title string, leaderboard []leaderboardEntry) string {
+	text := title + "\n"
+	if len(leaderboard) == 0 {
+		return text + "No votes yet.\n"
+	}
+	for i, entry := range leaderboard {
+		text += fmt.Sprintf("%d. %s: %.0f%% (%d of %d)\n", i+1, entry.Model,
+			float64(entry.Wins)*100/float64(entry.Games), entry.Wins, entry.Games)
+	}
+	return text
+}
+
+// handleLeaderboard shows the win rates of the models in multi-model votes:
+//
+//	/leaderboard [category]
+//	/leaderboard blind on|off
+func handleLeaderboard(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	userID := msg.From.Id
+	username := msg.From.Username
+
+	// Check if user is allowed
+	if !isUserAllowed(userID) {
+		logMessage(userID, username, "access_denied", "User not in allowed list")
+		_, err := msg.Reply(b, "Sorry, you are not authorized to use this bot.", nil)
+		return err
+	}
+
+	logMessage(userID, username, "command", msg.Text)
+	userMode, err := getUserMode(context.Background(), userID)
+	if err != nil {
+		logMessage(userID, username, "error", "Failed to get user mode")
+		userMode = "text" // fallback to text mode
+	}
+
+	reply := func(text string) error {
+		_, err := msg.Reply(b, text, &gotgbot.SendMessageOpts{
+			ReplyMarkup: getKeyboard(userMode),
+		})
+		return err
+	}
+
+	if !isAnswerVotingEnabled() {
+		return reply("Voting on answers is not enabled.")
+	}
+
+	args, _ := splitCommand(msg.Text, 3)
+	category := allCategories
+	if len(args) > 1 {
+		category = strings.ToLower(args[1])
+	}
+
+	if category == "blind" {
+		if len(args) < 3 || (args[2] != "on" && args[2] != "off") {
+			blind, err := isBlindVoting(context.Background(), userID)
+			if err != nil {
+				logMessage(userID, username, "error", fmt.Sprintf("Failed to get blind voting: %v", err))
+			}
+			state := "off"
+			if blind {
+				state = "on"
+			}
+			return reply(fmt.Sprintf("Blind voting is %s. Use /leaderboard blind on to hide the model names until you voted.", state))
+		}
+		if err := rdb.Set(context.Background(), blindVotingKey(userID), strconv.FormatBool(args[2] == "on"), 0).Err(); err != nil {
+			logMessage(userID, username, "error", fmt.Sprintf("Failed to set blind voting: %v", err))
+			return reply("Sorry, the setting could not be saved.")
+		}
+		if args[2] == "on" {
+			return reply("🙈 Blind voting is on. Answers are labeled A, B, C… until you vote.")
+		}
+		return reply("Blind voting is off, answers show their model names.")
+	}
+
+	valid := category == allCategories
+	for _, name := range categoryNames() {
+		valid = valid || name == category
+	}
+	if !valid {
+		return reply(fmt.Sprintf("Unknown category %q. Categories: %s", category, strings.Join(categoryNames(), ", ")))
+	}
+
+	team, err := getLeaderboard(context.Background(), leaderboardKey(0, category))
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to get leaderboard: %v", err))
+		return reply("Sorry, the leaderboard could not be loaded.")
+	}
+	own, err := getLeaderboard(context.Background(), leaderboardKey(userID, category))
+	if err != nil {
+		logMessage(userID, username, "error", fmt.Sprintf("Failed to get leaderboard: %v", err))
+		return reply("Sorry, the leaderboard could not be loaded.")
+	}
+
+	title := "all categories"
+	if category != allCategories {
+		title = category
+	}
+	text := fmt.Sprintf("🏆 Leaderboard (%s)\n\n", title) +
+		formatLeaderboard("Team:", team) + "\n" +
+		formatLeaderboard("Your votes:", own) +
+		fmt.Sprintf("\nWin rate is how often a model's answer was voted best when it was compared.\n"+
+			"Categories: %s. Use /leaderboard <category> to see one.", strings.Join(categoryNames(), ", "))
+	return reply(text)
+}